@@ -1,6 +1,7 @@
 package ast
 
 type Program struct {
+	File   string
 	Module *ModStmt
 	Links  []*LinkStmt
 	Types  []*TypeStmt
@@ -28,8 +29,9 @@ type Stmt interface {
 }
 
 type ModStmt struct {
-	loc  Location
-	Name *StringLiteral
+	loc     Location
+	Name    *StringLiteral
+	Version *StringLiteral // the version of the compiler when nil
 }
 
 func (s *ModStmt) Location() Location {
@@ -40,18 +42,33 @@ func Mod(name string) *ModStmt {
 	return &ModStmt{Name: String(name)}
 }
 
+func VersionedMod(name string, version string) *ModStmt {
+	return &ModStmt{Name: String(name), Version: String(version)}
+}
+
 type ConstStmt struct {
 	loc     Location
-	Name    *Identifier // for fn consts
+	Name    *Identifier // for fn consts and named consts
 	Index   *IntLiteral
 	Type    *Identifier
 	Literal Literal
+	Public  bool // exported to other modules, needs a name
 }
 
 func (s *ConstStmt) Location() Location {
 	return s.loc
 }
 
+func (s *ConstStmt) At(loc Location) *ConstStmt {
+	s.loc = loc
+	return s
+}
+
+func (s *ConstStmt) Export() *ConstStmt {
+	s.Public = true
+	return s
+}
+
 func Const(idx int, typ string, lit Literal) *ConstStmt {
 	return &ConstStmt{
 		Index:   Int(idx),
@@ -60,6 +77,15 @@ func Const(idx int, typ string, lit Literal) *ConstStmt {
 	}
 }
 
+func NamedConst(name string, idx int, typ string, lit Literal) *ConstStmt {
+	return &ConstStmt{
+		Index:   Int(idx),
+		Name:    Ident(name),
+		Type:    Ident(typ),
+		Literal: lit,
+	}
+}
+
 func FnConst(name string, idx int, typ string, lit Literal) *ConstStmt {
 	return &ConstStmt{
 		Index:   Int(idx),
@@ -70,9 +96,10 @@ func FnConst(name string, idx int, typ string, lit Literal) *ConstStmt {
 }
 
 type LinkStmt struct {
-	loc   Location
-	Index *IntLiteral
-	Mod   *StringLiteral
+	loc        Location
+	Index      *IntLiteral
+	Mod        *StringLiteral
+	Constraint *StringLiteral // like ^1.2.0, any version when nil
 }
 
 func (s *LinkStmt) Location() Location {
@@ -86,6 +113,14 @@ func Link(idx int, mod string) *LinkStmt {
 	}
 }
 
+func VersionedLink(idx int, mod string, constraint string) *LinkStmt {
+	return &LinkStmt{
+		Index:      Int(idx),
+		Mod:        String(mod),
+		Constraint: String(constraint),
+	}
+}
+
 type TypeField struct {
 	loc   Location
 	Name  *StringLiteral
@@ -103,12 +138,18 @@ type TypeStmt struct {
 	Name   *Identifier
 	Index  *IntLiteral
 	Fields []TypeField
+	Public bool
 }
 
 func (s *TypeStmt) Location() Location {
 	return s.loc
 }
 
+func (s *TypeStmt) Export() *TypeStmt {
+	s.Public = true
+	return s
+}
+
 type OpStmt interface {
 	Stmt
 	opstmt()
@@ -118,12 +159,18 @@ type Op struct {
 	loc      Location
 	Name     *Identifier
 	Operands []*IntLiteral
+	Symbol   *SymbolRef // replaces the operands of load.modconst std.println
 }
 
 func (s *Op) Location() Location {
 	return s.loc
 }
 
+func (s *Op) At(loc Location) *Op {
+	s.loc = loc
+	return s
+}
+
 func NewOp(name string, operands ...int) *Op {
 	ops := make([]*IntLiteral, len(operands))
 
@@ -137,8 +184,39 @@ func NewOp(name string, operands ...int) *Op {
 	}
 }
 
+// Creates an op that refers to an exported const of a linked module by name
+func NewSymbolOp(name string, symbol *SymbolRef) *Op {
+	return &Op{
+		Name:   Ident(name),
+		Symbol: symbol,
+	}
+}
+
+// A name exported by a linked module, written as mod.name
+type SymbolRef struct {
+	loc  Location
+	Mod  *Identifier
+	Name *Identifier
+}
+
+func (r *SymbolRef) Location() Location {
+	return r.loc
+}
+
+func (r *SymbolRef) String() string {
+	return r.Mod.Value + "." + r.Name.Value
+}
+
+func Sym(mod, name string) *SymbolRef {
+	return &SymbolRef{
+		Mod:  Ident(mod),
+		Name: Ident(name),
+	}
+}
+
 type Label struct {
 	loc   Location
+	Name  *Identifier
 	Index *IntLiteral
 	Ops   []OpStmt
 }
@@ -147,6 +225,11 @@ func (s *Label) Location() Location {
 	return s.loc
 }
 
+func (s *Label) At(loc Location) *Label {
+	s.loc = loc
+	return s
+}
+
 func NewLabel(idx int, ops ...OpStmt) *Label {
 	return &Label{
 		Index: Int(idx),
@@ -154,6 +237,14 @@ func NewLabel(idx int, ops ...OpStmt) *Label {
 	}
 }
 
+func NamedLabel(name string, idx int, ops ...OpStmt) *Label {
+	return &Label{
+		Name:  Ident(name),
+		Index: Int(idx),
+		Ops:   ops,
+	}
+}
+
 func (*Op) opstmt()    {}
 func (*Label) opstmt() {}
 
@@ -263,8 +354,9 @@ func Data(v ...Literal) *DataLiteral {
 }
 
 type FnLiteral struct {
-	loc Location
-	Ops []OpStmt
+	loc    Location
+	Params []*Identifier
+	Ops    []OpStmt
 }
 
 func (l *FnLiteral) Location() Location {
@@ -278,3 +370,13 @@ func (l *FnLiteral) Value() any {
 func Fn(ops ...OpStmt) *FnLiteral {
 	return &FnLiteral{Ops: ops}
 }
+
+func FnParams(params []string, ops ...OpStmt) *FnLiteral {
+	idents := make([]*Identifier, len(params))
+
+	for i, param := range params {
+		idents[i] = Ident(param)
+	}
+
+	return &FnLiteral{Params: idents, Ops: ops}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/canpacis/flint/common"
+	"github.com/canpacis/flint/dap"
+	"github.com/canpacis/flint/debug"
+	"github.com/canpacis/flint/profile"
+	"github.com/canpacis/flint/vfs"
+	"github.com/canpacis/flint/vm"
+)
+
+const usage = `usage: flint <command> [arguments]
+
+commands:
+  run [-profile file] [-fs dir] <archive> [-- args...]
+                    run a compiled archive and exit with its status
+  debug <archive>   debug a compiled archive in the terminal
+  dap [-listen addr]
+                    serve the debug adapter protocol over stdio or a local socket`
+
+func load(path string, config vm.Config, options ...vm.InitOption) (*vm.VM, error) {
+	archive, err := common.OpenArchive(path)
+	if err != nil {
+		return nil, err
+	}
+
+	machine := vm.NewVMWithConfig(config)
+	if err := machine.Init(archive, vm.DefaultBuiltins(machine), options...); err != nil {
+		return nil, err
+	}
+	return machine, nil
+}
+
+func run(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	profpath := flags.String("profile", "", "write a pprof profile of the run to a file")
+	dir := flags.String("fs", "", "give the program read and write access to a directory")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	config := vm.DefaultConfig()
+	if *dir != "" {
+		root, err := vfs.Dir(*dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		config.FS = vfs.NewSandbox(root).Grant(".", vfs.Read|vfs.Write)
+	}
+	// The archive is the first argument of the program, like a command name
+	argv := flags.Args()
+	if len(argv) > 1 && argv[1] == "--" {
+		argv = append(argv[:1:1], argv[2:]...)
+	}
+	machine, err := load(flags.Arg(0), config, vm.WithArgs(argv...), vm.WithEnv(environ()))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var profiler *profile.Profiler
+	if *profpath != "" {
+		profiler = profile.New()
+		profiler.Start(machine)
+	}
+	machine.Run()
+	// There is no host to hand a value to, yields just continue the program
+	for machine.State() == vm.StateSuspended {
+		if err := machine.Resume(nil); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if profiler != nil {
+		profiler.Stop()
+		if err := writeFile(*profpath, profiler); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	result := machine.Result()
+	if result.Paniced {
+		fmt.Fprintf(os.Stderr, "panic: %s\n", machine.PanicMessage())
+	}
+	return result.Code
+}
+
+func environ() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+func writeFile(path string, w io.WriterTo) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := w.WriteTo(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func debugger(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	machine, err := load(args[0], vm.DefaultConfig())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	terminal := debug.NewTerminal(debug.New(machine), os.Stdin, os.Stdout)
+	if err := terminal.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func adapter(args []string) int {
+	flags := flag.NewFlagSet("dap", flag.ContinueOnError)
+	listen := flags.String("listen", "", "serve on a loopback tcp address, like 127.0.0.1:4711, instead of stdio")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var err error
+	if *listen != "" {
+		err = dap.ListenAndServe(*listen, nil)
+	} else {
+		err = dap.NewServer(os.Stdin, os.Stdout, nil).Serve()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "run":
+		os.Exit(run(os.Args[2:]))
+	case "debug":
+		os.Exit(debugger(os.Args[2:]))
+	case "dap":
+		os.Exit(adapter(os.Args[2:]))
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
@@ -1,35 +1,145 @@
 package common
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"strings"
 )
 
+var ErrModuleNotFound = errors.New("module not found")
+var ErrModuleCollision = errors.New("module collision")
+
+// A module written to an archive, its id is its index in the module table
+type ModuleEntry struct {
+	Name    string
+	Version Version
+	Pointer int
+	// Debug info of the module, kept out of the module pool so it does not take up its space
+	Debug *DebugInfo
+}
+
+// Modules are identified by name and version, an archive can hold several versions of a module
+type moduleKey struct {
+	name    string
+	version Version
+}
+
 type Archive struct {
-	Modules    *Pool
+	modules    *Pool
+	table      []ModuleEntry
+	ids        map[moduleKey]int
 	entrymod   uint32
 	entryconst uint32
 }
 
+func OpenArchive(path string) (*Archive, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	archive := NewArchive()
+	if _, err := archive.ReadFrom(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("failed to read archive %s: %w", path, err)
+	}
+	return archive, nil
+}
+
 func NewArchive() *Archive {
 	return &Archive{
-		Modules: NewPool(),
+		modules: NewPool(),
+		ids:     make(map[moduleKey]int),
 	}
 }
 
-func (a *Archive) SetEntry(mod, c int) {
-	a.entrymod = uint32(mod)
-	a.entryconst = uint32(c)
+// Writes mod to the archive and returns its id. Adding a module that is already in
+// the archive returns the id it was written with, a different module with the same
+// name and version is a collision
+func (a *Archive) AddModule(mod *Module) (int, error) {
+	debug := mod.Debug
+	stripped := *mod
+	stripped.Strip()
+	mod = &stripped
+
+	key := moduleKey{mod.Name, mod.Version}
+	id, ok := a.ids[key]
+	if !ok {
+		id = len(a.table)
+		pointer, err := a.modules.Set(id, mod)
+		if err != nil {
+			return -1, err
+		}
+		a.table = append(a.table, ModuleEntry{Name: mod.Name, Version: mod.Version, Pointer: pointer, Debug: debug})
+		a.ids[key] = id
+		return id, nil
+	}
+
+	entry := a.table[id]
+	buf := new(bytes.Buffer)
+	if _, err := mod.WriteTo(buf); err != nil {
+		return -1, err
+	}
+	data := a.modules.Bytes()
+	end := entry.Pointer + buf.Len()
+	if end > len(data) || !bytes.Equal(data[entry.Pointer:end], buf.Bytes()) {
+		return -1, fmt.Errorf("%w: two different modules are %s %s", ErrModuleCollision, mod.Name, mod.Version)
+	}
+	return id, nil
 }
 
-func (a *Archive) MainModule() (*Module, error) {
+// Returns the id of the newest version of the module called name that satisfies constraint
+func (a *Archive) Lookup(name string, constraint Constraint) (int, bool) {
+	found := -1
+	for id, entry := range a.table {
+		if entry.Name != name || !constraint.Match(entry.Version) {
+			continue
+		}
+		if found < 0 || entry.Version > a.table[found].Version {
+			found = id
+		}
+	}
+	return found, found >= 0
+}
+
+// Returns the module table, indexed by module id
+func (a *Archive) Entries() []ModuleEntry {
+	return a.table
+}
+
+func (a *Archive) ModuleAt(id int) (*Module, error) {
+	if id < 0 || id >= len(a.table) {
+		return nil, fmt.Errorf("%w: id %d", ErrModuleNotFound, id)
+	}
+	entry := a.table[id]
 	mod := NewModule("", 0)
-	if err := a.Modules.Get(int(a.entrymod), mod); err != nil {
+	if err := a.modules.Get(entry.Pointer, mod); err != nil {
 		return nil, err
 	}
+	if mod.Name != entry.Name || mod.Version != entry.Version {
+		return nil, fmt.Errorf("module %d is %s %s, the module table expects %s %s", id, mod.Name, mod.Version, entry.Name, entry.Version)
+	}
+	mod.Debug = entry.Debug
 	return mod, nil
 }
 
+// Sets the module id and const pointer of the main function
+func (a *Archive) SetEntry(mod, c int) {
+	a.entrymod = uint32(mod)
+	a.entryconst = uint32(c)
+}
+
+// Returns the module id and const pointer of the main function
+func (a *Archive) Entry() (int, int) {
+	return int(a.entrymod), int(a.entryconst)
+}
+
+func (a *Archive) MainModule() (*Module, error) {
+	return a.ModuleAt(int(a.entrymod))
+}
+
 func (a *Archive) MainFn() (*Const, error) {
 	mod, err := a.MainModule()
 	if err != nil {
@@ -42,6 +152,29 @@ func (a *Archive) MainFn() (*Const, error) {
 	return fn, nil
 }
 
+// Finds the newest version of the module called name that satisfies constraint and
+// returns it with its id
+func (a *Archive) Module(name string, constraint Constraint) (*Module, int, error) {
+	id, ok := a.Lookup(name, constraint)
+	if !ok {
+		versions := []string{}
+		for _, entry := range a.table {
+			if entry.Name == name {
+				versions = append(versions, entry.Version.String())
+			}
+		}
+		if len(versions) == 0 {
+			return nil, -1, fmt.Errorf("%w: %s", ErrModuleNotFound, name)
+		}
+		return nil, -1, fmt.Errorf("%w: %s %s requires %s", ErrVersionMismatch, name, strings.Join(versions, ", "), constraint)
+	}
+	mod, err := a.ModuleAt(id)
+	if err != nil {
+		return nil, -1, err
+	}
+	return mod, id, nil
+}
+
 func (a *Archive) WriteTo(w io.Writer) (n int64, err error) {
 	if err := binary.Write(w, binary.LittleEndian, a.entrymod); err != nil {
 		return n, err
@@ -53,7 +186,40 @@ func (a *Archive) WriteTo(w io.Writer) (n int64, err error) {
 	} else {
 		n += 4
 	}
-	if m, err := a.Modules.WriteTo(w); err != nil {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(a.table))); err != nil {
+		return n, err
+	} else {
+		n += 4
+	}
+	for _, entry := range a.table {
+		if m, err := writeString(w, entry.Name); err != nil {
+			return n, err
+		} else {
+			n += m
+		}
+		if err := binary.Write(w, binary.LittleEndian, [2]uint32{uint32(entry.Version), uint32(entry.Pointer)}); err != nil {
+			return n, err
+		} else {
+			n += 8
+		}
+		var flags ModuleFlag
+		if entry.Debug != nil {
+			flags |= ModuleDebugInfo
+		}
+		if m, err := w.Write([]byte{byte(flags)}); err != nil {
+			return n, err
+		} else {
+			n += int64(m)
+		}
+		if entry.Debug != nil {
+			if m, err := entry.Debug.WriteTo(w); err != nil {
+				return n, err
+			} else {
+				n += m
+			}
+		}
+	}
+	if m, err := a.modules.WriteTo(w); err != nil {
 		return n, err
 	} else {
 		n += m
@@ -72,7 +238,49 @@ func (a *Archive) ReadFrom(r io.Reader) (n int64, err error) {
 	} else {
 		n += 4
 	}
-	if m, err := a.Modules.ReadFrom(r); err != nil {
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return n, err
+	} else {
+		n += 4
+	}
+	a.table = make([]ModuleEntry, length)
+	a.ids = make(map[moduleKey]int, length)
+	for id := range a.table {
+		name, m, err := readString(r)
+		if err != nil {
+			return n, err
+		}
+		n += m
+		var fields [2]uint32
+		if err := binary.Read(r, binary.LittleEndian, &fields); err != nil {
+			return n, err
+		} else {
+			n += 8
+		}
+		flags := make([]byte, 1)
+		if m, err := io.ReadFull(r, flags); err != nil {
+			return n, err
+		} else {
+			n += int64(m)
+		}
+		var debug *DebugInfo
+		if ModuleFlag(flags[0])&ModuleDebugInfo != 0 {
+			debug = new(DebugInfo)
+			if m, err := debug.ReadFrom(r); err != nil {
+				return n, err
+			} else {
+				n += m
+			}
+		}
+		key := moduleKey{name, Version(fields[0])}
+		if _, ok := a.ids[key]; ok {
+			return n, fmt.Errorf("%w: %s %s is in the module table twice", ErrModuleCollision, name, key.version)
+		}
+		a.table[id] = ModuleEntry{Name: name, Version: key.version, Pointer: int(fields[1]), Debug: debug}
+		a.ids[key] = id
+	}
+	if m, err := a.modules.ReadFrom(r); err != nil {
 		return n, err
 	} else {
 		n += m
@@ -65,6 +65,17 @@ const (
 	OpYield
 	OpTrap
 	OpHalt
+	OpHaltCode
+
+	// Threads
+	OpSpawn
+	OpJoin
+	OpChan
+	OpSend
+	OpRecv
+	OpTrySend
+	OpTryRecv
+	OpClose
 )
 
 func (c OpCode) String() string {
@@ -139,6 +150,15 @@ var ops = map[OpCode]OpDefinition{
 	OpYield:       {"yield", []int{}},
 	OpTrap:        {"trap", []int{}},
 	OpHalt:        {"halt", []int{}},
+	OpHaltCode:    {"halt.code", []int{}},
+	OpSpawn:       {"spawn", []int{2}},
+	OpJoin:        {"join", []int{}},
+	OpChan:        {"chan", []int{2}},
+	OpSend:        {"send", []int{}},
+	OpRecv:        {"recv", []int{}},
+	OpTrySend:     {"try.send", []int{}},
+	OpTryRecv:     {"try.recv", []int{}},
+	OpClose:       {"close", []int{}},
 }
 
 func LookupOp(code byte) (OpDefinition, error) {
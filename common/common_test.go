@@ -2,6 +2,7 @@ package common_test
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
 	"testing"
 
@@ -203,6 +204,15 @@ func TestModules(t *testing.T) {
 			mod.Consts.Set(1, common.NewConst(common.I64Const, int64(0)))
 			return mod
 		}},
+		{func() *common.Module {
+			mod := common.NewModule("main", common.NewVersion(0, 0, 1))
+
+			pointer, _ := mod.Consts.Set(0, common.NewConst(common.StrConst, "Hello, World!"))
+			mod.Symbols.Add(common.Symbol{Name: "greeting", Kind: common.ConstSymbol, Visibility: common.Public, Pointer: pointer})
+			pointer, _ = mod.Consts.Set(1, common.NewConst(common.I64Const, int64(0)))
+			mod.Symbols.Add(common.Symbol{Name: "zero", Kind: common.ConstSymbol, Visibility: common.Private, Pointer: pointer})
+			return mod
+		}},
 	}
 
 	for i, test := range tests {
@@ -220,9 +230,35 @@ func TestModules(t *testing.T) {
 		assert.Equalf(mod.Links.Bytes(), decoded.Links.Bytes(), "Links: Test case %d", i)
 		assert.Equalf(mod.Types.Bytes(), decoded.Types.Bytes(), "Types: Test case %d", i)
 		assert.Equalf(mod.Consts.Bytes(), decoded.Consts.Bytes(), "Consts: Test case %d", i)
+		assert.Equalf(len(mod.Symbols.Symbols), len(decoded.Symbols.Symbols), "Symbols: Test case %d", i)
+		for j, symbol := range mod.Symbols.Symbols {
+			assert.Equalf(symbol, decoded.Symbols.Symbols[j], "Symbols: Test case %d", i)
+		}
 	}
 }
 
+func TestSymbolTable(t *testing.T) {
+	assert := assert.New(t)
+
+	table := common.NewSymbolTable()
+	assert.NoError(table.Add(common.Symbol{Name: "greeting", Visibility: common.Public, Pointer: 2}))
+	assert.ErrorIs(table.Add(common.Symbol{Name: "greeting"}), common.ErrSymbolExists)
+
+	buf := new(bytes.Buffer)
+	_, err := table.WriteTo(buf)
+	assert.NoError(err)
+	decoded := common.NewSymbolTable()
+	_, err = decoded.ReadFrom(buf)
+	assert.NoError(err)
+	assert.Equal(table.Symbols, decoded.Symbols)
+
+	// The length is checked before the symbols are allocated
+	buf.Reset()
+	assert.NoError(binary.Write(buf, binary.LittleEndian, uint32(common.MAX_SYMBOLS+1)))
+	_, err = decoded.ReadFrom(buf)
+	assert.ErrorIs(err, common.ErrSymbolTableTooLarge)
+}
+
 func TestTypes(t *testing.T) {}
 
 func TestVersion(t *testing.T) {
@@ -250,6 +286,51 @@ func TestVersion(t *testing.T) {
 	}
 }
 
+func TestConstraints(t *testing.T) {
+	assert := assert.New(t)
+
+	type ConstraintTest struct {
+		Constraint string
+		Version    string
+		Match      bool
+	}
+
+	tests := []ConstraintTest{
+		{"", "3.1.4", true},
+		{"*", "0.0.0", true},
+		{"1.2.3", "1.2.3", true},
+		{"=1.2.3", "1.2.4", false},
+		{"^1.2.3", "1.2.3", true},
+		{"^1.2.3", "1.9.0", true},
+		{"^1.2.3", "1.2.2", false},
+		{"^1.2.3", "2.0.0", false},
+		{"^0.2.3", "0.2.9", true},
+		{"^0.2.3", "0.3.0", false},
+		{"^0.0.3", "0.0.3", true},
+		{"^0.0.3", "0.0.4", false},
+		{"~1.2.3", "1.2.9", true},
+		{"~1.2.3", "1.3.0", false},
+		{"~1.2", "1.2.0", true},
+		{"^1", "1.5.2", true},
+	}
+
+	for i, test := range tests {
+		constraint, err := common.ParseConstraint(test.Constraint)
+		assert.NoErrorf(err, "Test case %d", i)
+		version, err := common.ParseVersion(test.Version)
+		assert.NoErrorf(err, "Test case %d", i)
+		assert.Equalf(test.Match, constraint.Match(version), "Test case %d: %s %s", i, test.Constraint, test.Version)
+	}
+
+	constraint, err := common.ParseConstraint("^1.2")
+	assert.NoError(err)
+	assert.Equal("^1.2.0", constraint.String())
+	for _, invalid := range []string{"^", "1.2.3.4", "~x", "1.256.0", ">=1.0.0"} {
+		_, err := common.ParseConstraint(invalid)
+		assert.Errorf(err, "Constraint %s", invalid)
+	}
+}
+
 func TestPool(t *testing.T) {
 	assert := assert.New(t)
 
@@ -262,12 +343,14 @@ func TestPool(t *testing.T) {
 	}
 
 	tests := []PoolTest{
-		{0, common.NewConst(common.U8Const, uint8(255)), &common.Const{}, 0, nil},           // Size 2
-		{1, common.NewConst(common.I32Const, int32(-255)), &common.Const{}, 2, nil},         // Size 5
-		{2, common.NewConst(common.F64Const, float64(3.14159265)), &common.Const{}, 7, nil}, // Size 9
-		{3, common.NewConst(common.StrConst, "Hello, World\n"), &common.Const{}, 16, nil},   // Size 18
-		{4, common.NewLink("io"), common.NewLink(""), 34, nil},                              // Size 4
-		{5, common.NewLink("std"), common.NewLink(""), 38, nil},                             // Size 5
+		{0, common.NewConst(common.U8Const, uint8(255)), &common.Const{}, 0, nil},                                                                            // Size 2
+		{1, common.NewConst(common.I32Const, int32(-255)), &common.Const{}, 2, nil},                                                                          // Size 5
+		{2, common.NewConst(common.F64Const, float64(3.14159265)), &common.Const{}, 7, nil},                                                                  // Size 9
+		{3, common.NewConst(common.StrConst, "Hello, World\n"), &common.Const{}, 16, nil},                                                                    // Size 18
+		{4, common.NewLink("io"), common.NewLink(""), 34, nil},                                                                                               // Size 14
+		{5, common.NewLink("std"), common.NewLink(""), 48, nil},                                                                                              // Size 15
+		{6, common.NewVersionedLink("json", common.Constraint{Kind: common.CaretVersion, Version: common.NewVersion(1, 2, 0)}), common.NewLink(""), 63, nil}, // Size 16
+		{7, &common.Link{Name: "fmt", Resolved: true, Version: common.NewVersion(1, 3, 0)}, common.NewLink(""), 79, nil},
 		{0, nil, nil, 0, common.ErrPoolKeyExists},
 	}
 
@@ -286,3 +369,162 @@ func TestPool(t *testing.T) {
 		}
 	}
 }
+
+func TestDebugInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	info := common.NewDebugInfo("main.flir")
+	info.Fns = append(info.Fns, &common.FnDebug{
+		Name:    "main.main",
+		Pointer: 4,
+		Line:    3,
+		Lines:   []common.LineEntry{{Offset: 0, Line: 4}, {Offset: 9, Line: 5}, {Offset: 12, Line: 7}},
+		Labels:  []common.LabelEntry{{Offset: 12, Name: "loop"}},
+		Locals:  []string{"a", "b"},
+	})
+
+	mod := common.NewModule("main", common.NewVersion(0, 0, 1))
+	mod.Debug = info
+	_, err := mod.Consts.Set(0, common.NewConst(common.I64Const, int64(1)))
+	assert.NoError(err)
+
+	buf := new(bytes.Buffer)
+	n, err := mod.WriteTo(buf)
+	assert.NoError(err)
+	assert.Equal(int64(mod.Len()), n)
+	assert.Equal(common.ModuleDebugInfo, common.ModuleFlag(buf.Bytes()[4+4+4+len(mod.Name)]))
+
+	decoded := common.NewModule("", 0)
+	_, err = decoded.ReadFrom(buf)
+	assert.NoError(err)
+	assert.Equal(info, decoded.Debug)
+
+	type PositionTest struct {
+		Offset       int
+		ExpectedLine int
+		ExpectedOk   bool
+	}
+
+	tests := []PositionTest{
+		{0, 4, true},
+		{5, 4, true},
+		{9, 5, true},
+		{11, 5, true},
+		{40, 7, true},
+	}
+
+	for i, test := range tests {
+		pos, ok := decoded.Debug.Position(4, test.Offset)
+		assert.Equalf(test.ExpectedOk, ok, "Test case %d", i)
+		assert.Equalf(test.ExpectedLine, pos.Line, "Test case %d", i)
+		assert.Equalf("main.flir", pos.File, "Test case %d", i)
+	}
+
+	_, ok := decoded.Debug.Position(0, 0)
+	assert.False(ok)
+
+	fn := decoded.Debug.Fn(4)
+	assert.Equal([]int{9}, fn.Offsets(5))
+	label, ok := fn.Label(12)
+	assert.True(ok)
+	assert.Equal("loop", label)
+	assert.Equal("b", fn.Local(1))
+	assert.Equal("local2", fn.Local(2))
+
+	mod.Strip()
+	buf.Reset()
+	_, err = mod.WriteTo(buf)
+	assert.NoError(err)
+	stripped := common.NewModule("", 0)
+	_, err = stripped.ReadFrom(buf)
+	assert.NoError(err)
+	assert.Nil(stripped.Debug)
+}
+
+func TestArchive(t *testing.T) {
+	assert := assert.New(t)
+
+	module := func(name string, version common.Version, value int64) *common.Module {
+		mod := common.NewModule(name, version)
+		_, err := mod.Consts.Set(0, common.NewConst(common.I64Const, value))
+		assert.NoError(err)
+		return mod
+	}
+
+	type ArchiveTest struct {
+		Module *common.Module
+		Id     int
+		Err    error
+	}
+
+	tests := []ArchiveTest{
+		{module("main", common.NewVersion(1, 0, 0), 1), 0, nil},
+		{module("io", common.NewVersion(1, 2, 0), 2), 1, nil},
+		{module("json", common.NewVersion(0, 1, 0), 3), 2, nil},
+		{module("io", common.NewVersion(1, 2, 0), 2), 1, nil},
+		{module("io", common.NewVersion(1, 3, 0), 2), 3, nil},
+		{module("json", common.NewVersion(0, 1, 0), 4), -1, common.ErrModuleCollision},
+	}
+
+	archive := common.NewArchive()
+	for i, test := range tests {
+		id, err := archive.AddModule(test.Module)
+		if test.Err != nil {
+			assert.ErrorIsf(err, test.Err, "Test case %d", i)
+			continue
+		}
+		assert.NoErrorf(err, "Test case %d", i)
+		assert.Equalf(test.Id, id, "Test case %d", i)
+	}
+	assert.Len(archive.Entries(), 4)
+	archive.SetEntry(0, 0)
+
+	buf := new(bytes.Buffer)
+	_, err := archive.WriteTo(buf)
+	assert.NoError(err)
+	read := common.NewArchive()
+	_, err = read.ReadFrom(buf)
+	assert.NoError(err)
+	assert.Equal(archive.Entries(), read.Entries())
+
+	mod, id, err := read.Module("json", common.Constraint{})
+	assert.NoError(err)
+	assert.Equal(2, id)
+	assert.Equal(common.NewVersion(0, 1, 0), mod.Version)
+	main, err := read.MainModule()
+	assert.NoError(err)
+	assert.Equal("main", main.Name)
+	_, _, err = read.Module("missing", common.Constraint{})
+	assert.ErrorIs(err, common.ErrModuleNotFound)
+	_, err = read.ModuleAt(4)
+	assert.ErrorIs(err, common.ErrModuleNotFound)
+
+	// Links pick the newest version that satisfies their constraint
+	type LookupTest struct {
+		Constraint string
+		Id         int
+		Err        error
+	}
+
+	lookups := []LookupTest{
+		{"", 3, nil},
+		{"^1.0.0", 3, nil},
+		{"~1.2.0", 1, nil},
+		{"=1.2.0", 1, nil},
+		{"^2.0.0", -1, common.ErrVersionMismatch},
+	}
+
+	for i, test := range lookups {
+		constraint, err := common.ParseConstraint(test.Constraint)
+		assert.NoErrorf(err, "Test case %d", i)
+		mod, id, err := read.Module("io", constraint)
+		if test.Err != nil {
+			assert.ErrorIsf(err, test.Err, "Test case %d", i)
+			assert.ErrorContainsf(err, "io 1.2.0, 1.3.0 requires ^2.0.0", "Test case %d", i)
+			continue
+		}
+		assert.NoErrorf(err, "Test case %d", i)
+		assert.Equalf(test.Id, id, "Test case %d", i)
+		assert.Equalf(read.Entries()[id].Version, mod.Version, "Test case %d", i)
+	}
+}
@@ -0,0 +1,310 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+var ErrDebugInfoTooLarge = errors.New("debug info is too large")
+
+// Upper limit of the entries and string lengths read from debug info, so a corrupt
+// file cannot make the reader allocate arbitrary amounts of memory
+const MAX_DEBUG_ENTRIES = 1 << 16
+
+type Position struct {
+	File string
+	Line int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d", p.File, p.Line)
+}
+
+type LineEntry struct {
+	Offset int
+	Line   int
+}
+
+type LabelEntry struct {
+	Offset int
+	Name   string
+}
+
+type FnDebug struct {
+	Name string
+	// Pointer of the fn const in the module, debug info is looked up by it since
+	// names are not unique, every anonymous fn of a module has the same one
+	Pointer int
+	Line    int
+	Lines   []LineEntry
+	Labels  []LabelEntry
+	Locals  []string
+}
+
+// Returns the source line of the instruction at offset, 0 if unknown
+func (f *FnDebug) LineAt(offset int) int {
+	idx := sort.Search(len(f.Lines), func(i int) bool {
+		return f.Lines[i].Offset > offset
+	})
+	if idx == 0 {
+		return 0
+	}
+	return f.Lines[idx-1].Line
+}
+
+// Returns the offsets of the first instruction of every run of instructions on line
+func (f *FnDebug) Offsets(line int) []int {
+	offsets := []int{}
+	for _, entry := range f.Lines {
+		if entry.Line == line {
+			offsets = append(offsets, entry.Offset)
+		}
+	}
+	return offsets
+}
+
+func (f *FnDebug) Label(offset int) (string, bool) {
+	for _, label := range f.Labels {
+		if label.Offset == offset {
+			return label.Name, true
+		}
+	}
+	return "", false
+}
+
+func (f *FnDebug) Local(idx int) string {
+	if idx < 0 || idx >= len(f.Locals) || f.Locals[idx] == "" {
+		return fmt.Sprintf("local%d", idx)
+	}
+	return f.Locals[idx]
+}
+
+func writeString(w io.Writer, str string) (n int64, err error) {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(str))); err != nil {
+		return n, err
+	} else {
+		n += 4
+	}
+	if m, err := w.Write([]byte(str)); err != nil {
+		return n, err
+	} else {
+		n += int64(m)
+	}
+	return
+}
+
+func readString(r io.Reader) (string, int64, error) {
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return "", 0, err
+	}
+	if length > MAX_DEBUG_ENTRIES {
+		return "", 4, fmt.Errorf("%w: string of %d bytes", ErrDebugInfoTooLarge, length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", 4, err
+	}
+	return string(buf), int64(4 + length), nil
+}
+
+func (f *FnDebug) WriteTo(w io.Writer) (n int64, err error) {
+	if m, err := writeString(w, f.Name); err != nil {
+		return n, err
+	} else {
+		n += m
+	}
+	header := []uint32{uint32(f.Pointer), uint32(f.Line), uint32(len(f.Lines)), uint32(len(f.Labels)), uint32(len(f.Locals))}
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return n, err
+	} else {
+		n += 20
+	}
+	for _, entry := range f.Lines {
+		if err := binary.Write(w, binary.LittleEndian, []uint32{uint32(entry.Offset), uint32(entry.Line)}); err != nil {
+			return n, err
+		} else {
+			n += 8
+		}
+	}
+	for _, label := range f.Labels {
+		if err := binary.Write(w, binary.LittleEndian, uint32(label.Offset)); err != nil {
+			return n, err
+		} else {
+			n += 4
+		}
+		if m, err := writeString(w, label.Name); err != nil {
+			return n, err
+		} else {
+			n += m
+		}
+	}
+	for _, local := range f.Locals {
+		if m, err := writeString(w, local); err != nil {
+			return n, err
+		} else {
+			n += m
+		}
+	}
+	return
+}
+
+func (f *FnDebug) ReadFrom(r io.Reader) (n int64, err error) {
+	if name, m, err := readString(r); err != nil {
+		return n, err
+	} else {
+		n += m
+		f.Name = name
+	}
+	header := make([]uint32, 5)
+	if err := binary.Read(r, binary.LittleEndian, header); err != nil {
+		return n, err
+	} else {
+		n += 20
+	}
+	for _, count := range header[2:] {
+		if count > MAX_DEBUG_ENTRIES {
+			return n, fmt.Errorf("%w: %d entries in %s", ErrDebugInfoTooLarge, count, f.Name)
+		}
+	}
+	f.Pointer = int(header[0])
+	f.Line = int(header[1])
+	f.Lines = make([]LineEntry, header[2])
+	f.Labels = make([]LabelEntry, header[3])
+	f.Locals = make([]string, header[4])
+
+	for i := range f.Lines {
+		entry := make([]uint32, 2)
+		if err := binary.Read(r, binary.LittleEndian, entry); err != nil {
+			return n, err
+		} else {
+			n += 8
+		}
+		f.Lines[i] = LineEntry{Offset: int(entry[0]), Line: int(entry[1])}
+	}
+	for i := range f.Labels {
+		var offset uint32
+		if err := binary.Read(r, binary.LittleEndian, &offset); err != nil {
+			return n, err
+		} else {
+			n += 4
+		}
+		name, m, err := readString(r)
+		if err != nil {
+			return n, err
+		}
+		n += m
+		f.Labels[i] = LabelEntry{Offset: int(offset), Name: name}
+	}
+	for i := range f.Locals {
+		local, m, err := readString(r)
+		if err != nil {
+			return n, err
+		}
+		n += m
+		f.Locals[i] = local
+	}
+	return
+}
+
+type DebugInfo struct {
+	File string
+	Fns  []*FnDebug
+	// Fns by const pointer, rebuilt when fns are added
+	index map[int]*FnDebug
+}
+
+// Returns the debug info of the fn const at pointer
+func (d *DebugInfo) Fn(pointer int) *FnDebug {
+	if len(d.index) != len(d.Fns) {
+		d.index = make(map[int]*FnDebug, len(d.Fns))
+		for _, fn := range d.Fns {
+			d.index[fn.Pointer] = fn
+		}
+	}
+	return d.index[pointer]
+}
+
+func (d *DebugInfo) Position(pointer int, offset int) (Position, bool) {
+	info := d.Fn(pointer)
+	if info == nil {
+		return Position{}, false
+	}
+	line := info.LineAt(offset)
+	if line == 0 {
+		return Position{}, false
+	}
+	return Position{File: d.File, Line: line}, true
+}
+
+func (d *DebugInfo) Len() int {
+	buf := &countWriter{}
+	d.WriteTo(buf)
+	return buf.n
+}
+
+func (d *DebugInfo) WriteTo(w io.Writer) (n int64, err error) {
+	if m, err := writeString(w, d.File); err != nil {
+		return n, err
+	} else {
+		n += m
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(d.Fns))); err != nil {
+		return n, err
+	} else {
+		n += 4
+	}
+	for _, fn := range d.Fns {
+		if m, err := fn.WriteTo(w); err != nil {
+			return n, err
+		} else {
+			n += m
+		}
+	}
+	return
+}
+
+func (d *DebugInfo) ReadFrom(r io.Reader) (n int64, err error) {
+	if file, m, err := readString(r); err != nil {
+		return n, err
+	} else {
+		n += m
+		d.File = file
+	}
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return n, err
+	} else {
+		n += 4
+	}
+	if length > MAX_DEBUG_ENTRIES {
+		return n, fmt.Errorf("%w: %d fns", ErrDebugInfoTooLarge, length)
+	}
+	d.Fns = make([]*FnDebug, length)
+	for i := range d.Fns {
+		fn := new(FnDebug)
+		if m, err := fn.ReadFrom(r); err != nil {
+			return n, err
+		} else {
+			n += m
+		}
+		d.Fns[i] = fn
+	}
+	return
+}
+
+func NewDebugInfo(file string) *DebugInfo {
+	return &DebugInfo{File: file}
+}
+
+type countWriter struct {
+	n int
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	w.n += len(b)
+	return len(b), nil
+}
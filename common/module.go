@@ -2,22 +2,54 @@ package common
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
-type Link string
+type Link struct {
+	Name string
+	// Versions of the linked module the link accepts
+	Constraint Constraint
+	// Set when the compiler resolved the link to Version, the module its symbols point into
+	Resolved bool
+	Version  Version
+}
 
 func (l *Link) WriteTo(w io.Writer) (n int64, err error) {
-	if err := binary.Write(w, binary.LittleEndian, uint16(len(*l))); err != nil {
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(l.Name))); err != nil {
+		return n, err
+	} else {
+		n += 2
+	}
+	if m, err := w.Write([]byte(l.Name)); err != nil {
+		return n, err
+	} else {
+		n += int64(m)
+	}
+	if m, err := w.Write([]byte{byte(l.Constraint.Kind)}); err != nil {
+		return n, err
+	} else {
+		n += int64(m)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(l.Constraint.Version)); err != nil {
 		return n, err
 	} else {
 		n += 4
 	}
-	if m, err := w.Write([]byte(*l)); err != nil {
+	var resolved byte
+	if l.Resolved {
+		resolved = 1
+	}
+	if m, err := w.Write([]byte{resolved}); err != nil {
 		return n, err
 	} else {
 		n += int64(m)
 	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(l.Version)); err != nil {
+		return n, err
+	} else {
+		n += 4
+	}
 	return
 }
 
@@ -25,32 +57,94 @@ func (l *Link) ReadFrom(r io.Reader) (n int64, err error) {
 	var length uint16
 	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
 		return n, err
+	} else {
+		n += 2
 	}
-	buf := make([]byte, length)
-	if m, err := r.Read(buf); err != nil {
+	buf := make([]byte, length+1)
+	if m, err := io.ReadFull(r, buf); err != nil {
 		return n, err
 	} else {
 		n += int64(m)
 	}
-	*l = Link(buf)
+	l.Name = string(buf[:length])
+	l.Constraint.Kind = ConstraintKind(buf[length])
+	if err := binary.Read(r, binary.LittleEndian, &l.Constraint.Version); err != nil {
+		return n, err
+	} else {
+		n += 4
+	}
+	resolved := make([]byte, 1)
+	if m, err := io.ReadFull(r, resolved); err != nil {
+		return n, err
+	} else {
+		n += int64(m)
+	}
+	l.Resolved = resolved[0] != 0
+	if err := binary.Read(r, binary.LittleEndian, &l.Version); err != nil {
+		return n, err
+	} else {
+		n += 4
+	}
 	return
 }
 
 func NewLink(name string) *Link {
-	link := Link(name)
-	return &link
+	return &Link{Name: name}
+}
+
+func NewVersionedLink(name string, constraint Constraint) *Link {
+	return &Link{Name: name, Constraint: constraint}
 }
 
+type ModuleFlag byte
+
+const (
+	ModuleDebugInfo = ModuleFlag(1 << iota)
+)
+
 type Module struct {
 	Name    string
 	Version Version
 	Links   *Pool
 	Types   *Pool
 	Consts  *Pool
+	Symbols *SymbolTable
+	Debug   *DebugInfo
+}
+
+func (m *Module) Flags() ModuleFlag {
+	var flags ModuleFlag
+	if m.Debug != nil {
+		flags |= ModuleDebugInfo
+	}
+	return flags
+}
+
+func (m *Module) Strip() {
+	m.Debug = nil
+}
+
+// Returns the exported function called name
+func (m *Module) Fn(name string) (*Const, error) {
+	symbol, err := m.Symbols.Export(name)
+	if err != nil {
+		return nil, err
+	}
+	if symbol.Kind != ConstSymbol {
+		return nil, fmt.Errorf("%s is a %s not a fn", name, symbol.Kind)
+	}
+	constant := new(Const)
+	if err := m.Consts.Get(symbol.Pointer, constant); err != nil {
+		return nil, err
+	}
+	if constant.Type != FnConst {
+		return nil, fmt.Errorf("%s is a %s not a fn", name, constant.Type)
+	}
+	return constant, nil
 }
 
 func (m *Module) headerSize() int {
-	return 4 /* version */ + 4 /* mod length */ + 2 /* name length */ + len(m.Name)
+	return 4 /* version */ + 4 /* mod length */ + 4 /* name length */ + len(m.Name) + 1 /* flags */
 }
 
 func (mod *Module) writeHeader(w io.Writer) (n int64, err error) {
@@ -74,6 +168,11 @@ func (mod *Module) writeHeader(w io.Writer) (n int64, err error) {
 	} else {
 		n += int64(m)
 	}
+	if m, err := w.Write([]byte{byte(mod.Flags())}); err != nil {
+		return n, err
+	} else {
+		n += int64(m)
+	}
 	return
 }
 
@@ -105,6 +204,14 @@ func (mod *Module) readHeader(r io.Reader) (n int64, err error) {
 	return
 }
 
+func (mod *Module) readFlags(r io.Reader) (ModuleFlag, int64, error) {
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, 0, err
+	}
+	return ModuleFlag(buf[0]), 1, nil
+}
+
 func (mod *Module) WriteTo(w io.Writer) (n int64, err error) {
 	if m, err := mod.writeHeader(w); err != nil {
 		return n, err
@@ -126,6 +233,18 @@ func (mod *Module) WriteTo(w io.Writer) (n int64, err error) {
 	} else {
 		n += m
 	}
+	if m, err := mod.Symbols.WriteTo(w); err != nil {
+		return n, err
+	} else {
+		n += m
+	}
+	if mod.Debug != nil {
+		if m, err := mod.Debug.WriteTo(w); err != nil {
+			return n, err
+		} else {
+			n += m
+		}
+	}
 	return
 }
 
@@ -135,6 +254,11 @@ func (mod *Module) ReadFrom(r io.Reader) (n int64, err error) {
 	} else {
 		n += m
 	}
+	flags, m, err := mod.readFlags(r)
+	if err != nil {
+		return n, err
+	}
+	n += m
 	if m, err := mod.Links.ReadFrom(r); err != nil {
 		return n, err
 	} else {
@@ -150,14 +274,34 @@ func (mod *Module) ReadFrom(r io.Reader) (n int64, err error) {
 	} else {
 		n += m
 	}
+	if m, err := mod.Symbols.ReadFrom(r); err != nil {
+		return n, err
+	} else {
+		n += m
+	}
+	mod.Debug = nil
+	if flags&ModuleDebugInfo != 0 {
+		debug := new(DebugInfo)
+		if m, err := debug.ReadFrom(r); err != nil {
+			return n, err
+		} else {
+			n += m
+		}
+		mod.Debug = debug
+	}
 	return
 }
 
 func (m *Module) Len() int {
-	return m.headerSize() +
+	length := m.headerSize() +
 		m.Links.Len() + 4 /* length size */ +
 		m.Types.Len() + 4 /* length size */ +
-		m.Consts.Len() + 4 /* length size */
+		m.Consts.Len() + 4 /* length size */ +
+		m.Symbols.Len()
+	if m.Debug != nil {
+		length += m.Debug.Len()
+	}
+	return length
 }
 
 func NewModule(name string, version Version) *Module {
@@ -167,5 +311,6 @@ func NewModule(name string, version Version) *Module {
 		Links:   NewPool(),
 		Types:   NewPool(),
 		Consts:  NewPool(),
+		Symbols: NewSymbolTable(),
 	}
 }
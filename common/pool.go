@@ -112,3 +112,21 @@ func NewPool() *Pool {
 		indicies: make(map[int]int),
 	}
 }
+
+// Reads the values of the pool in the order they were written and calls fn with each
+// value and its pointer until fn returns false
+func Scan[T io.ReaderFrom](p *Pool, create func() T, fn func(pointer int, value T) bool) error {
+	for pointer := 0; pointer < p.wp; pointer = p.rp {
+		value := create()
+		if err := p.Get(pointer, value); err != nil {
+			return fmt.Errorf("failed to read pool value at %d: %w", pointer, err)
+		}
+		if p.rp <= pointer {
+			return fmt.Errorf("failed to read pool value at %d: value is empty", pointer)
+		}
+		if !fn(pointer, value) {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrSymbolNotFound = errors.New("symbol not found")
+var ErrSymbolExists = errors.New("symbol already exists")
+var ErrSymbolPrivate = errors.New("symbol is not exported")
+var ErrSymbolTableTooLarge = errors.New("symbol table is too large")
+
+// Upper limit of the symbols read from a module, so a corrupt file cannot make the
+// reader allocate arbitrary amounts of memory
+const MAX_SYMBOLS = 1 << 16
+
+type SymbolKind byte
+
+const (
+	ConstSymbol = SymbolKind(iota)
+	TypeSymbol
+)
+
+func (k SymbolKind) String() string {
+	switch k {
+	case ConstSymbol:
+		return "const"
+	case TypeSymbol:
+		return "type"
+	default:
+		return ""
+	}
+}
+
+type Visibility byte
+
+const (
+	// Private symbols can only be referred to by their own module
+	Private = Visibility(iota)
+	// Public symbols are exported to other modules and the host
+	Public
+)
+
+type Symbol struct {
+	Name       string
+	Kind       SymbolKind
+	Visibility Visibility
+	// Pointer to the entry in the const or type pool of the module
+	Pointer int
+}
+
+// Names of the consts and types of a module
+type SymbolTable struct {
+	Symbols []Symbol
+}
+
+func (t *SymbolTable) Add(symbol Symbol) error {
+	if _, ok := t.Lookup(symbol.Name); ok {
+		return fmt.Errorf("%w: %s", ErrSymbolExists, symbol.Name)
+	}
+	t.Symbols = append(t.Symbols, symbol)
+	return nil
+}
+
+func (t *SymbolTable) Lookup(name string) (Symbol, bool) {
+	for _, symbol := range t.Symbols {
+		if symbol.Name == name {
+			return symbol, true
+		}
+	}
+	return Symbol{}, false
+}
+
+// Returns the public symbol called name
+func (t *SymbolTable) Export(name string) (Symbol, error) {
+	symbol, ok := t.Lookup(name)
+	if !ok {
+		return Symbol{}, fmt.Errorf("%w: %s", ErrSymbolNotFound, name)
+	}
+	if symbol.Visibility != Public {
+		return Symbol{}, fmt.Errorf("%w: %s", ErrSymbolPrivate, name)
+	}
+	return symbol, nil
+}
+
+// Reports whether the entry of kind at pointer is exported
+func (t *SymbolTable) Exported(kind SymbolKind, pointer int) bool {
+	for _, symbol := range t.Symbols {
+		if symbol.Kind == kind && symbol.Pointer == pointer && symbol.Visibility == Public {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *SymbolTable) Exports() []Symbol {
+	exports := []Symbol{}
+	for _, symbol := range t.Symbols {
+		if symbol.Visibility == Public {
+			exports = append(exports, symbol)
+		}
+	}
+	return exports
+}
+
+func (t *SymbolTable) Len() int {
+	buf := &countWriter{}
+	t.WriteTo(buf)
+	return buf.n
+}
+
+func (t *SymbolTable) WriteTo(w io.Writer) (n int64, err error) {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(t.Symbols))); err != nil {
+		return n, err
+	} else {
+		n += 4
+	}
+	for _, symbol := range t.Symbols {
+		if m, err := writeString(w, symbol.Name); err != nil {
+			return n, err
+		} else {
+			n += m
+		}
+		if m, err := w.Write([]byte{byte(symbol.Kind), byte(symbol.Visibility)}); err != nil {
+			return n, err
+		} else {
+			n += int64(m)
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint32(symbol.Pointer)); err != nil {
+			return n, err
+		} else {
+			n += 4
+		}
+	}
+	return
+}
+
+func (t *SymbolTable) ReadFrom(r io.Reader) (n int64, err error) {
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return n, err
+	} else {
+		n += 4
+	}
+	if length > MAX_SYMBOLS {
+		return n, fmt.Errorf("%w: %d symbols", ErrSymbolTableTooLarge, length)
+	}
+	t.Symbols = make([]Symbol, length)
+	for i := range t.Symbols {
+		name, m, err := readString(r)
+		if err != nil {
+			return n, err
+		}
+		n += m
+		flags := make([]byte, 2)
+		if m, err := io.ReadFull(r, flags); err != nil {
+			return n, err
+		} else {
+			n += int64(m)
+		}
+		var pointer uint32
+		if err := binary.Read(r, binary.LittleEndian, &pointer); err != nil {
+			return n, err
+		} else {
+			n += 4
+		}
+		t.Symbols[i] = Symbol{Name: name, Kind: SymbolKind(flags[0]), Visibility: Visibility(flags[1]), Pointer: int(pointer)}
+	}
+	return
+}
+
+func NewSymbolTable() *SymbolTable {
+	return &SymbolTable{}
+}
@@ -1,6 +1,11 @@
 package common
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 type Version uint32
 
@@ -29,3 +34,104 @@ func NewVersion(major, minor, patch uint8) Version {
 	version.Set(major, minor, patch)
 	return version
 }
+
+var ErrVersionMismatch = errors.New("version does not satisfy constraint")
+
+// Parses a major.minor.patch version, missing minor and patch numbers are 0
+func ParseVersion(str string) (Version, error) {
+	parts := strings.Split(str, ".")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid version %q", str)
+	}
+	numbers := [3]uint8{}
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return 0, fmt.Errorf("invalid version %q", str)
+		}
+		numbers[i] = uint8(n)
+	}
+	return NewVersion(numbers[0], numbers[1], numbers[2]), nil
+}
+
+type ConstraintKind byte
+
+const (
+	// Matches every version
+	AnyVersion = ConstraintKind(iota)
+	// =1.2.3 or 1.2.3 matches only 1.2.3
+	ExactVersion
+	// ^1.2.3 matches 1.2.3 up to 2.0.0, ^0.2.3 up to 0.3.0 and ^0.0.3 only 0.0.3
+	CaretVersion
+	// ~1.2.3 matches 1.2.3 up to 1.3.0
+	TildeVersion
+)
+
+// A range of versions a linked module has to be in
+type Constraint struct {
+	Kind    ConstraintKind
+	Version Version
+}
+
+func ParseConstraint(str string) (Constraint, error) {
+	kind := ExactVersion
+	switch {
+	case str == "" || str == "*":
+		return Constraint{}, nil
+	case strings.HasPrefix(str, "^"):
+		kind = CaretVersion
+	case strings.HasPrefix(str, "~"):
+		kind = TildeVersion
+	case strings.HasPrefix(str, "="):
+	default:
+		return parseConstraint(kind, str)
+	}
+	return parseConstraint(kind, str[1:])
+}
+
+func parseConstraint(kind ConstraintKind, str string) (Constraint, error) {
+	version, err := ParseVersion(str)
+	if err != nil {
+		return Constraint{}, fmt.Errorf("invalid version constraint: %w", err)
+	}
+	return Constraint{Kind: kind, Version: version}, nil
+}
+
+func (c Constraint) Match(v Version) bool {
+	base := c.Version
+	switch c.Kind {
+	case AnyVersion:
+		return true
+	case ExactVersion:
+		return v == base
+	case CaretVersion:
+		if v < base {
+			return false
+		}
+		switch {
+		case base.Major() > 0:
+			return v.Major() == base.Major()
+		case base.Minor() > 0:
+			return v.Major() == 0 && v.Minor() == base.Minor()
+		default:
+			return v == base
+		}
+	case TildeVersion:
+		return v >= base && v.Major() == base.Major() && v.Minor() == base.Minor()
+	default:
+		return false
+	}
+}
+
+func (c Constraint) String() string {
+	switch c.Kind {
+	case ExactVersion:
+		return "=" + c.Version.String()
+	case CaretVersion:
+		return "^" + c.Version.String()
+	case TildeVersion:
+		return "~" + c.Version.String()
+	default:
+		return "*"
+	}
+}
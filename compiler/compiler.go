@@ -1,8 +1,8 @@
 package compiler
 
 import (
+	"errors"
 	"fmt"
-	"hash/fnv"
 	"io"
 
 	"github.com/canpacis/flint/ast"
@@ -16,9 +16,19 @@ type IRCompiler struct {
 	archive  *common.Archive
 	module   *common.Module
 	program  *ast.Program
-	resolver map[string]*ast.Program
-	links    map[int]*common.Module
+	resolver Resolver
+	// Modules whose links led to this one, the program being compiled first
+	chain []string
+	// Name the module is linked by, the module name for the program being compiled
+	linkname string
+	links    map[string]*common.Module
+	// Linked modules by name, shared by every compiler of the program so each is compiled once
+	compiled map[string]*common.Module
+	// Linked modules read from module files, which do not keep the indicies of their consts
+	prebuilt map[string]bool
 	builtins map[int]int
+	debug    bool
+	fndebug  *common.FnDebug
 }
 
 func (c *IRCompiler) getConstant(stmt *ast.ConstStmt) (*common.Const, error) {
@@ -51,10 +61,9 @@ func (c *IRCompiler) getConstant(stmt *ast.ConstStmt) (*common.Const, error) {
 	case common.DataConst:
 		return nil, nil
 	case common.FnConst:
-		stmts := stmt.Literal.Value().([]ast.OpStmt)
-		set, err := c.CompileBlock(stmts)
-		if err != nil {
-			return nil, err
+		lit, ok := stmt.Literal.(*ast.FnLiteral)
+		if !ok {
+			return nil, fmt.Errorf("invalid fn literal %T", stmt.Literal)
 		}
 		name := c.module.Name
 		if stmt.Name == nil {
@@ -62,49 +71,73 @@ func (c *IRCompiler) getConstant(stmt *ast.ConstStmt) (*common.Const, error) {
 		} else {
 			name += "." + stmt.Name.Value
 		}
-		return common.NewConst(typ, common.NewCompiledFn(name, 0, set)), nil
+
+		if c.module.Debug != nil {
+			// The const is written at the end of the pool once it is compiled
+			c.fndebug = &common.FnDebug{Name: name, Pointer: c.module.Consts.Len(), Line: int(stmt.Location())}
+			for _, param := range lit.Params {
+				c.fndebug.Locals = append(c.fndebug.Locals, param.Value)
+			}
+			c.module.Debug.Fns = append(c.module.Debug.Fns, c.fndebug)
+			defer func() { c.fndebug = nil }()
+		}
+
+		set, err := c.CompileBlock(lit.Ops)
+		if err != nil {
+			return nil, err
+		}
+		return common.NewConst(typ, common.NewCompiledFn(name, len(lit.Params), set)), nil
 	default:
 		return nil, fmt.Errorf("invalid const type %s", stmt.Type.Value)
 	}
 }
 
 func (c *IRCompiler) Compile() error {
+	if version := c.program.Module.Version; version != nil {
+		v, err := common.ParseVersion(version.String)
+		if err != nil {
+			return fmt.Errorf("failed to write module: %w", err)
+		}
+		c.module.Version = v
+	}
+
 	for _, stmt := range c.program.Links {
 		idx := stmt.Index.Int
 
-		program, ok := c.resolver[stmt.Mod.String]
-		if !ok {
-			return fmt.Errorf("failed to write link: cannot resolve link module %s", stmt.Mod.String)
+		target := common.NewLink(stmt.Mod.String)
+		if stmt.Constraint != nil {
+			constraint, err := common.ParseConstraint(stmt.Constraint.String)
+			if err != nil {
+				return fmt.Errorf("failed to write link %s: %w", stmt.Mod.String, err)
+			}
+			target.Constraint = constraint
 		}
-		link := NewIRCompiler(c.version)
-		link.Init(program, c.resolver, c.builtins)
 
-		if err := link.Compile(); err != nil {
+		mod, err := c.link(target)
+		if err != nil {
 			return fmt.Errorf("failed to write link: %w", err)
 		}
+		// The runtime loads the version the symbols of the link were resolved against
+		target.Resolved = true
+		target.Version = mod.Version
 
-		if _, err := c.module.Links.Set(idx, common.NewLink(stmt.Mod.String)); err != nil {
+		if _, err := c.module.Links.Set(idx, target); err != nil {
 			return fmt.Errorf("failed to write link: %w", err)
 		}
 
-		hash := hash(stmt.Mod.String)
-
-		// Archive may already have the link written
-		if !c.archive.Modules.Has(hash) {
-			if _, err := c.archive.Modules.Set(hash, link.module); err != nil {
-				return fmt.Errorf("failed to write link: %w", err)
-			}
-		}
-
 		// write to cache
-		c.links[hash] = link.module
+		c.links[stmt.Mod.String] = mod
 	}
 
 	for _, stmt := range c.program.Types {
 		idx := stmt.Index.Int
 		// TODO: Create the actual type
 		typ := common.NewType()
-		if _, err := c.module.Types.Set(idx, typ); err != nil {
+		pointer, err := c.module.Types.Set(idx, typ)
+		if err != nil {
+			return fmt.Errorf("failed to write type: %w", err)
+		}
+		if err := c.declare(stmt.Name, stmt.Public, common.TypeSymbol, pointer); err != nil {
 			return fmt.Errorf("failed to write type: %w", err)
 		}
 	}
@@ -115,7 +148,11 @@ func (c *IRCompiler) Compile() error {
 		if err != nil {
 			return fmt.Errorf("failed to write const: %w", err)
 		}
-		if _, err := c.module.Consts.Set(idx, constant); err != nil {
+		pointer, err := c.module.Consts.Set(idx, constant)
+		if err != nil {
+			return fmt.Errorf("failed to write const: %w", err)
+		}
+		if err := c.declare(stmt.Name, stmt.Public, common.ConstSymbol, pointer); err != nil {
 			return fmt.Errorf("failed to write const: %w", err)
 		}
 	}
@@ -123,8 +160,124 @@ func (c *IRCompiler) Compile() error {
 	return nil
 }
 
+// Adds a named const or type to the symbol table of the module
+func (c *IRCompiler) declare(name *ast.Identifier, public bool, kind common.SymbolKind, pointer int) error {
+	if name == nil {
+		if public {
+			return fmt.Errorf("cannot export unnamed %s", kind)
+		}
+		return nil
+	}
+	visibility := common.Private
+	if public {
+		visibility = common.Public
+	}
+	return c.module.Symbols.Add(common.Symbol{Name: name.Value, Kind: kind, Visibility: visibility, Pointer: pointer})
+}
+
+// Compiles the linked module, or loads it prebuilt, checks its version and writes it
+// to the archive after the modules it links
+func (c *IRCompiler) link(target *common.Link) (*common.Module, error) {
+	name := target.Name
+	self := c.linkname
+	if self == "" {
+		self = c.module.Name
+	}
+	chain := append(c.chain[:len(c.chain):len(c.chain)], self)
+	for i, linked := range chain {
+		if linked == name {
+			return nil, &CycleError{Cycle: append(chain[i:], name)}
+		}
+	}
+
+	if mod, ok := c.compiled[name]; ok {
+		if !target.Constraint.Match(mod.Version) {
+			return nil, &VersionError{Chain: chain, Name: name, Constraint: target.Constraint, Version: mod.Version}
+		}
+		return mod, nil
+	}
+
+	var mod *common.Module
+	if resolver, ok := c.resolver.(ModuleResolver); ok {
+		prebuilt, err := resolver.ResolveModule(name)
+		if err != nil && !errors.Is(err, ErrModuleNotFound) {
+			return nil, &ResolveError{Chain: chain, Name: name, Err: err}
+		}
+		mod = prebuilt
+	}
+
+	if mod != nil {
+		// Prebuilt modules only carry the names of their links
+		linker := &IRCompiler{
+			version:  c.version,
+			archive:  c.archive,
+			compiled: c.compiled,
+			prebuilt: c.prebuilt,
+			module:   mod,
+			resolver: c.resolver,
+			builtins: c.builtins,
+			debug:    c.debug,
+			chain:    chain,
+			linkname: name,
+		}
+		// Links are written again with the versions they resolve to in this program, every
+		// link keeps its size so the pointers in the code of the module stay valid
+		links := common.NewPool()
+		var linkErr error
+		err := common.Scan(mod.Links, func() *common.Link { return new(common.Link) }, func(pointer int, link *common.Link) bool {
+			var linked *common.Module
+			if linked, linkErr = linker.link(link); linkErr != nil {
+				return false
+			}
+			link.Resolved = true
+			link.Version = linked.Version
+			_, linkErr = links.Set(pointer, link)
+			return linkErr == nil
+		})
+		if err == nil {
+			err = linkErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		mod.Links = links
+		c.prebuilt[name] = true
+	} else {
+		program, err := c.resolver.Resolve(name)
+		if err != nil {
+			return nil, &ResolveError{Chain: chain, Name: name, Err: err}
+		}
+		link := NewIRCompiler(c.version)
+		link.SetDebug(c.debug)
+		link.Init(program, c.resolver, c.builtins)
+		link.archive = c.archive
+		link.compiled = c.compiled
+		link.prebuilt = c.prebuilt
+		link.chain = chain
+		link.linkname = name
+		if err := link.Compile(); err != nil {
+			return nil, err
+		}
+		mod = link.module
+	}
+	if !target.Constraint.Match(mod.Version) {
+		return nil, &VersionError{Chain: chain, Name: name, Constraint: target.Constraint, Version: mod.Version}
+	}
+
+	if _, err := c.archive.AddModule(mod); err != nil {
+		return nil, &ResolveError{Chain: chain, Name: name, Err: err}
+	}
+	c.compiled[name] = mod
+	return mod, nil
+}
+
+// Writes the compiled module alone, it can be linked by other programs through a ModuleResolver
+func (c *IRCompiler) WriteModuleTo(w io.Writer) (int64, error) {
+	return c.module.WriteTo(w)
+}
+
 func (c *IRCompiler) WriteTo(w io.Writer) (int64, error) {
-	entrymod, err := c.archive.Modules.Set(POOL_WRITE_LIMIT, c.module)
+	entrymod, err := c.archive.AddModule(c.module)
 	if err != nil {
 		return 0, err
 	}
@@ -146,6 +299,63 @@ func readOp(stmt *ast.Op) (common.OpCode, []int, error) {
 	return code, operands, nil
 }
 
+// Resolves the operands of load.modconst from a link index and a const index
+func (c *IRCompiler) resolveModConst(modidx, idx int) ([]int, error) {
+	link := new(common.Link)
+	if !c.module.Links.Has(modidx) {
+		return nil, fmt.Errorf("undefined mod index %d", modidx)
+	}
+
+	if err := c.module.Links.Get(c.module.Links.Lookup(modidx), link); err != nil {
+		return nil, err
+	}
+
+	mod, ok := c.links[link.Name]
+	if !ok {
+		return nil, fmt.Errorf("found mod index %d but failed to resolve it", modidx)
+	}
+
+	if !mod.Consts.Has(idx) {
+		if c.prebuilt[link.Name] {
+			return nil, fmt.Errorf("%w: const index %d in mod %s", ErrPrebuiltConstIndex, idx, mod.Name)
+		}
+		return nil, fmt.Errorf("undefined const index %d in mod %d", idx, modidx)
+	}
+	pointer := mod.Consts.Lookup(idx)
+	if !mod.Symbols.Exported(common.ConstSymbol, pointer) {
+		return nil, fmt.Errorf("const index %d in mod %s is not exported", idx, mod.Name)
+	}
+	return []int{c.module.Links.Lookup(modidx), pointer}, nil
+}
+
+// Resolves the operands of load.modconst from a symbol exported by a linked module
+func (c *IRCompiler) resolveSymbol(symbol *ast.SymbolRef) ([]int, error) {
+	name := symbol.Mod.Value
+	link := -1
+	for _, stmt := range c.program.Links {
+		if stmt.Mod.String == name {
+			link = c.module.Links.Lookup(stmt.Index.Int)
+			break
+		}
+	}
+	if link < 0 {
+		return nil, fmt.Errorf("cannot resolve %s: module %s is not linked", symbol, name)
+	}
+
+	mod, ok := c.links[name]
+	if !ok {
+		return nil, fmt.Errorf("cannot resolve %s: module %s is linked but failed to resolve it", symbol, name)
+	}
+	export, err := mod.Symbols.Export(symbol.Name.Value)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve %s: %w in module %s", symbol, err, name)
+	}
+	if export.Kind != common.ConstSymbol {
+		return nil, fmt.Errorf("cannot resolve %s: %s is a %s not a const", symbol, symbol.Name.Value, export.Kind)
+	}
+	return []int{link, export.Pointer}, nil
+}
+
 type jump struct {
 	code  common.OpCode
 	label int
@@ -153,6 +363,29 @@ type jump struct {
 }
 
 func (c *IRCompiler) CompileBlock(ops []ast.OpStmt) (common.Instructions, error) {
+	return c.compileBlock(ops, 0)
+}
+
+func (c *IRCompiler) markLine(offset int, loc ast.Location) {
+	if c.fndebug == nil || loc <= 0 {
+		return
+	}
+	lines := c.fndebug.Lines
+	if len(lines) > 0 && lines[len(lines)-1].Line == int(loc) {
+		return
+	}
+	c.fndebug.Lines = append(lines, common.LineEntry{Offset: offset, Line: int(loc)})
+}
+
+func (c *IRCompiler) markLabel(offset int, label *ast.Label) {
+	if c.fndebug == nil || label.Name == nil {
+		return
+	}
+	c.fndebug.Labels = append(c.fndebug.Labels, common.LabelEntry{Offset: offset, Name: label.Name.Value})
+}
+
+// base is the offset of the block from the start of the enclosing function
+func (c *IRCompiler) compileBlock(ops []ast.OpStmt, base int) (common.Instructions, error) {
 	var set common.Instructions
 
 	blocks := map[int]int{}
@@ -166,6 +399,10 @@ func (c *IRCompiler) CompileBlock(ops []ast.OpStmt) (common.Instructions, error)
 				return nil, err
 			}
 
+			if stmt.Symbol != nil && code != common.OpLoadModConst {
+				return nil, fmt.Errorf("op %s does not take a symbol", code)
+			}
+
 			switch code {
 			case common.OpLoadConst:
 				idx := operands[0]
@@ -175,29 +412,14 @@ func (c *IRCompiler) CompileBlock(ops []ast.OpStmt) (common.Instructions, error)
 				}
 				operands[0] = c.module.Consts.Lookup(idx)
 			case common.OpLoadModConst:
-				modidx := operands[0]
-				idx := operands[1]
-
-				link := new(common.Link)
-				if !c.module.Links.Has(modidx) {
-					return nil, fmt.Errorf("undefined mod index %d", modidx)
+				if stmt.Symbol != nil {
+					operands, err = c.resolveSymbol(stmt.Symbol)
+				} else {
+					operands, err = c.resolveModConst(operands[0], operands[1])
 				}
-
-				if err := c.module.Links.Get(c.module.Links.Lookup(modidx), link); err != nil {
+				if err != nil {
 					return nil, err
 				}
-
-				hash := hash(string(*link))
-				mod, ok := c.links[hash]
-				if !ok {
-					return nil, fmt.Errorf("found mod index %d but failed to resolve it", modidx)
-				}
-
-				if !mod.Consts.Has(idx) {
-					return nil, fmt.Errorf("undefined const index %d in mod %d", idx, modidx)
-				}
-				operands[0] = c.archive.Modules.Lookup(hash)
-				operands[1] = mod.Consts.Lookup(idx)
 			case common.OpLoadBuiltin:
 				idx := operands[0]
 
@@ -210,9 +432,11 @@ func (c *IRCompiler) CompileBlock(ops []ast.OpStmt) (common.Instructions, error)
 				jumps = append(jumps, jump{code, operands[0], len(set)})
 			}
 
+			c.markLine(base+len(set), stmt.Location())
 			set = append(set, common.NewOp(code, operands...)...)
 		case *ast.Label:
-			block, err := c.CompileBlock(stmt.Ops)
+			c.markLabel(base+len(set), stmt)
+			block, err := c.compileBlock(stmt.Ops, base+len(set))
 			if err != nil {
 				return nil, err
 			}
@@ -244,21 +468,28 @@ func (c *IRCompiler) CompileBlock(ops []ast.OpStmt) (common.Instructions, error)
 	return set, nil
 }
 
-func (c *IRCompiler) Init(program *ast.Program, resolver map[string]*ast.Program, builtins map[int]int) {
+func (c *IRCompiler) Init(program *ast.Program, resolver Resolver, builtins map[int]int) {
 	c.program = program
 	c.resolver = resolver
 	c.builtins = builtins
-	c.links = make(map[int]*common.Module)
+	c.links = make(map[string]*common.Module)
+	c.compiled = make(map[string]*common.Module)
+	c.prebuilt = make(map[string]bool)
 	c.archive = common.NewArchive()
 	c.module = common.NewModule(program.Module.Name.String, c.version)
+	if c.debug {
+		c.module.Debug = common.NewDebugInfo(program.File)
+	}
 }
 
-func NewIRCompiler(version common.Version) *IRCompiler {
-	return &IRCompiler{version: version}
+// Enables debug info, set it before Init. It is off by default to keep modules small
+func (c *IRCompiler) SetDebug(debug bool) {
+	c.debug = debug
+	if !debug && c.module != nil {
+		c.module.Strip()
+	}
 }
 
-func hash(str string) int {
-	hash := fnv.New64()
-	hash.Write([]byte(str))
-	return int(hash.Sum64())
+func NewIRCompiler(version common.Version) *IRCompiler {
+	return &IRCompiler{version: version}
 }
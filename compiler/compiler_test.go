@@ -2,11 +2,15 @@ package compiler_test
 
 import (
 	"bytes"
+	"fmt"
+	"strings"
 	"testing"
+	"testing/fstest"
 
 	"github.com/canpacis/flint/ast"
 	"github.com/canpacis/flint/common"
 	"github.com/canpacis/flint/compiler"
+	"github.com/canpacis/flint/vm"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -14,7 +18,7 @@ func TestCompileBlock(t *testing.T) {
 	assert := assert.New(t)
 
 	type CompileBlockTest struct {
-		Resolver map[string]*ast.Program
+		Resolver compiler.MapResolver
 		Builtins map[int]int
 		Program  *ast.Program
 		Block    []ast.OpStmt
@@ -211,14 +215,14 @@ func TestCompile(t *testing.T) {
 	c := compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
 
 	io := ast.NewProgram(ast.Mod("io"), nil, nil, []*ast.ConstStmt{
-		ast.Const(0, "u32", ast.Int(0)),      // Size 5, Index 0
-		ast.Const(1, "bool", ast.Bool(true)), // Size 1, Index 5
+		ast.NamedConst("zero", 0, "u32", ast.Int(0)).Export(),     // Size 5, Index 0
+		ast.NamedConst("yes", 1, "bool", ast.Bool(true)).Export(), // Size 1, Index 5
 	})
 	std := ast.NewProgram(ast.Mod("std"), nil, nil, []*ast.ConstStmt{
-		ast.Const(0, "i64", ast.Int(1)), // Size 9, Index 0
+		ast.NamedConst("one", 0, "i64", ast.Int(1)).Export(), // Size 9, Index 0
 	})
 
-	c.Init(program, map[string]*ast.Program{"io": io, "std": std}, map[int]int{0: 0})
+	c.Init(program, compiler.MapResolver{"io": io, "std": std}, map[int]int{0: 0})
 
 	assert.NoError(c.Compile())
 	buf := new(bytes.Buffer)
@@ -226,3 +230,548 @@ func TestCompile(t *testing.T) {
 	assert.NoError(err)
 	assert.NotEqual(0, buf.Len())
 }
+
+func TestExports(t *testing.T) {
+	assert := assert.New(t)
+
+	lib := ast.NewProgram(ast.Mod("lib"), nil, []*ast.TypeStmt{
+		{Name: ast.Ident("User"), Index: ast.Int(0), Public: true},
+	}, []*ast.ConstStmt{
+		ast.NamedConst("hidden", 0, "i64", ast.Int(1)),
+		ast.NamedConst("shown", 1, "i64", ast.Int(2)).Export(),
+		ast.FnConst("print", 2, "fn", ast.Fn(ast.NewOp("return"))).Export(),
+		ast.Const(3, "i64", ast.Int(3)),
+	})
+
+	type ExportTest struct {
+		Op  *ast.Op
+		Err string
+	}
+
+	tests := []ExportTest{
+		{ast.NewOp("load.modconst", 0, 1), ""},
+		{ast.NewOp("load.modconst", 0, 2), ""},
+		{ast.NewOp("load.modconst", 0, 0), "const index 0 in mod lib is not exported"},
+		{ast.NewOp("load.modconst", 0, 3), "const index 3 in mod lib is not exported"},
+	}
+
+	for i, test := range tests {
+		program := ast.NewProgram(ast.Mod("main"), []*ast.LinkStmt{ast.Link(0, "lib")}, nil, []*ast.ConstStmt{
+			ast.FnConst("main", compiler.POOL_WRITE_LIMIT, "fn", ast.Fn(test.Op)),
+		})
+		c := compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+		c.Init(program, compiler.MapResolver{"lib": lib}, map[int]int{})
+
+		err := c.Compile()
+		if test.Err == "" {
+			assert.NoErrorf(err, "Test case %d", i)
+		} else {
+			assert.ErrorContainsf(err, test.Err, "Test case %d", i)
+		}
+	}
+
+	c := compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+	c.Init(lib, compiler.MapResolver{}, map[int]int{})
+	assert.NoError(c.Compile())
+	buf := new(bytes.Buffer)
+	_, err := c.WriteTo(buf)
+	assert.NoError(err)
+	archive := common.NewArchive()
+	_, err = archive.ReadFrom(buf)
+	assert.NoError(err)
+	mod, err := archive.MainModule()
+	assert.NoError(err)
+
+	exports := []string{}
+	for _, symbol := range mod.Symbols.Exports() {
+		exports = append(exports, symbol.Kind.String()+" "+symbol.Name)
+	}
+	assert.Equal([]string{"type User", "const shown", "const print"}, exports)
+	_, err = mod.Symbols.Export("hidden")
+	assert.ErrorIs(err, common.ErrSymbolPrivate)
+	fn, err := mod.Fn("print")
+	assert.NoError(err)
+	assert.Equal(common.FnConst, fn.Type)
+	_, err = mod.Fn("shown")
+	assert.Error(err)
+
+	unnamed := ast.NewProgram(ast.Mod("lib"), nil, nil, []*ast.ConstStmt{
+		ast.Const(0, "i64", ast.Int(1)).Export(),
+	})
+	c = compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+	c.Init(unnamed, compiler.MapResolver{}, map[int]int{})
+	assert.ErrorContains(c.Compile(), "cannot export unnamed const")
+
+	duplicate := ast.NewProgram(ast.Mod("lib"), nil, nil, []*ast.ConstStmt{
+		ast.NamedConst("one", 0, "i64", ast.Int(1)),
+		ast.NamedConst("one", 1, "i64", ast.Int(1)).Export(),
+	})
+	c = compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+	c.Init(duplicate, compiler.MapResolver{}, map[int]int{})
+	assert.ErrorIs(c.Compile(), common.ErrSymbolExists)
+}
+
+func TestSymbolOps(t *testing.T) {
+	assert := assert.New(t)
+
+	std := ast.NewProgram(ast.Mod("std"), nil, nil, []*ast.ConstStmt{
+		ast.NamedConst("newline", 0, "str", ast.String("\n")).Export(),
+		ast.NamedConst("secret", 1, "i64", ast.Int(1)),
+		ast.FnConst("println", 2, "fn", ast.Fn(ast.NewOp("return"))).Export(),
+	})
+	resolver := compiler.MapResolver{"std": std}
+
+	type SymbolTest struct {
+		Op       *ast.Op
+		Expected *ast.Op
+		Err      string
+	}
+
+	tests := []SymbolTest{
+		{ast.NewSymbolOp("load.modconst", ast.Sym("std", "println")), ast.NewOp("load.modconst", 0, 2), ""},
+		{ast.NewSymbolOp("load.modconst", ast.Sym("std", "newline")), ast.NewOp("load.modconst", 0, 0), ""},
+		{ast.NewSymbolOp("load.modconst", ast.Sym("std", "print")), nil, "cannot resolve std.print: symbol not found: print in module std"},
+		{ast.NewSymbolOp("load.modconst", ast.Sym("std", "secret")), nil, "cannot resolve std.secret: symbol is not exported: secret in module std"},
+		{ast.NewSymbolOp("load.modconst", ast.Sym("io", "println")), nil, "cannot resolve io.println: module io is not linked"},
+		{ast.NewSymbolOp("load.const", ast.Sym("std", "println")), nil, "op load.const does not take a symbol"},
+	}
+
+	for i, test := range tests {
+		program := ast.NewProgram(ast.Mod("main"), []*ast.LinkStmt{ast.Link(0, "std")}, nil, nil)
+		c := compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+		c.Init(program, resolver, map[int]int{})
+		assert.NoErrorf(c.Compile(), "Test case %d", i)
+
+		set, err := c.CompileBlock([]ast.OpStmt{test.Op})
+		if test.Err != "" {
+			assert.EqualErrorf(err, test.Err, "Test case %d", i)
+			continue
+		}
+		assert.NoErrorf(err, "Test case %d", i)
+		expected, err := c.CompileBlock([]ast.OpStmt{test.Expected})
+		assert.NoErrorf(err, "Test case %d", i)
+		assert.Equalf(expected, set, "Test case %d", i)
+	}
+}
+
+func TestDebugInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	program := ast.NewProgram(
+		ast.Mod("main"),
+		nil,
+		nil,
+		[]*ast.ConstStmt{
+			ast.FnConst("add", 0, "fn", ast.FnParams([]string{"a", "b"},
+				ast.NewOp("load.local", 0).At(2),
+				ast.NewOp("load.local", 1).At(2),
+				ast.NewOp("add.i64").At(3),
+				ast.NewOp("return.value").At(4),
+			)).At(1),
+			ast.FnConst("main", compiler.POOL_WRITE_LIMIT, "fn", ast.Fn(
+				ast.NewOp("jmp", 0).At(7),
+				ast.NamedLabel("end", 0,
+					ast.NewOp("load.i64", 1).At(9),
+					ast.NewOp("halt").At(10),
+				).At(8),
+			)).At(6),
+			ast.Const(1, "fn", ast.Fn(ast.NewOp("return").At(12))).At(12),
+			ast.Const(2, "fn", ast.Fn(ast.NewOp("return").At(13))).At(13),
+		},
+	)
+	program.File = "main.flir"
+
+	type DebugTest struct {
+		Strip bool
+	}
+
+	for i, test := range []DebugTest{{false}, {true}} {
+		c := compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+		c.SetDebug(!test.Strip)
+		c.Init(program, compiler.MapResolver{}, map[int]int{})
+		assert.NoErrorf(c.Compile(), "Test case %d", i)
+
+		buf := new(bytes.Buffer)
+		_, err := c.WriteTo(buf)
+		assert.NoErrorf(err, "Test case %d", i)
+
+		archive := common.NewArchive()
+		_, err = archive.ReadFrom(buf)
+		assert.NoErrorf(err, "Test case %d", i)
+		mod, err := archive.MainModule()
+		assert.NoErrorf(err, "Test case %d", i)
+
+		if test.Strip {
+			assert.Nilf(mod.Debug, "Test case %d", i)
+			continue
+		}
+
+		assert.Equalf("main.flir", mod.Debug.File, "Test case %d", i)
+
+		symbol, _ := mod.Symbols.Lookup("add")
+		add := mod.Debug.Fn(symbol.Pointer)
+		assert.NotNilf(add, "Test case %d", i)
+		assert.Equalf("main.add", add.Name, "Test case %d", i)
+		assert.Equalf(1, add.Line, "Test case %d", i)
+		assert.Equalf([]string{"a", "b"}, add.Locals, "Test case %d", i)
+		assert.Equalf([]common.LineEntry{{Offset: 0, Line: 2}, {Offset: 10, Line: 3}, {Offset: 11, Line: 4}}, add.Lines, "Test case %d", i)
+
+		_, entry := archive.Entry()
+		main := mod.Debug.Fn(entry)
+		assert.NotNilf(main, "Test case %d", i)
+		assert.Equalf("main.main", main.Name, "Test case %d", i)
+		assert.Equalf([]common.LabelEntry{{Offset: 3, Name: "end"}}, main.Labels, "Test case %d", i)
+		assert.Equalf([]common.LineEntry{{Offset: 0, Line: 7}, {Offset: 3, Line: 9}, {Offset: 12, Line: 10}}, main.Lines, "Test case %d", i)
+
+		fn, err := archive.MainFn()
+		assert.NoErrorf(err, "Test case %d", i)
+		assert.Equalf("main.main", fn.Value.(common.Fn).Name(), "Test case %d", i)
+
+		// Anonymous fns share a name but each has its own debug info
+		lines := []int{}
+		for _, info := range mod.Debug.Fns {
+			if info.Name != "main.anonymous" {
+				continue
+			}
+			assert.Equalf(info, mod.Debug.Fn(info.Pointer), "Test case %d", i)
+			lines = append(lines, info.LineAt(0))
+		}
+		assert.Equalf([]int{12, 13}, lines, "Test case %d", i)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	assert := assert.New(t)
+
+	fsys := fstest.MapFS{
+		"project/util.flir": {Data: []byte("util")},
+		"vendor/util.flir":  {Data: []byte("vendored util")},
+		"vendor/json.flir":  {Data: []byte("json io missing")},
+		"std/io.flir":       {Data: []byte("io")},
+	}
+	// Sources are a module name followed by the modules it links
+	parsed := map[string]int{}
+	parse := func(file string, src []byte) (*ast.Program, error) {
+		parsed[file]++
+		fields := strings.Fields(string(src))
+		links := []*ast.LinkStmt{}
+		for i, name := range fields[1:] {
+			links = append(links, ast.Link(i, name))
+		}
+		return ast.NewProgram(ast.Mod(fields[0]), links, nil, nil), nil
+	}
+	resolver := compiler.NewFSResolver(fsys, parse, "project", "vendor", "std")
+
+	type ResolveTest struct {
+		Name string
+		File string
+		Err  error
+	}
+
+	tests := []ResolveTest{
+		{"util", "project/util.flir", nil},
+		{"json", "vendor/json.flir", nil},
+		{"io", "std/io.flir", nil},
+		{"util", "project/util.flir", nil},
+		{"missing", "", compiler.ErrModuleNotFound},
+		{"../std/io", "", nil},
+	}
+
+	for i, test := range tests {
+		program, err := resolver.Resolve(test.Name)
+		if test.File == "" {
+			assert.Errorf(err, "Test case %d", i)
+			if test.Err != nil {
+				assert.ErrorIsf(err, test.Err, "Test case %d", i)
+			}
+			continue
+		}
+		assert.NoErrorf(err, "Test case %d", i)
+		assert.Equalf(test.File, program.File, "Test case %d", i)
+	}
+	assert.Equal(1, parsed["project/util.flir"])
+	_, err := resolver.Resolve("missing")
+	assert.EqualError(err, "module not found: missing in project, vendor, std")
+
+	main := ast.NewProgram(ast.Mod("main"), []*ast.LinkStmt{ast.Link(0, "util"), ast.Link(1, "json")}, nil, nil)
+	c := compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+	c.Init(main, resolver, map[int]int{})
+	err = c.Compile()
+	var resolveErr *compiler.ResolveError
+	assert.ErrorAs(err, &resolveErr)
+	assert.ErrorIs(err, compiler.ErrModuleNotFound)
+	assert.Equal([]string{"main", "json"}, resolveErr.Chain)
+	assert.Equal("missing", resolveErr.Name)
+	assert.ErrorContains(err, "cannot resolve link module missing (main -> json -> missing)")
+}
+
+func TestLinkCycles(t *testing.T) {
+	assert := assert.New(t)
+
+	program := func(name string, links ...string) *ast.Program {
+		stmts := []*ast.LinkStmt{}
+		for i, link := range links {
+			stmts = append(stmts, ast.Link(i, link))
+		}
+		return ast.NewProgram(ast.Mod(name), stmts, nil, nil)
+	}
+
+	type CycleTest struct {
+		Resolver compiler.MapResolver
+		Cycle    []string
+	}
+
+	tests := []CycleTest{
+		{compiler.MapResolver{"main": program("main", "a"), "a": program("a", "b"), "b": program("b", "a")}, []string{"a", "b", "a"}},
+		{compiler.MapResolver{"main": program("main", "a"), "a": program("a", "a")}, []string{"a", "a"}},
+		{compiler.MapResolver{"main": program("main", "a"), "a": program("a", "b"), "b": program("b", "c"), "c": program("c", "a")}, []string{"a", "b", "c", "a"}},
+		{compiler.MapResolver{"main": program("main", "a"), "a": program("a", "main")}, []string{"main", "a", "main"}},
+		{compiler.MapResolver{"main": program("main", "a", "b"), "a": program("a", "c"), "b": program("b", "c"), "c": program("c")}, nil},
+	}
+
+	for i, test := range tests {
+		c := compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+		c.Init(test.Resolver["main"], test.Resolver, map[int]int{})
+		err := c.Compile()
+		if test.Cycle == nil {
+			assert.NoErrorf(err, "Test case %d", i)
+			continue
+		}
+		var cycle *compiler.CycleError
+		assert.ErrorAsf(err, &cycle, "Test case %d", i)
+		assert.ErrorIsf(err, compiler.ErrLinkCycle, "Test case %d", i)
+		assert.Equalf(test.Cycle, cycle.Cycle, "Test case %d", i)
+	}
+
+	c := compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+	c.Init(tests[0].Resolver["main"], tests[0].Resolver, map[int]int{})
+	assert.ErrorContains(c.Compile(), "link cycle: a -> b -> a")
+}
+
+// Counts how many times each module is resolved
+type CountingResolver struct {
+	compiler.MapResolver
+	Counts map[string]int
+}
+
+func (r *CountingResolver) Resolve(name string) (*ast.Program, error) {
+	r.Counts[name]++
+	return r.MapResolver.Resolve(name)
+}
+
+func TestSharedLinks(t *testing.T) {
+	assert := assert.New(t)
+
+	// Every level links both modules of the next one, each path through the
+	// diamonds would compile the last level again
+	const depth = 24
+	resolver := &CountingResolver{MapResolver: compiler.MapResolver{}, Counts: map[string]int{}}
+	level := func(i int) []*ast.LinkStmt {
+		if i == depth {
+			return nil
+		}
+		return []*ast.LinkStmt{ast.Link(0, fmt.Sprintf("a%d", i+1)), ast.Link(1, fmt.Sprintf("b%d", i+1))}
+	}
+	for i := 1; i <= depth; i++ {
+		for _, side := range []string{"a", "b"} {
+			name := fmt.Sprintf("%s%d", side, i)
+			resolver.MapResolver[name] = ast.NewProgram(ast.Mod(name), level(i), nil, nil)
+		}
+	}
+	main := ast.NewProgram(ast.Mod("main"), level(0), nil, nil)
+
+	c := compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+	c.Init(main, resolver, map[int]int{})
+	assert.NoError(c.Compile())
+	assert.Len(resolver.Counts, 2*depth)
+	for name, count := range resolver.Counts {
+		assert.Equalf(1, count, "Module %s", name)
+	}
+	_, err := c.WriteTo(new(bytes.Buffer))
+	assert.NoError(err)
+}
+
+func TestPrebuiltModules(t *testing.T) {
+	assert := assert.New(t)
+
+	sources := map[string]*ast.Program{
+		"src/io.flir": ast.NewProgram(ast.Mod("io"), nil, nil, []*ast.ConstStmt{
+			ast.NamedConst("name", 0, "str", ast.String("io")).Export(),
+			ast.FnConst("print", 1, "fn", ast.Fn(
+				ast.NewOp("load.builtin", 0),
+				ast.NewOp("return.value"),
+			)).Export(),
+		}),
+		"src/std.flir": ast.NewProgram(ast.Mod("std"), []*ast.LinkStmt{ast.Link(0, "io")}, nil, []*ast.ConstStmt{
+			ast.NamedConst("version", 0, "i64", ast.Int(1)),
+			ast.FnConst("greet", 1, "fn", ast.Fn(
+				ast.NewSymbolOp("load.modconst", ast.Sym("io", "name")),
+				ast.NewOp("return.value"),
+			)).Export(),
+		}),
+	}
+	parsed := []string{}
+	parse := func(file string, src []byte) (*ast.Program, error) {
+		parsed = append(parsed, file)
+		return sources[file], nil
+	}
+	fsys := fstest.MapFS{
+		"src/io.flir":  {Data: []byte{}},
+		"src/std.flir": {Data: []byte{}},
+	}
+
+	// Build std once into a module file
+	std, err := compiler.NewFSResolver(fsys, parse, "src").Resolve("std")
+	assert.NoError(err)
+	c := compiler.NewIRCompiler(common.NewVersion(1, 2, 0))
+	c.Init(std, compiler.NewFSResolver(fsys, parse, "src"), map[int]int{0: 7})
+	assert.NoError(c.Compile())
+	buf := new(bytes.Buffer)
+	_, err = c.WriteModuleTo(buf)
+	assert.NoError(err)
+	fsys["lib/std.flmod"] = &fstest.MapFile{Data: bytes.Clone(buf.Bytes())}
+	delete(fsys, "src/std.flir")
+
+	parsed = parsed[:0]
+	resolver := compiler.NewFSResolver(fsys, parse, "lib", "src")
+	program := ast.NewProgram(ast.Mod("main"), []*ast.LinkStmt{ast.Link(0, "std")}, nil, []*ast.ConstStmt{
+		ast.FnConst("main", compiler.POOL_WRITE_LIMIT, "fn", ast.Fn(
+			ast.NewSymbolOp("load.modconst", ast.Sym("std", "greet")),
+			ast.NewOp("call", 0),
+			ast.NewOp("halt"),
+		)),
+	})
+	c = compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+	c.SetDebug(true)
+	c.Init(program, resolver, map[int]int{0: 7})
+	assert.NoError(c.Compile())
+	// Only the link of the prebuilt module is compiled from source
+	assert.Equal([]string{"src/io.flir"}, parsed)
+
+	buf.Reset()
+	_, err = c.WriteTo(buf)
+	assert.NoError(err)
+	archive := common.NewArchive()
+	_, err = archive.ReadFrom(buf)
+	assert.NoError(err)
+	mod, _, err := archive.Module("std", common.Constraint{})
+	assert.NoError(err)
+	assert.Equal(common.NewVersion(1, 2, 0), mod.Version)
+	// Sources reached through a prebuilt module use the builtins and debug setting of the program
+	io, _, err := archive.Module("io", common.Constraint{})
+	assert.NoError(err)
+	assert.True(bytes.Contains(io.Consts.Bytes(), []byte{byte(common.OpLoadBuiltin), 7, 0}))
+	assert.NotNil(io.Debug)
+	// The link std was built with is resolved to the io of this program
+	link := new(common.Link)
+	assert.NoError(mod.Links.Get(0, link))
+	assert.True(link.Resolved)
+	assert.Equal(io.Version, link.Version)
+	assert.NotEqual(mod.Version, link.Version)
+
+	machine := vm.NewVM()
+	assert.NoError(machine.Init(archive, vm.DefaultBuiltins(machine)))
+	machine.Run()
+	assert.False(machine.Paniced(), machine.PanicMessage())
+	top, err := machine.Thread().Stack().Top()
+	assert.NoError(err)
+	assert.Equal("io", top.Value)
+
+	// Module files do not keep const indicies, so their consts are only found by symbol
+	indexed := ast.NewProgram(ast.Mod("main"), []*ast.LinkStmt{ast.Link(0, "std")}, nil, []*ast.ConstStmt{
+		ast.FnConst("main", compiler.POOL_WRITE_LIMIT, "fn", ast.Fn(
+			ast.NewOp("load.modconst", 0, 1),
+			ast.NewOp("halt"),
+		)),
+	})
+	c = compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+	c.Init(indexed, compiler.NewFSResolver(fsys, parse, "lib", "src"), map[int]int{0: 7})
+	assert.ErrorIs(c.Compile(), compiler.ErrPrebuiltConstIndex)
+
+	// Prebuilt modules still need the modules they link
+	delete(fsys, "src/io.flir")
+	c = compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+	c.Init(program, compiler.NewFSResolver(fsys, parse, "lib", "src"), map[int]int{})
+	var resolveErr *compiler.ResolveError
+	err = c.Compile()
+	assert.ErrorAs(err, &resolveErr)
+	assert.Equal([]string{"main", "std"}, resolveErr.Chain)
+	assert.Equal("io", resolveErr.Name)
+}
+
+func TestVersionedLinks(t *testing.T) {
+	assert := assert.New(t)
+
+	resolver := compiler.MapResolver{
+		"io":   ast.NewProgram(ast.VersionedMod("io", "1.2.0"), nil, nil, nil),
+		"std":  ast.NewProgram(ast.Mod("std"), []*ast.LinkStmt{ast.VersionedLink(0, "io", "~1.2")}, nil, nil),
+		"json": ast.NewProgram(ast.Mod("json"), []*ast.LinkStmt{ast.VersionedLink(0, "io", "~1.3")}, nil, nil),
+	}
+
+	type VersionTest struct {
+		Link *ast.LinkStmt
+		Err  string
+	}
+
+	tests := []VersionTest{
+		{ast.Link(0, "io"), ""},
+		{ast.VersionedLink(0, "io", "^1.0.0"), ""},
+		{ast.VersionedLink(0, "io", "1.2.0"), ""},
+		{ast.VersionedLink(0, "io", "~1.2.1"), "version does not satisfy constraint: module io is 1.2.0, main requires ~1.2.1"},
+		{ast.VersionedLink(0, "io", "^2"), "version does not satisfy constraint: module io is 1.2.0, main requires ^2.0.0"},
+		{ast.Link(0, "std"), ""},
+		{ast.Link(0, "json"), "version does not satisfy constraint: module io is 1.2.0, main -> json requires ~1.3.0"},
+		{ast.VersionedLink(0, "std", "^0.1.0"), "version does not satisfy constraint: module std is 0.0.1, main requires ^0.1.0"},
+		{ast.VersionedLink(0, "io", "^x"), "invalid version constraint"},
+	}
+
+	for i, test := range tests {
+		program := ast.NewProgram(ast.Mod("main"), []*ast.LinkStmt{test.Link}, nil, nil)
+		c := compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+		c.Init(program, resolver, map[int]int{})
+		err := c.Compile()
+		if test.Err == "" {
+			assert.NoErrorf(err, "Test case %d", i)
+			continue
+		}
+		assert.ErrorContainsf(err, test.Err, "Test case %d", i)
+		if strings.HasPrefix(test.Err, "version") {
+			assert.ErrorIsf(err, common.ErrVersionMismatch, "Test case %d", i)
+		}
+	}
+
+	program := ast.NewProgram(ast.VersionedMod("main", "1.x"), nil, nil, nil)
+	c := compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+	c.Init(program, resolver, map[int]int{})
+	assert.ErrorContains(c.Compile(), `invalid version "1.x"`)
+
+	// Two versions of a module live side by side in the archive
+	resolver["fork"] = ast.NewProgram(ast.VersionedMod("io", "1.3.0"), nil, nil, nil)
+	program = ast.NewProgram(ast.Mod("main"), []*ast.LinkStmt{ast.Link(0, "io"), ast.Link(1, "fork")}, nil, nil)
+	c = compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+	c.Init(program, resolver, map[int]int{})
+	assert.NoError(c.Compile())
+	buf := new(bytes.Buffer)
+	_, err := c.WriteTo(buf)
+	assert.NoError(err)
+	archive := common.NewArchive()
+	_, err = archive.ReadFrom(buf)
+	assert.NoError(err)
+	for constraint, expected := range map[string]common.Version{"": common.NewVersion(1, 3, 0), "~1.2": common.NewVersion(1, 2, 0)} {
+		parsed, err := common.ParseConstraint(constraint)
+		assert.NoError(err)
+		mod, _, err := archive.Module("io", parsed)
+		assert.NoError(err)
+		assert.Equal(expected, mod.Version, constraint)
+	}
+
+	// Two different modules cannot share a name and a version
+	resolver["fork"] = ast.NewProgram(ast.VersionedMod("io", "1.2.0"), nil, nil, []*ast.ConstStmt{
+		ast.NamedConst("name", 0, "str", ast.String("fork")),
+	})
+	c = compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+	c.Init(program, resolver, map[int]int{})
+	err = c.Compile()
+	assert.ErrorIs(err, common.ErrModuleCollision)
+	assert.ErrorContains(err, "module collision: two different modules are io 1.2.0")
+}
@@ -0,0 +1,191 @@
+package compiler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/canpacis/flint/ast"
+	"github.com/canpacis/flint/common"
+)
+
+var ErrModuleNotFound = errors.New("module not found")
+var ErrLinkCycle = errors.New("link cycle")
+var ErrPrebuiltConstIndex = errors.New("prebuilt modules must be referenced by symbol")
+
+// Extension of flint ir source files
+const SOURCE_EXT = ".flir"
+
+// Extension of compiled module files
+const MODULE_EXT = ".flmod"
+
+// Finds the program of a linked module by the name given in its link statement
+type Resolver interface {
+	Resolve(name string) (*ast.Program, error)
+}
+
+// Resolvers that can find prebuilt modules, which are linked without compiling them again.
+// Modules that are not prebuilt are reported with ErrModuleNotFound and resolved from source
+type ModuleResolver interface {
+	Resolver
+	ResolveModule(name string) (*common.Module, error)
+}
+
+// Resolves modules from programs that are already parsed
+type MapResolver map[string]*ast.Program
+
+func (r MapResolver) Resolve(name string) (*ast.Program, error) {
+	program, ok := r[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrModuleNotFound, name)
+	}
+	return program, nil
+}
+
+// Parses the source of a module read from file
+type ParseFunc func(file string, src []byte) (*ast.Program, error)
+
+// Inspects a module file before it is parsed or loaded, an error rejects the file
+type ReadFunc func(name, file string, src []byte) error
+
+// Resolves modules from source files in a list of search paths, a link to "io"
+// resolves to the first io.flir found, or io.flmod if it was compiled already.
+// Parsed programs and loaded modules are cached
+type FSResolver struct {
+	fsys   fs.FS
+	parse  ParseFunc
+	paths  []string
+	cache  map[string]*ast.Program
+	built  map[string]*common.Module
+	onread ReadFunc
+}
+
+// Sets a function every module file is passed to once it is read
+func (r *FSResolver) OnRead(fn ReadFunc) {
+	r.onread = fn
+}
+
+func (r *FSResolver) Resolve(name string) (*ast.Program, error) {
+	if program, ok := r.cache[name]; ok {
+		return program, nil
+	}
+	file, src, err := r.find(name, SOURCE_EXT)
+	if err != nil {
+		return nil, err
+	}
+	program, err := r.parse(file, src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	if program.File == "" {
+		program.File = file
+	}
+	r.cache[name] = program
+	return program, nil
+}
+
+func (r *FSResolver) ResolveModule(name string) (*common.Module, error) {
+	if mod, ok := r.built[name]; ok {
+		return mod, nil
+	}
+	file, src, err := r.find(name, MODULE_EXT)
+	if err != nil {
+		return nil, err
+	}
+	mod := common.NewModule("", 0)
+	if _, err := mod.ReadFrom(bytes.NewReader(src)); err != nil {
+		return nil, fmt.Errorf("failed to read module %s: %w", file, err)
+	}
+	if mod.Name != name {
+		return nil, fmt.Errorf("module file %s holds module %s", file, mod.Name)
+	}
+	r.built[name] = mod
+	return mod, nil
+}
+
+// Reads the first file of the search paths for the module called name
+func (r *FSResolver) find(name, ext string) (string, []byte, error) {
+	if name == "" || !fs.ValidPath(name) {
+		return "", nil, fmt.Errorf("invalid module name %q", name)
+	}
+
+	for _, dir := range r.paths {
+		file := path.Join(dir, name+ext)
+		src, err := fs.ReadFile(r.fsys, file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if r.onread != nil {
+			if err := r.onread(name, file, src); err != nil {
+				return "", nil, err
+			}
+		}
+		return file, src, nil
+	}
+	return "", nil, fmt.Errorf("%w: %s in %s", ErrModuleNotFound, name, strings.Join(r.paths, ", "))
+}
+
+// Creates a resolver searching paths of fsys in order, typically the project,
+// vendor and standard library directories
+func NewFSResolver(fsys fs.FS, parse ParseFunc, paths ...string) *FSResolver {
+	return &FSResolver{
+		fsys:  fsys,
+		parse: parse,
+		paths: paths,
+		cache: make(map[string]*ast.Program),
+		built: make(map[string]*common.Module),
+	}
+}
+
+// Error of a link that cannot be resolved, along with the links that led to it
+type ResolveError struct {
+	// Modules from the program being compiled to the one with the failing link
+	Chain []string
+	Name  string
+	Err   error
+}
+
+func (e *ResolveError) Error() string {
+	return fmt.Sprintf("cannot resolve link module %s (%s -> %s): %v", e.Name, strings.Join(e.Chain, " -> "), e.Name, e.Err)
+}
+
+func (e *ResolveError) Unwrap() error {
+	return e.Err
+}
+
+// Error of a module that links itself through its links
+type CycleError struct {
+	// Modules of the cycle, starting and ending with the same module
+	Cycle []string
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrLinkCycle, strings.Join(e.Cycle, " -> "))
+}
+
+func (e *CycleError) Unwrap() error {
+	return ErrLinkCycle
+}
+
+// Error of a linked module whose version is outside the constraint of the link
+type VersionError struct {
+	// Modules from the program being compiled to the one with the failing link
+	Chain      []string
+	Name       string
+	Constraint common.Constraint
+	Version    common.Version
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("%s: module %s is %s, %s requires %s", common.ErrVersionMismatch, e.Name, e.Version, strings.Join(e.Chain, " -> "), e.Constraint)
+}
+
+func (e *VersionError) Unwrap() error {
+	return common.ErrVersionMismatch
+}
@@ -0,0 +1,286 @@
+package dap_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/canpacis/flint/ast"
+	"github.com/canpacis/flint/common"
+	"github.com/canpacis/flint/compiler"
+	"github.com/canpacis/flint/dap"
+	"github.com/canpacis/flint/vm"
+	"github.com/stretchr/testify/assert"
+)
+
+func WriteProgram(t *testing.T) string {
+	assert := assert.New(t)
+
+	program := ast.NewProgram(
+		ast.Mod("main"),
+		nil,
+		nil,
+		[]*ast.ConstStmt{
+			ast.FnConst("add", 0, "fn", ast.FnParams([]string{"a", "b"},
+				ast.NewOp("load.local", 0).At(2),
+				ast.NewOp("load.local", 1).At(2),
+				ast.NewOp("add.i64").At(3),
+				ast.NewOp("return.value").At(4),
+			)).At(1),
+			ast.FnConst("main", compiler.POOL_WRITE_LIMIT, "fn", ast.Fn(
+				ast.NewOp("load.i64", 5).At(7),
+				ast.NewOp("load.i64", 7).At(7),
+				ast.NewOp("load.const", 0).At(8),
+				ast.NewOp("call", 2).At(8),
+				ast.NewOp("pop").At(9),
+				ast.NewOp("halt").At(10),
+			)).At(6),
+		},
+	)
+	program.File = "src/main.flir"
+
+	c := compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+	c.SetDebug(true)
+	c.Init(program, compiler.MapResolver{}, vm.DefaultBuiltins(vm.NewVM()).Map())
+	assert.NoError(c.Compile())
+
+	path := filepath.Join(t.TempDir(), "main.flar")
+	file, err := os.Create(path)
+	assert.NoError(err)
+	defer file.Close()
+	_, err = c.WriteTo(file)
+	assert.NoError(err)
+	return path
+}
+
+type Client struct {
+	t        *testing.T
+	conn     net.Conn
+	seq      int
+	messages chan *dap.Message
+}
+
+func (c *Client) Send(command string, args any) {
+	c.seq++
+	msg := &dap.Message{Seq: c.seq, Type: "request", Command: command}
+	if args != nil {
+		data, err := json.Marshal(args)
+		assert.NoError(c.t, err)
+		msg.Arguments = data
+	}
+	assert.NoError(c.t, dap.WriteMessage(c.conn, msg))
+}
+
+func (c *Client) Next() *dap.Message {
+	select {
+	case msg := <-c.messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("timed out waiting for a message")
+		return nil
+	}
+}
+
+// Reads messages until the response for command, returning its body
+func (c *Client) Expect(command string, body any) {
+	for {
+		msg := c.Next()
+		if msg.Type != "response" {
+			continue
+		}
+		assert.Equal(c.t, command, msg.Command)
+		assert.Truef(c.t, msg.Success, "%s failed: %s", command, msg.Message)
+		if body != nil {
+			assert.NoError(c.t, json.Unmarshal(msg.Body, body))
+		}
+		return
+	}
+}
+
+func (c *Client) Event(name string, body any) {
+	for {
+		msg := c.Next()
+		if msg.Type != "event" || msg.Event != name {
+			continue
+		}
+		if body != nil {
+			assert.NoError(c.t, json.Unmarshal(msg.Body, body))
+		}
+		return
+	}
+}
+
+func (c *Client) Request(command string, args any, body any) {
+	c.Send(command, args)
+	c.Expect(command, body)
+}
+
+func NewClient(t *testing.T) *Client {
+	server, conn := net.Pipe()
+	go dap.NewServer(server, server, nil).Serve()
+
+	client := &Client{t: t, conn: conn, messages: make(chan *dap.Message, 64)}
+	go func() {
+		reader := bufio.NewReader(conn)
+		for {
+			msg, err := dap.ReadMessage(reader)
+			if err != nil {
+				close(client.messages)
+				return
+			}
+			client.messages <- msg
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return client
+}
+
+func TestSession(t *testing.T) {
+	assert := assert.New(t)
+
+	program := WriteProgram(t)
+	client := NewClient(t)
+
+	var capabilities dap.Capabilities
+	client.Request("initialize", map[string]any{"adapterID": "flint"}, &capabilities)
+	assert.True(capabilities.SupportsConfigurationDoneRequest)
+	client.Event("initialized", nil)
+
+	client.Request("launch", dap.LaunchArguments{Program: program}, nil)
+
+	var breakpoints struct{ Breakpoints []dap.Breakpoint }
+	client.Request("setBreakpoints", dap.SetBreakpointsArguments{
+		Source:      dap.Source{Path: "/home/dev/project/src/main.flir"},
+		Breakpoints: []dap.SourceBreakpoint{{Line: 3}, {Line: 5}},
+	}, &breakpoints)
+	assert.Len(breakpoints.Breakpoints, 2)
+	assert.True(breakpoints.Breakpoints[0].Verified)
+	// There is no code on line 5
+	assert.False(breakpoints.Breakpoints[1].Verified)
+
+	client.Request("configurationDone", nil, nil)
+	var stopped dap.StoppedEvent
+	client.Event("stopped", &stopped)
+	assert.Equal("breakpoint", stopped.Reason)
+	assert.Equal(dap.ThreadID, stopped.ThreadID)
+
+	var threads struct{ Threads []dap.Thread }
+	client.Request("threads", nil, &threads)
+	assert.Equal([]dap.Thread{{ID: dap.ThreadID, Name: "main"}}, threads.Threads)
+
+	var trace struct{ StackFrames []dap.StackFrame }
+	client.Request("stackTrace", dap.StackTraceArguments{ThreadID: dap.ThreadID}, &trace)
+	assert.Len(trace.StackFrames, 2)
+	assert.Equal("main.add", trace.StackFrames[0].Name)
+	assert.Equal(3, trace.StackFrames[0].Line)
+	assert.Equal("src/main.flir", trace.StackFrames[0].Source.Path)
+	assert.Equal("main.main", trace.StackFrames[1].Name)
+	assert.Equal(8, trace.StackFrames[1].Line)
+
+	var scopes struct{ Scopes []dap.Scope }
+	client.Request("scopes", dap.ScopesArguments{FrameID: trace.StackFrames[0].ID}, &scopes)
+	assert.Len(scopes.Scopes, 2)
+	assert.Equal("Locals", scopes.Scopes[0].Name)
+
+	var variables struct{ Variables []dap.Variable }
+	client.Request("variables", dap.VariablesArguments{VariablesReference: scopes.Scopes[0].VariablesReference}, &variables)
+	assert.Equal([]dap.Variable{
+		{Name: "a", Value: "5", Type: "i64"},
+		{Name: "b", Value: "7", Type: "i64"},
+	}, variables.Variables)
+
+	client.Request("variables", dap.VariablesArguments{VariablesReference: scopes.Scopes[1].VariablesReference}, &variables)
+	assert.Len(variables.Variables, 4)
+
+	type StepTest struct {
+		Command       string
+		ExpectedFrame string
+		ExpectedLine  int
+	}
+
+	tests := []StepTest{
+		{"stepOut", "main.main", 9},
+		{"next", "main.main", 10},
+	}
+
+	for i, test := range tests {
+		client.Request(test.Command, map[string]any{"threadId": dap.ThreadID}, nil)
+		client.Event("stopped", &stopped)
+		assert.Equalf("step", stopped.Reason, "Test case %d", i)
+		client.Request("stackTrace", dap.StackTraceArguments{ThreadID: dap.ThreadID}, &trace)
+		assert.Equalf(test.ExpectedFrame, trace.StackFrames[0].Name, "Test case %d", i)
+		assert.Equalf(test.ExpectedLine, trace.StackFrames[0].Line, "Test case %d", i)
+	}
+
+	client.Request("continue", map[string]any{"threadId": dap.ThreadID}, nil)
+	var exited dap.ExitedEvent
+	client.Event("exited", &exited)
+	assert.Equal(0, exited.ExitCode)
+	client.Event("terminated", nil)
+
+	client.Request("disconnect", nil, nil)
+}
+
+func TestStepIn(t *testing.T) {
+	assert := assert.New(t)
+
+	program := WriteProgram(t)
+	client := NewClient(t)
+
+	client.Request("initialize", nil, nil)
+	client.Request("launch", dap.LaunchArguments{Program: program, StopOnEntry: true}, nil)
+	client.Request("configurationDone", nil, nil)
+
+	var stopped dap.StoppedEvent
+	client.Event("stopped", &stopped)
+	assert.Equal("entry", stopped.Reason)
+
+	var trace struct{ StackFrames []dap.StackFrame }
+	lines := []int{8, 2}
+	for i, line := range lines {
+		client.Request("stepIn", map[string]any{"threadId": dap.ThreadID}, nil)
+		client.Event("stopped", &stopped)
+		client.Request("stackTrace", dap.StackTraceArguments{ThreadID: dap.ThreadID}, &trace)
+		assert.Equalf(line, trace.StackFrames[0].Line, "Test case %d", i)
+	}
+	assert.Equal("main.add", trace.StackFrames[0].Name)
+
+	client.Send("evaluate", map[string]any{"expression": "a"})
+	msg := client.Next()
+	for msg.Type != "response" {
+		msg = client.Next()
+	}
+	assert.False(msg.Success)
+}
+
+func TestLaunchError(t *testing.T) {
+	assert := assert.New(t)
+
+	client := NewClient(t)
+	client.Send("launch", dap.LaunchArguments{Program: filepath.Join(t.TempDir(), "missing.flar")})
+	msg := client.Next()
+	assert.Equal("response", msg.Type)
+	assert.False(msg.Success)
+
+	client.Send("stackTrace", dap.StackTraceArguments{ThreadID: dap.ThreadID})
+	msg = client.Next()
+	assert.False(msg.Success)
+	assert.Equal(dap.ErrNotLaunched.Error(), msg.Message)
+
+	// Failed responses still carry the success field
+	data, err := json.Marshal(msg)
+	assert.NoError(err)
+	assert.Contains(string(data), `"success":false`)
+}
+
+func TestListenLoopback(t *testing.T) {
+	assert := assert.New(t)
+
+	for i, addr := range []string{"0.0.0.0:0", "192.168.1.10:4711", "example.com:4711"} {
+		assert.ErrorIsf(dap.ListenAndServe(addr, nil), dap.ErrNotLoopback, "Test case %d", i)
+	}
+}
@@ -0,0 +1,387 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+
+	"github.com/canpacis/flint/common"
+	"github.com/canpacis/flint/debug"
+	"github.com/canpacis/flint/vm"
+)
+
+const ThreadID = 1
+
+// Variables reference of the value stack scope, frame locals use depth + 1
+const stackReference = 1 << 20
+
+var ErrNotLaunched = errors.New("program is not launched")
+var ErrNotLoopback = errors.New("address is not a loopback address")
+
+type Loader func(program string, stdout io.Writer) (*vm.VM, error)
+
+func DefaultLoader(program string, stdout io.Writer) (*vm.VM, error) {
+	archive, err := common.OpenArchive(program)
+	if err != nil {
+		return nil, err
+	}
+	// Replace the standard output descriptor so program output does not mix with the protocol
+	config := vm.DefaultConfig()
+	config.Stdout = stdout
+	machine := vm.NewVMWithConfig(config)
+
+	if err := machine.Init(archive, vm.DefaultBuiltins(machine)); err != nil {
+		return nil, err
+	}
+	return machine, nil
+}
+
+type outputWriter struct {
+	server *Server
+}
+
+func (w *outputWriter) Write(b []byte) (int, error) {
+	if err := w.server.event("output", OutputEvent{Category: "stdout", Output: string(b)}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+type Server struct {
+	reader      *bufio.Reader
+	writer      io.Writer
+	loader      Loader
+	seq         int
+	debugger    *debug.Debugger
+	stopOnEntry bool
+	pending     map[string][]int
+	sources     map[string][]int
+	done        bool
+}
+
+func (s *Server) send(msg *Message) error {
+	s.seq++
+	msg.Seq = s.seq
+	return WriteMessage(s.writer, msg)
+}
+
+func (s *Server) event(name string, body any) error {
+	msg := &Message{Type: "event", Event: name}
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		msg.Body = data
+	}
+	return s.send(msg)
+}
+
+func (s *Server) respond(req *Message, body any, err error) error {
+	msg := &Message{Type: "response", Command: req.Command, RequestSeq: req.Seq, Success: err == nil}
+	if err != nil {
+		msg.Message = err.Error()
+	} else if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		msg.Body = data
+	}
+	return s.send(msg)
+}
+
+func (s *Server) setBreakpoints(path string, lines []int) []Breakpoint {
+	for _, id := range s.sources[path] {
+		s.debugger.Clear(id)
+	}
+	s.sources[path] = nil
+
+	breakpoints := make([]Breakpoint, len(lines))
+	for i, line := range lines {
+		bp := s.debugger.BreakLine(path, line)
+		s.sources[path] = append(s.sources[path], bp.ID)
+		breakpoints[i] = Breakpoint{
+			ID:       bp.ID,
+			Verified: s.debugger.HasCode(path, line),
+			Line:     line,
+			Source:   Source{Name: filepath.Base(path), Path: path},
+		}
+	}
+	return breakpoints
+}
+
+// Reports how the debugger stopped to the client
+func (s *Server) stopped(reason debug.StopReason) error {
+	switch reason {
+	case debug.StopBreakpoint:
+		return s.event("stopped", StoppedEvent{Reason: "breakpoint", ThreadID: ThreadID, AllThreadsStopped: true})
+	case debug.StopStep:
+		return s.event("stopped", StoppedEvent{Reason: "step", ThreadID: ThreadID, AllThreadsStopped: true})
+	case debug.StopPause:
+		return s.event("stopped", StoppedEvent{Reason: "pause", ThreadID: ThreadID, AllThreadsStopped: true})
+	default:
+		machine := s.debugger.VM()
+		result := machine.Result()
+		if result.Paniced {
+			if err := s.event("output", OutputEvent{Category: "stderr", Output: fmt.Sprintf("panic: %s\n", machine.PanicMessage())}); err != nil {
+				return err
+			}
+		}
+		if err := s.event("exited", ExitedEvent{ExitCode: result.Code}); err != nil {
+			return err
+		}
+		return s.event("terminated", nil)
+	}
+}
+
+func (s *Server) stackTrace() []StackFrame {
+	frames := s.debugger.Frames()
+	trace := make([]StackFrame, len(frames))
+	for i, frame := range frames {
+		trace[i] = StackFrame{ID: i, Name: frame.String(), Column: 1}
+		if pos, ok := s.debugger.Position(i); ok {
+			trace[i].Line = pos.Line
+			trace[i].Source = &Source{Name: filepath.Base(pos.File), Path: pos.File}
+		}
+	}
+	return trace
+}
+
+func (s *Server) variables(ref int) ([]Variable, error) {
+	if ref == stackReference {
+		stack := s.debugger.Stack()
+		vars := make([]Variable, len(stack))
+		for i, constant := range stack {
+			vars[i] = Variable{Name: fmt.Sprintf("%d", i), Value: fmt.Sprintf("%v", constant.Value), Type: constant.Type.String()}
+		}
+		return vars, nil
+	}
+	locals, err := s.debugger.Locals(ref - 1)
+	if err != nil {
+		return nil, err
+	}
+	vars := make([]Variable, len(locals))
+	for i, local := range locals {
+		vars[i] = Variable{Name: local.Name, Value: fmt.Sprintf("%v", local.Value.Value), Type: local.Value.Type.String()}
+	}
+	return vars, nil
+}
+
+func decode[T any](req *Message) (T, error) {
+	var args T
+	if len(req.Arguments) == 0 {
+		return args, nil
+	}
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return args, fmt.Errorf("invalid arguments for %s: %w", req.Command, err)
+	}
+	return args, nil
+}
+
+func (s *Server) handle(req *Message) error {
+	if s.debugger == nil {
+		switch req.Command {
+		case "initialize", "launch", "setBreakpoints", "configurationDone", "disconnect", "threads":
+		default:
+			return s.respond(req, nil, ErrNotLaunched)
+		}
+	}
+
+	switch req.Command {
+	case "initialize":
+		if err := s.respond(req, Capabilities{SupportsConfigurationDoneRequest: true}, nil); err != nil {
+			return err
+		}
+		return s.event("initialized", nil)
+	case "launch":
+		args, err := decode[LaunchArguments](req)
+		if err != nil {
+			return s.respond(req, nil, err)
+		}
+		machine, err := s.loader(args.Program, &outputWriter{s})
+		if err != nil {
+			return s.respond(req, nil, err)
+		}
+		s.debugger = debug.New(machine)
+		s.stopOnEntry = args.StopOnEntry
+		for path, lines := range s.pending {
+			s.setBreakpoints(path, lines)
+		}
+		s.pending = nil
+		return s.respond(req, nil, nil)
+	case "setBreakpoints":
+		args, err := decode[SetBreakpointsArguments](req)
+		if err != nil {
+			return s.respond(req, nil, err)
+		}
+		lines := make([]int, len(args.Breakpoints))
+		for i, bp := range args.Breakpoints {
+			lines[i] = bp.Line
+		}
+		if s.debugger == nil {
+			s.pending[args.Source.Path] = lines
+			breakpoints := make([]Breakpoint, len(lines))
+			for i, line := range lines {
+				breakpoints[i] = Breakpoint{Line: line, Source: args.Source}
+			}
+			return s.respond(req, map[string]any{"breakpoints": breakpoints}, nil)
+		}
+		return s.respond(req, map[string]any{"breakpoints": s.setBreakpoints(args.Source.Path, lines)}, nil)
+	case "configurationDone":
+		if s.debugger == nil {
+			return s.respond(req, nil, ErrNotLaunched)
+		}
+		if err := s.respond(req, nil, nil); err != nil {
+			return err
+		}
+		if s.stopOnEntry {
+			return s.event("stopped", StoppedEvent{Reason: "entry", ThreadID: ThreadID, AllThreadsStopped: true})
+		}
+		return s.stopped(s.debugger.Continue())
+	case "threads":
+		return s.respond(req, map[string]any{"threads": []Thread{{ID: ThreadID, Name: "main"}}}, nil)
+	case "stackTrace":
+		args, err := decode[StackTraceArguments](req)
+		if err != nil {
+			return s.respond(req, nil, err)
+		}
+		frames := s.stackTrace()
+		total := len(frames)
+		if args.StartFrame < len(frames) {
+			frames = frames[args.StartFrame:]
+		} else {
+			frames = nil
+		}
+		if args.Levels > 0 && args.Levels < len(frames) {
+			frames = frames[:args.Levels]
+		}
+		return s.respond(req, map[string]any{"stackFrames": frames, "totalFrames": total}, nil)
+	case "scopes":
+		args, err := decode[ScopesArguments](req)
+		if err != nil {
+			return s.respond(req, nil, err)
+		}
+		if _, err := s.debugger.Frame(args.FrameID); err != nil {
+			return s.respond(req, nil, err)
+		}
+		scopes := []Scope{
+			{Name: "Locals", VariablesReference: args.FrameID + 1},
+			{Name: "Stack", VariablesReference: stackReference},
+		}
+		return s.respond(req, map[string]any{"scopes": scopes}, nil)
+	case "variables":
+		args, err := decode[VariablesArguments](req)
+		if err != nil {
+			return s.respond(req, nil, err)
+		}
+		vars, err := s.variables(args.VariablesReference)
+		if err != nil {
+			return s.respond(req, nil, err)
+		}
+		return s.respond(req, map[string]any{"variables": vars}, nil)
+	case "continue", "next", "stepIn", "stepOut":
+		var body any
+		if req.Command == "continue" {
+			body = map[string]any{"allThreadsContinued": true}
+		}
+		if err := s.respond(req, body, nil); err != nil {
+			return err
+		}
+		switch req.Command {
+		case "continue":
+			return s.stopped(s.debugger.Continue())
+		case "next":
+			return s.stopped(s.debugger.StepOver())
+		case "stepIn":
+			return s.stopped(s.debugger.StepInto())
+		default:
+			return s.stopped(s.debugger.StepOut())
+		}
+	case "disconnect":
+		s.done = true
+		return s.respond(req, nil, nil)
+	default:
+		return s.respond(req, nil, fmt.Errorf("unsupported command %s", req.Command))
+	}
+}
+
+func (s *Server) Serve() error {
+	for !s.done {
+		msg, err := ReadMessage(s.reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if msg.Type != "request" {
+			continue
+		}
+		if err := s.handle(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NewServer(r io.Reader, w io.Writer, loader Loader) *Server {
+	if loader == nil {
+		loader = DefaultLoader
+	}
+	return &Server{
+		reader:  bufio.NewReader(r),
+		writer:  w,
+		loader:  loader,
+		pending: make(map[string][]int),
+		sources: make(map[string][]int),
+	}
+}
+
+// Serves debug sessions on a local socket, one connection at a time. The address has
+// to be a loopback address since clients can launch any program on the host, an
+// address without a host listens on 127.0.0.1
+func ListenAndServe(addr string, loader Loader) error {
+	addr, err := loopback(addr)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		err = NewServer(conn, conn, loader).Serve()
+		conn.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func loopback(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	if host == "localhost" {
+		return addr, nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return addr, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrNotLoopback, addr)
+}
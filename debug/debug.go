@@ -0,0 +1,372 @@
+package debug
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/canpacis/flint/common"
+	"github.com/canpacis/flint/vm"
+)
+
+var ErrNoBreakpoint = errors.New("no such breakpoint")
+var ErrNoFrame = errors.New("no such frame")
+var ErrNotRunning = errors.New("program is not running")
+
+type StopReason int
+
+const (
+	StopStep = StopReason(iota)
+	StopBreakpoint
+	StopPause
+	StopExit
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopStep:
+		return "step"
+	case StopBreakpoint:
+		return "breakpoint"
+	case StopPause:
+		return "pause"
+	case StopExit:
+		return "exit"
+	default:
+		return ""
+	}
+}
+
+type Breakpoint struct {
+	ID     int
+	Fn     string
+	Offset int
+	File   string
+	Line   int
+}
+
+func (b *Breakpoint) String() string {
+	if b.Line > 0 {
+		return fmt.Sprintf("#%d %s:%d", b.ID, b.File, b.Line)
+	}
+	return fmt.Sprintf("#%d %s+%d", b.ID, b.Fn, b.Offset)
+}
+
+func (b *Breakpoint) matches(frame *vm.Frame) bool {
+	if b.Line <= 0 {
+		return frame.Fn().Name() == b.Fn && frame.IP() == b.Offset
+	}
+	info := frame.Debug()
+	if info == nil {
+		return false
+	}
+	if !sameFile(b.File, frame.Module().Debug.File) {
+		return false
+	}
+	for _, offset := range info.Offsets(b.Line) {
+		if offset == frame.IP() {
+			return true
+		}
+	}
+	return false
+}
+
+// Source paths match when one is a path suffix of the other, so editors can
+// use absolute paths against the relative paths stored in debug info
+func sameFile(a, b string) bool {
+	if a == "" || a == b {
+		return true
+	}
+	a, b = filepath.ToSlash(filepath.Clean(a)), filepath.ToSlash(filepath.Clean(b))
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	return strings.HasSuffix(a, "/"+b)
+}
+
+type Variable struct {
+	Name  string
+	Value *common.Const
+}
+
+type Debugger struct {
+	vm          *vm.VM
+	breakpoints []*Breakpoint
+	next        int
+	hit         *Breakpoint
+	started     bool
+	// Thread the debugger stopped in, nil for the main thread
+	current *vm.Executor
+}
+
+func (d *Debugger) VM() *vm.VM {
+	return d.vm
+}
+
+func (d *Debugger) Break(fn string, offset int) *Breakpoint {
+	d.next++
+	bp := &Breakpoint{ID: d.next, Fn: fn, Offset: offset}
+	d.breakpoints = append(d.breakpoints, bp)
+	return bp
+}
+
+// An empty file matches every source file
+func (d *Debugger) BreakLine(file string, line int) *Breakpoint {
+	d.next++
+	bp := &Breakpoint{ID: d.next, File: file, Line: line}
+	d.breakpoints = append(d.breakpoints, bp)
+	return bp
+}
+
+// Reports whether any module of the program has code on the line of file
+func (d *Debugger) HasCode(file string, line int) bool {
+	archive := d.vm.Archive()
+	if archive == nil {
+		return false
+	}
+	for _, entry := range archive.Entries() {
+		if entry.Debug == nil || !sameFile(file, entry.Debug.File) {
+			continue
+		}
+		for _, fn := range entry.Debug.Fns {
+			if len(fn.Offsets(line)) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (d *Debugger) Clear(id int) error {
+	for i, bp := range d.breakpoints {
+		if bp.ID == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %d", ErrNoBreakpoint, id)
+}
+
+func (d *Debugger) ClearAll() {
+	d.breakpoints = nil
+}
+
+func (d *Debugger) Breakpoints() []*Breakpoint {
+	return d.breakpoints
+}
+
+// Breakpoint that caused the last stop, nil if the last stop was not a breakpoint
+func (d *Debugger) Hit() *Breakpoint {
+	return d.hit
+}
+
+func (d *Debugger) Running() bool {
+	return d.vm.Running()
+}
+
+// Thread that frames, stack and locals are read from
+func (d *Debugger) Thread() *vm.Executor {
+	if d.current == nil {
+		return d.vm.Thread()
+	}
+	return d.current
+}
+
+// Checks the program and the next instruction of thread for a reason to stop
+func (d *Debugger) stopReason(thread *vm.Executor) (StopReason, bool) {
+	if d.vm.Thread().Paused() {
+		return StopPause, true
+	}
+	if !d.vm.Running() {
+		return StopExit, true
+	}
+	// Blocked threads retry their instruction, it was checked before they first ran it
+	if state := thread.State(); state != vm.StateRunnable && state != vm.StateSuspended {
+		return StopStep, false
+	}
+	frame, err := thread.Frames().Top()
+	if err != nil {
+		return StopStep, false
+	}
+	for _, bp := range d.breakpoints {
+		if bp.matches(frame) {
+			d.hit = bp
+			return StopBreakpoint, true
+		}
+	}
+	return StopStep, false
+}
+
+func (d *Debugger) depth() int {
+	return d.Thread().Frames().Len()
+}
+
+func (d *Debugger) line() int {
+	frame, err := d.Thread().Frames().Top()
+	if err != nil {
+		return 0
+	}
+	pos, ok := frame.Position(frame.IP())
+	if !ok {
+		return 0
+	}
+	return pos.Line
+}
+
+// Executes instructions of every thread through the scheduler until done returns true
+// after an instruction of the current thread, or the program stops
+func (d *Debugger) run(done func() bool) StopReason {
+	d.started = true
+	d.hit = nil
+	if thread := d.vm.Thread(); thread.State() == vm.StateSuspended {
+		if err := thread.Resume(nil); err != nil {
+			return d.stop(nil, StopExit)
+		}
+	}
+	if !d.Running() {
+		return d.stop(nil, StopExit)
+	}
+	current := d.Thread()
+	for {
+		thread := d.vm.Step()
+		if thread == nil {
+			return d.stop(nil, StopExit)
+		}
+		if reason, stop := d.stopReason(thread); stop {
+			return d.stop(thread, reason)
+		}
+		if thread == current && done() {
+			return StopStep
+		}
+	}
+}
+
+// Breakpoints switch to the thread that hit them, exits and pauses back to the main thread
+func (d *Debugger) stop(thread *vm.Executor, reason StopReason) StopReason {
+	if reason != StopBreakpoint {
+		thread = nil
+	}
+	d.current = thread
+	return reason
+}
+
+func (d *Debugger) Continue() StopReason {
+	if !d.started {
+		// Breakpoints on the entry instruction must hit before anything executes
+		d.started = true
+		if reason, stop := d.stopReason(d.Thread()); stop {
+			return d.stop(d.Thread(), reason)
+		}
+	}
+	return d.run(func() bool { return false })
+}
+
+// Steps a single source line, or a single instruction when there is no debug info
+func (d *Debugger) StepInto() StopReason {
+	depth, line := d.depth(), d.line()
+	return d.run(func() bool {
+		return line == 0 || d.depth() != depth || d.line() != line
+	})
+}
+
+func (d *Debugger) StepOver() StopReason {
+	depth, line := d.depth(), d.line()
+	return d.run(func() bool {
+		if d.depth() > depth {
+			return false
+		}
+		return line == 0 || d.depth() < depth || d.line() != line
+	})
+}
+
+func (d *Debugger) StepOut() StopReason {
+	depth := d.depth()
+	return d.run(func() bool {
+		return d.depth() < depth
+	})
+}
+
+func (d *Debugger) StepInstruction() StopReason {
+	return d.run(func() bool { return true })
+}
+
+// Frames of the current thread, innermost first
+func (d *Debugger) Frames() []*vm.Frame {
+	frames := d.Thread().Frames()
+	out := make([]*vm.Frame, 0, frames.Len())
+	for i := frames.Len() - 1; i >= 0; i-- {
+		frame, _ := frames.Get(i)
+		out = append(out, frame)
+	}
+	return out
+}
+
+func (d *Debugger) Frame(depth int) (*vm.Frame, error) {
+	frames := d.Frames()
+	if depth < 0 || depth >= len(frames) {
+		return nil, fmt.Errorf("%w: %d", ErrNoFrame, depth)
+	}
+	return frames[depth], nil
+}
+
+// Source position of a frame, the innermost frame reports the next instruction
+func (d *Debugger) Position(depth int) (common.Position, bool) {
+	frame, err := d.Frame(depth)
+	if err != nil {
+		return common.Position{}, false
+	}
+	if depth == 0 {
+		return frame.Position(frame.IP())
+	}
+	return frame.Position(frame.PC())
+}
+
+// Value stack, top first
+func (d *Debugger) Stack() []*common.Const {
+	stack := d.Thread().Stack()
+	out := make([]*common.Const, 0, stack.Len())
+	for i := stack.Len() - 1; i >= 0; i-- {
+		constant, _ := stack.Get(i)
+		out = append(out, constant)
+	}
+	return out
+}
+
+func (d *Debugger) Locals(depth int) ([]Variable, error) {
+	frame, err := d.Frame(depth)
+	if err != nil {
+		return nil, err
+	}
+	info := frame.Debug()
+	stack := d.Thread().Stack()
+	locals := make([]Variable, frame.Fn().Locals())
+	for i := range locals {
+		value, err := stack.Get(frame.BP() + i)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read local %d: %w", i, err)
+		}
+		name := fmt.Sprintf("local%d", i)
+		if info != nil {
+			name = info.Local(i)
+		}
+		locals[i] = Variable{Name: name, Value: value}
+	}
+	return locals, nil
+}
+
+func (d *Debugger) Heap() []vm.HeapBlock {
+	return d.vm.Heap().Blocks()
+}
+
+func (d *Debugger) Module() (*common.Module, error) {
+	frame, err := d.Frame(0)
+	if err != nil {
+		return nil, ErrNotRunning
+	}
+	return frame.Module(), nil
+}
+
+func New(machine *vm.VM) *Debugger {
+	return &Debugger{vm: machine}
+}
@@ -0,0 +1,230 @@
+package debug_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/canpacis/flint/ast"
+	"github.com/canpacis/flint/common"
+	"github.com/canpacis/flint/compiler"
+	"github.com/canpacis/flint/debug"
+	"github.com/canpacis/flint/vm"
+	"github.com/stretchr/testify/assert"
+)
+
+func Program() *ast.Program {
+	program := ast.NewProgram(
+		ast.Mod("main"),
+		nil,
+		nil,
+		[]*ast.ConstStmt{
+			ast.FnConst("add", 0, "fn", ast.FnParams([]string{"a", "b"},
+				ast.NewOp("load.local", 0).At(2),
+				ast.NewOp("load.local", 1).At(2),
+				ast.NewOp("add.i64").At(3),
+				ast.NewOp("return.value").At(4),
+			)).At(1),
+			ast.FnConst("main", compiler.POOL_WRITE_LIMIT, "fn", ast.Fn(
+				ast.NewOp("load.i64", 5).At(7),
+				ast.NewOp("load.i64", 7).At(7),
+				ast.NewOp("load.const", 0).At(8),
+				ast.NewOp("call", 2).At(8),
+				ast.NewOp("alloc", 16).At(9),
+				ast.NewOp("halt").At(10),
+			)).At(6),
+		},
+	)
+	program.File = "main.flir"
+	return program
+}
+
+func SetupDebugger(t *testing.T, program *ast.Program) *debug.Debugger {
+	assert := assert.New(t)
+
+	machine := vm.NewVM()
+	builtins := vm.DefaultBuiltins(machine)
+
+	c := compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+	c.SetDebug(true)
+	c.Init(program, compiler.MapResolver{}, builtins.Map())
+	assert.NoError(c.Compile())
+
+	buf := new(bytes.Buffer)
+	_, err := c.WriteTo(buf)
+	assert.NoError(err)
+
+	archive := common.NewArchive()
+	_, err = archive.ReadFrom(buf)
+	assert.NoError(err)
+	assert.NoError(machine.Init(archive, builtins))
+
+	return debug.New(machine)
+}
+
+func TestBreakLine(t *testing.T) {
+	assert := assert.New(t)
+
+	d := SetupDebugger(t, Program())
+	bp := d.BreakLine("main.flir", 3)
+
+	assert.Equal(debug.StopBreakpoint, d.Continue())
+	assert.Equal(bp, d.Hit())
+
+	frame, err := d.Frame(0)
+	assert.NoError(err)
+	assert.Equal("main.add", frame.String())
+	pos, ok := d.Position(0)
+	assert.True(ok)
+	assert.Equal(common.Position{File: "main.flir", Line: 3}, pos)
+	pos, ok = d.Position(1)
+	assert.True(ok)
+	assert.Equal(common.Position{File: "main.flir", Line: 8}, pos)
+
+	locals, err := d.Locals(0)
+	assert.NoError(err)
+	assert.Equal([]debug.Variable{
+		{Name: "a", Value: common.NewConst(common.I64Const, int64(5))},
+		{Name: "b", Value: common.NewConst(common.I64Const, int64(7))},
+	}, locals)
+
+	stack := d.Stack()
+	assert.Len(stack, 4)
+	assert.Equal(int64(7), stack[0].Value)
+
+	mod, err := d.Module()
+	assert.NoError(err)
+	assert.Equal("main", mod.Name)
+
+	assert.Equal(debug.StopStep, d.StepOut())
+	pos, ok = d.Position(0)
+	assert.True(ok)
+	assert.Equal(9, pos.Line)
+	assert.Equal(int64(12), d.Stack()[0].Value)
+
+	assert.Equal(debug.StopStep, d.StepOver())
+	pos, ok = d.Position(0)
+	assert.True(ok)
+	assert.Equal(10, pos.Line)
+	heap := d.Heap()
+	assert.Len(heap, 2)
+	assert.Equal(16, heap[0].Size())
+	assert.False(heap[0].Free())
+
+	assert.Equal(debug.StopExit, d.Continue())
+	assert.True(d.VM().Halted())
+	assert.Equal(debug.StopExit, d.StepInto())
+}
+
+func TestBreakOffset(t *testing.T) {
+	assert := assert.New(t)
+
+	type StepTest struct {
+		Step          func(*debug.Debugger) debug.StopReason
+		ExpectedStop  debug.StopReason
+		ExpectedFrame string
+		ExpectedLine  int
+	}
+
+	d := SetupDebugger(t, Program())
+	// load.i64 (9) + load.i64 (9) + load.const (5)
+	call := d.Break("main.main", 23)
+	entry := d.Break("main.main", 0)
+
+	tests := []StepTest{
+		{(*debug.Debugger).Continue, debug.StopBreakpoint, "main.main", 7},
+		{(*debug.Debugger).Continue, debug.StopBreakpoint, "main.main", 8},
+		{(*debug.Debugger).StepInto, debug.StopStep, "main.add", 2},
+		{(*debug.Debugger).StepInto, debug.StopStep, "main.add", 3},
+		{(*debug.Debugger).StepInstruction, debug.StopStep, "main.add", 4},
+		{(*debug.Debugger).StepInto, debug.StopStep, "main.main", 9},
+	}
+
+	for i, test := range tests {
+		assert.Equalf(test.ExpectedStop, test.Step(d), "Test case %d", i)
+		frame, err := d.Frame(0)
+		assert.NoErrorf(err, "Test case %d", i)
+		assert.Equalf(test.ExpectedFrame, frame.String(), "Test case %d", i)
+		pos, _ := d.Position(0)
+		assert.Equalf(test.ExpectedLine, pos.Line, "Test case %d", i)
+	}
+
+	assert.NoError(d.Clear(entry.ID))
+	assert.NoError(d.Clear(call.ID))
+	assert.ErrorIs(d.Clear(call.ID), debug.ErrNoBreakpoint)
+	assert.Empty(d.Breakpoints())
+}
+
+func ThreadProgram() *ast.Program {
+	program := Program()
+	program.Consts[1] = ast.FnConst("main", compiler.POOL_WRITE_LIMIT, "fn", ast.Fn(
+		ast.NewOp("load.i64", 5).At(7),
+		ast.NewOp("load.i64", 37).At(7),
+		ast.NewOp("load.const", 0).At(8),
+		ast.NewOp("spawn", 2).At(8),
+		ast.NewOp("join").At(9),
+		ast.NewOp("halt").At(10),
+	)).At(6)
+	return program
+}
+
+func TestThreads(t *testing.T) {
+	assert := assert.New(t)
+
+	// The main thread blocks on join while the spawned thread runs
+	d := SetupDebugger(t, ThreadProgram())
+	assert.Equal(debug.StopExit, d.Continue())
+	assert.True(d.VM().Halted())
+	assert.Equal(int64(42), d.Stack()[0].Value)
+
+	// Breakpoints hit in the thread that reaches them
+	d = SetupDebugger(t, ThreadProgram())
+	d.BreakLine("main.flir", 3)
+	assert.Equal(debug.StopBreakpoint, d.Continue())
+	assert.Equal(1, d.Thread().ID())
+	frame, err := d.Frame(0)
+	assert.NoError(err)
+	assert.Equal("main.add", frame.String())
+
+	assert.Equal(debug.StopStep, d.StepOver())
+	assert.Equal(1, d.Thread().ID())
+	pos, ok := d.Position(0)
+	assert.True(ok)
+	assert.Equal(4, pos.Line)
+
+	assert.Equal(debug.StopExit, d.Continue())
+	assert.Equal(0, d.Thread().ID())
+	assert.Equal(int64(42), d.Stack()[0].Value)
+}
+
+func TestTerminal(t *testing.T) {
+	assert := assert.New(t)
+
+	d := SetupDebugger(t, Program())
+	script := strings.Join([]string{
+		"break 3",
+		"continue",
+		"locals",
+		"bt",
+		"out",
+		"stack",
+		"next",
+		"heap",
+		"unknown",
+		"continue",
+		"quit",
+	}, "\n")
+
+	out := new(bytes.Buffer)
+	assert.NoError(debug.NewTerminal(d, strings.NewReader(script), out).Run())
+
+	output := out.String()
+	assert.Contains(output, "breakpoint #1 :3")
+	assert.Contains(output, "main.add at main.flir:3")
+	assert.Contains(output, "a = <i64 5>")
+	assert.Contains(output, "#1 main.main at main.flir:8")
+	assert.Contains(output, "0: <i64 12>")
+	assert.Contains(output, "handle 1 offset 0 size 16 used")
+	assert.Contains(output, "error: unknown command unknown")
+	assert.Contains(output, "program exited")
+}
@@ -0,0 +1,194 @@
+package debug
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const terminalHelp = `commands:
+  break <fn> <offset>   break at a function offset
+  break <line>          break at a source line
+  delete <id>           delete a breakpoint
+  breakpoints           list breakpoints
+  continue, c           run until a breakpoint or exit
+  step, s               step into
+  next, n               step over
+  out, o                step out
+  stepi, si             step a single instruction
+  frames, bt            print the call stack
+  locals [depth]        print the locals of a frame
+  stack                 print the value stack
+  heap                  print heap blocks
+  module                print the current module
+  quit, q               exit the debugger`
+
+type Terminal struct {
+	debugger *Debugger
+	in       *bufio.Scanner
+	out      io.Writer
+}
+
+func (t *Terminal) printf(format string, args ...any) {
+	fmt.Fprintf(t.out, format, args...)
+}
+
+func (t *Terminal) where() {
+	if !t.debugger.Running() {
+		return
+	}
+	frame, err := t.debugger.Frame(0)
+	if err != nil {
+		return
+	}
+	if pos, ok := t.debugger.Position(0); ok {
+		t.printf("%s at %s\n", frame, pos)
+	} else {
+		t.printf("%s at +%d\n", frame, frame.IP())
+	}
+}
+
+func (t *Terminal) stopped(reason StopReason) {
+	switch reason {
+	case StopBreakpoint:
+		t.printf("breakpoint %s\n", t.debugger.Hit())
+	case StopPause:
+		t.printf("program yielded\n")
+	case StopExit:
+		machine := t.debugger.VM()
+		if machine.Paniced() {
+			t.printf("program panicked: %s\n", machine.PanicMessage())
+		} else {
+			t.printf("program exited\n")
+		}
+		return
+	}
+	t.where()
+}
+
+func (t *Terminal) Execute(line string) (bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return true, nil
+	}
+	d := t.debugger
+
+	switch fields[0] {
+	case "help", "h":
+		t.printf("%s\n", terminalHelp)
+	case "break", "b":
+		switch len(fields) {
+		case 2:
+			line, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return true, fmt.Errorf("invalid line %s", fields[1])
+			}
+			t.printf("breakpoint %s\n", d.BreakLine("", line))
+		case 3:
+			offset, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return true, fmt.Errorf("invalid offset %s", fields[2])
+			}
+			t.printf("breakpoint %s\n", d.Break(fields[1], offset))
+		default:
+			return true, fmt.Errorf("usage: break <fn> <offset> | break <line>")
+		}
+	case "delete", "d":
+		if len(fields) != 2 {
+			return true, fmt.Errorf("usage: delete <id>")
+		}
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return true, fmt.Errorf("invalid breakpoint id %s", fields[1])
+		}
+		return true, d.Clear(id)
+	case "breakpoints":
+		for _, bp := range d.Breakpoints() {
+			t.printf("%s\n", bp)
+		}
+	case "continue", "c":
+		t.stopped(d.Continue())
+	case "step", "s":
+		t.stopped(d.StepInto())
+	case "next", "n":
+		t.stopped(d.StepOver())
+	case "out", "o":
+		t.stopped(d.StepOut())
+	case "stepi", "si":
+		t.stopped(d.StepInstruction())
+	case "frames", "bt":
+		for i, frame := range d.Frames() {
+			if pos, ok := d.Position(i); ok {
+				t.printf("#%d %s at %s\n", i, frame, pos)
+			} else {
+				t.printf("#%d %s at +%d\n", i, frame, frame.PC())
+			}
+		}
+	case "locals":
+		depth := 0
+		if len(fields) > 1 {
+			n, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return true, fmt.Errorf("invalid frame depth %s", fields[1])
+			}
+			depth = n
+		}
+		locals, err := d.Locals(depth)
+		if err != nil {
+			return true, err
+		}
+		for _, local := range locals {
+			t.printf("%s = %s\n", local.Name, local.Value)
+		}
+	case "stack":
+		for i, constant := range d.Stack() {
+			t.printf("%d: %s\n", i, constant)
+		}
+	case "heap":
+		for _, block := range d.Heap() {
+			state := "used"
+			if block.Free() {
+				state = "free"
+			}
+			t.printf("handle %d offset %d size %d %s\n", block.Handle(), block.Offset(), block.Size(), state)
+		}
+	case "module":
+		mod, err := d.Module()
+		if err != nil {
+			return true, err
+		}
+		t.printf("%s %s\n", mod.Name, mod.Version)
+	case "quit", "q":
+		return false, nil
+	default:
+		return true, fmt.Errorf("unknown command %s, type help for a list of commands", fields[0])
+	}
+	return true, nil
+}
+
+func (t *Terminal) Run() error {
+	t.where()
+	for {
+		t.printf("(flint) ")
+		if !t.in.Scan() {
+			return t.in.Err()
+		}
+		more, err := t.Execute(t.in.Text())
+		if err != nil {
+			t.printf("error: %s\n", err)
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+func NewTerminal(debugger *Debugger, in io.Reader, out io.Writer) *Terminal {
+	return &Terminal{
+		debugger: debugger,
+		in:       bufio.NewScanner(in),
+		out:      out,
+	}
+}
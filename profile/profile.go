@@ -0,0 +1,259 @@
+package profile
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/canpacis/flint/common"
+	"github.com/canpacis/flint/vm"
+)
+
+const DefaultRate = 16
+
+type Location struct {
+	Fn     string
+	Module string
+	File   string
+	Line   int
+}
+
+func (l Location) String() string {
+	if l.Line > 0 {
+		return fmt.Sprintf("%s %s:%d", l.Fn, l.File, l.Line)
+	}
+	return fmt.Sprintf("%s %s", l.Fn, l.Module)
+}
+
+type Sample struct {
+	// Innermost frame first
+	Stack        []Location
+	Instructions int64
+	Nanoseconds  int64
+}
+
+type Profiler struct {
+	vm.NopHook
+	machine *vm.VM
+	rate    int
+	root    *node
+	samples []*Sample
+	count   int
+	last    time.Time
+	start   time.Time
+	stop    time.Time
+}
+
+// Sets how many instructions run between wall time samples
+func (p *Profiler) SetRate(rate int) {
+	p.rate = max(rate, 1)
+}
+
+// Identifies a frame without formatting it, so samples can be found on every instruction
+type frameKey struct {
+	module  string
+	fn      string
+	pointer int
+	pc      int
+}
+
+type node struct {
+	children map[frameKey]*node
+	sample   *Sample
+}
+
+func location(frame *vm.Frame) Location {
+	location := Location{Fn: frame.String()}
+	if mod := frame.Module(); mod != nil {
+		location.Module = mod.Name
+		location.File = mod.Name
+	}
+	if pos, ok := frame.Position(frame.PC()); ok {
+		location.File = pos.File
+		location.Line = pos.Line
+	}
+	return location
+}
+
+func (p *Profiler) sample(e *vm.Executor) *Sample {
+	frames := e.Frames()
+	current := p.root
+	for i := 0; i < frames.Len(); i++ {
+		frame, _ := frames.Get(i)
+		key := frameKey{fn: frame.String(), pointer: frame.Pointer(), pc: frame.PC()}
+		if mod := frame.Module(); mod != nil {
+			key.module = mod.Name
+		}
+		child, ok := current.children[key]
+		if !ok {
+			child = &node{children: make(map[frameKey]*node)}
+			current.children[key] = child
+		}
+		current = child
+	}
+
+	if current.sample == nil {
+		stack := make([]Location, 0, frames.Len())
+		for i := frames.Len() - 1; i >= 0; i-- {
+			frame, _ := frames.Get(i)
+			stack = append(stack, location(frame))
+		}
+		current.sample = &Sample{Stack: stack}
+		p.samples = append(p.samples, current.sample)
+	}
+	return current.sample
+}
+
+func (p *Profiler) BeforeInstruction(e *vm.Executor, frame *vm.Frame, code common.OpCode, operands []int) {
+	sample := p.sample(e)
+	sample.Instructions++
+
+	p.count++
+	if p.count%p.rate == 0 {
+		now := time.Now()
+		sample.Nanoseconds += now.Sub(p.last).Nanoseconds()
+		p.last = now
+	}
+}
+
+func (p *Profiler) Start(machine *vm.VM) {
+	p.machine = machine
+	p.start = time.Now()
+	p.last = p.start
+	machine.AddHook(p)
+}
+
+func (p *Profiler) Stop() {
+	p.stop = time.Now()
+	if p.machine != nil {
+		p.machine.RemoveHook(p)
+		p.machine = nil
+	}
+}
+
+func (p *Profiler) Samples() []Sample {
+	samples := make([]Sample, 0, len(p.samples))
+	for _, sample := range p.samples {
+		samples = append(samples, *sample)
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].Instructions > samples[j].Instructions
+	})
+	return samples
+}
+
+type stringTable struct {
+	table   []string
+	indices map[string]int64
+}
+
+func (s *stringTable) index(str string) int64 {
+	idx, ok := s.indices[str]
+	if !ok {
+		idx = int64(len(s.table))
+		s.table = append(s.table, str)
+		s.indices[str] = idx
+	}
+	return idx
+}
+
+// Encodes the profile as a gzipped pprof protobuf
+func (p *Profiler) WriteTo(w io.Writer) (int64, error) {
+	strs := &stringTable{table: []string{""}, indices: map[string]int64{"": 0}}
+	functions := map[string]uint64{}
+	locations := map[Location]uint64{}
+
+	profile := &encoder{}
+	funcs := &encoder{}
+	locs := &encoder{}
+
+	valueType := func(typ, unit string) func(*encoder) {
+		return func(e *encoder) {
+			e.int64(1, strs.index(typ))
+			e.int64(2, strs.index(unit))
+		}
+	}
+	profile.message(1, valueType("instructions", "count"))
+	profile.message(1, valueType("wall", "nanoseconds"))
+
+	for _, sample := range p.Samples() {
+		ids := make([]uint64, len(sample.Stack))
+		for i, location := range sample.Stack {
+			id, ok := locations[location]
+			if !ok {
+				fnkey := location.Fn + "\x00" + location.File
+				fnid, ok := functions[fnkey]
+				if !ok {
+					fnid = uint64(len(functions) + 1)
+					functions[fnkey] = fnid
+					funcs.message(5, func(e *encoder) {
+						e.uint64(1, fnid)
+						e.int64(2, strs.index(location.Fn))
+						e.int64(3, strs.index(location.Fn))
+						e.int64(4, strs.index(location.File))
+					})
+				}
+
+				id = uint64(len(locations) + 1)
+				locations[location] = id
+				locs.message(4, func(e *encoder) {
+					e.uint64(1, id)
+					e.message(4, func(e *encoder) {
+						e.uint64(1, fnid)
+						e.int64(2, int64(location.Line))
+					})
+				})
+			}
+			ids[i] = id
+		}
+		profile.message(2, func(e *encoder) {
+			e.packedUint64(1, ids)
+			e.packedInt64(2, []int64{sample.Instructions, sample.Nanoseconds})
+		})
+	}
+
+	profile.buf = append(profile.buf, locs.buf...)
+	profile.buf = append(profile.buf, funcs.buf...)
+
+	stop := p.stop
+	if stop.IsZero() {
+		stop = time.Now()
+	}
+	profile.int64(9, p.start.UnixNano())
+	profile.int64(10, stop.Sub(p.start).Nanoseconds())
+	profile.message(11, valueType("instructions", "count"))
+	profile.int64(12, 1)
+
+	// The string table goes last so every index above is already assigned
+	for _, str := range strs.table {
+		profile.string(6, str)
+	}
+
+	cw := &countWriter{w: w}
+	zw := gzip.NewWriter(cw)
+	if _, err := zw.Write(profile.buf); err != nil {
+		return cw.n, err
+	}
+	err := zw.Close()
+	return cw.n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+func New() *Profiler {
+	return &Profiler{
+		rate: DefaultRate,
+		root: &node{children: make(map[frameKey]*node)},
+	}
+}
@@ -0,0 +1,151 @@
+package profile_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/canpacis/flint/ast"
+	"github.com/canpacis/flint/common"
+	"github.com/canpacis/flint/compiler"
+	"github.com/canpacis/flint/profile"
+	"github.com/canpacis/flint/vm"
+	"github.com/stretchr/testify/assert"
+)
+
+func SetupMachine(t *testing.T) *vm.VM {
+	assert := assert.New(t)
+
+	program := ast.NewProgram(
+		ast.Mod("main"),
+		nil,
+		nil,
+		[]*ast.ConstStmt{
+			ast.FnConst("add", 0, "fn", ast.FnParams([]string{"a", "b"},
+				ast.NewOp("load.local", 0).At(2),
+				ast.NewOp("load.local", 1).At(2),
+				ast.NewOp("add.i64").At(3),
+				ast.NewOp("return.value").At(4),
+			)).At(1),
+			ast.FnConst("main", compiler.POOL_WRITE_LIMIT, "fn", ast.Fn(
+				ast.NewOp("load.i64", 5).At(7),
+				ast.NewOp("load.i64", 7).At(7),
+				ast.NewOp("load.const", 0).At(8),
+				ast.NewOp("call", 2).At(8),
+				ast.NewOp("load.i64", 1).At(9),
+				ast.NewOp("load.const", 0).At(9),
+				ast.NewOp("call", 2).At(9),
+				ast.NewOp("halt").At(10),
+			)).At(6),
+		},
+	)
+	program.File = "main.flir"
+
+	machine := vm.NewVM()
+	builtins := vm.DefaultBuiltins(machine)
+	c := compiler.NewIRCompiler(common.NewVersion(0, 0, 1))
+	c.SetDebug(true)
+	c.Init(program, compiler.MapResolver{}, builtins.Map())
+	assert.NoError(c.Compile())
+
+	buf := new(bytes.Buffer)
+	_, err := c.WriteTo(buf)
+	assert.NoError(err)
+	archive := common.NewArchive()
+	_, err = archive.ReadFrom(buf)
+	assert.NoError(err)
+	assert.NoError(machine.Init(archive, builtins))
+	return machine
+}
+
+// Collects the length delimited fields with the given number from a protobuf message
+func fields(t *testing.T, data []byte, number int) [][]byte {
+	var out [][]byte
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		assert.Greater(t, n, 0)
+		data = data[n:]
+		switch key & 7 {
+		case 0:
+			_, n := binary.Uvarint(data)
+			data = data[n:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			data = data[n:]
+			if int(key>>3) == number {
+				out = append(out, data[:length])
+			}
+			data = data[length:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return out
+}
+
+func TestProfile(t *testing.T) {
+	assert := assert.New(t)
+
+	machine := SetupMachine(t)
+	profiler := profile.New()
+	profiler.SetRate(1)
+	profiler.Start(machine)
+	machine.Run()
+	profiler.Stop()
+
+	assert.True(machine.Halted())
+
+	samples := profiler.Samples()
+	total := int64(0)
+	for _, sample := range samples {
+		total += sample.Instructions
+	}
+	// main (8), add (4) twice
+	assert.Equal(int64(16), total)
+
+	add := profile.Location{Fn: "main.add", Module: "main", File: "main.flir", Line: 2}
+	found := false
+	for _, sample := range samples {
+		if sample.Stack[0] == add {
+			found = true
+			assert.Len(sample.Stack, 2)
+			assert.Equal("main.main", sample.Stack[1].Fn)
+		}
+	}
+	assert.True(found, "add samples")
+
+	buf := new(bytes.Buffer)
+	n, err := profiler.WriteTo(buf)
+	assert.NoError(err)
+	assert.Equal(int64(buf.Len()), n)
+
+	reader, err := gzip.NewReader(buf)
+	assert.NoError(err)
+	data, err := io.ReadAll(reader)
+	assert.NoError(err)
+
+	strs := []string{}
+	for _, str := range fields(t, data, 6) {
+		strs = append(strs, string(str))
+	}
+	assert.Equal("", strs[0])
+	assert.Contains(strs, "main.add")
+	assert.Contains(strs, "main.main")
+	// Fn names are already qualified by their module
+	assert.NotContains(strs, "main.main.main")
+	assert.Contains(strs, "main.flir")
+	assert.Contains(strs, "instructions")
+	assert.Len(fields(t, data, 1), 2)
+	assert.Len(fields(t, data, 2), len(samples))
+	assert.NotEmpty(fields(t, data, 4))
+	assert.Len(fields(t, data, 5), 2)
+
+	// Once stopped the machine no longer reports to the profiler
+	machine = SetupMachine(t)
+	profiler.Start(machine)
+	profiler.Stop()
+	machine.Run()
+	assert.Len(profiler.Samples(), len(samples))
+}
@@ -0,0 +1,60 @@
+package profile
+
+import "encoding/binary"
+
+// Minimal protobuf wire encoder for the pprof profile.proto messages
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) varint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *encoder) tag(field int, wire int) {
+	e.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (e *encoder) uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, 0)
+	e.varint(v)
+}
+
+func (e *encoder) int64(field int, v int64) {
+	e.uint64(field, uint64(v))
+}
+
+func (e *encoder) bytes(field int, b []byte) {
+	e.tag(field, 2)
+	e.varint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) string(field int, s string) {
+	e.bytes(field, []byte(s))
+}
+
+func (e *encoder) message(field int, fn func(*encoder)) {
+	inner := &encoder{}
+	fn(inner)
+	e.bytes(field, inner.buf)
+}
+
+func (e *encoder) packedUint64(field int, values []uint64) {
+	inner := &encoder{}
+	for _, v := range values {
+		inner.varint(v)
+	}
+	e.bytes(field, inner.buf)
+}
+
+func (e *encoder) packedInt64(field int, values []int64) {
+	inner := &encoder{}
+	for _, v := range values {
+		inner.varint(uint64(v))
+	}
+	e.bytes(field, inner.buf)
+}
@@ -0,0 +1,86 @@
+package project
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+var ErrLockMismatch = errors.New("dependency does not match the lockfile")
+
+// Name of the lockfile written next to the manifest
+const LOCKFILE = "flint.lock"
+
+// A dependency as it was resolved when the lockfile was written
+type LockedModule struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// File the module was read from, relative to the project
+	File string `json:"file"`
+	// Hash of the file contents, "sha256:" followed by the hex digest
+	Hash string `json:"hash"`
+}
+
+// Pins every dependency of a project to the exact file it was built with
+type Lockfile struct {
+	Modules []LockedModule `json:"modules"`
+}
+
+// Returns the locked module called name
+func (l *Lockfile) Lookup(name string) (LockedModule, bool) {
+	for _, mod := range l.Modules {
+		if mod.Name == name {
+			return mod, true
+		}
+	}
+	return LockedModule{}, false
+}
+
+// Reports whether a file read for the dependency name is the one that was locked
+func (l *Lockfile) Verify(name, file string, src []byte) error {
+	locked, ok := l.Lookup(name)
+	if !ok {
+		return fmt.Errorf("%w: %s is not locked", ErrLockMismatch, name)
+	}
+	if locked.File != file {
+		return fmt.Errorf("%w: %s is locked to %s, found %s", ErrLockMismatch, name, locked.File, file)
+	}
+	if hash := Hash(src); locked.Hash != hash {
+		return fmt.Errorf("%w: %s has changed, locked %s, found %s", ErrLockMismatch, file, locked.Hash, hash)
+	}
+	return nil
+}
+
+func (l *Lockfile) WriteTo(w io.Writer) (int64, error) {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(data, '\n'))
+	return int64(n), err
+}
+
+// Content hash of a module file as stored in lockfiles
+func Hash(src []byte) string {
+	sum := sha256.Sum256(src)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func ParseLockfile(data []byte) (*Lockfile, error) {
+	lock := &Lockfile{}
+	if err := json.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("invalid lockfile: %w", err)
+	}
+	return lock, nil
+}
+
+func sortModules(modules []LockedModule) {
+	slices.SortFunc(modules, func(a, b LockedModule) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+}
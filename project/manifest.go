@@ -0,0 +1,97 @@
+package project
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/canpacis/flint/common"
+)
+
+var ErrInvalidManifest = errors.New("invalid manifest")
+
+// Name of the manifest file at the root of a project
+const MANIFEST = "flint.json"
+
+// Module the project links, found in a directory of the project
+type Dependency struct {
+	// Version constraint the module has to satisfy, any version when empty
+	Version string `json:"version,omitempty"`
+	// Directory holding the source or module file of the dependency
+	Path string `json:"path"`
+}
+
+// Describes a project, its entry module and the modules it depends on
+type Manifest struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// Module the project is built from, the program's main function lives in it
+	Entry        string                `json:"entry"`
+	Dependencies map[string]Dependency `json:"dependencies,omitempty"`
+}
+
+// Parsed version of the project
+func (m *Manifest) ProjectVersion() (common.Version, error) {
+	return common.ParseVersion(m.Version)
+}
+
+// Parsed version constraint of the dependency called name
+func (m *Manifest) Constraint(name string) (common.Constraint, error) {
+	dep, ok := m.Dependencies[name]
+	if !ok {
+		return common.Constraint{}, fmt.Errorf("%s is not a dependency of %s", name, m.Name)
+	}
+	return common.ParseConstraint(dep.Version)
+}
+
+// Reports the first field of the manifest that is missing or malformed
+func (m *Manifest) Validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("%w: missing name", ErrInvalidManifest)
+	}
+	if _, err := m.ProjectVersion(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidManifest, err)
+	}
+	if m.Entry == "" || !fs.ValidPath(m.Entry) {
+		return fmt.Errorf("%w: invalid entry module %q", ErrInvalidManifest, m.Entry)
+	}
+	for name, dep := range m.Dependencies {
+		if name == "" || !fs.ValidPath(name) {
+			return fmt.Errorf("%w: invalid dependency name %q", ErrInvalidManifest, name)
+		}
+		if name == m.Entry {
+			return fmt.Errorf("%w: entry module %s cannot be a dependency", ErrInvalidManifest, name)
+		}
+		if _, err := common.ParseConstraint(dep.Version); err != nil {
+			return fmt.Errorf("%w: dependency %s: %w", ErrInvalidManifest, name, err)
+		}
+		if dep.Path == "" || !fs.ValidPath(path.Clean(dep.Path)) {
+			return fmt.Errorf("%w: dependency %s: invalid path %q", ErrInvalidManifest, name, dep.Path)
+		}
+	}
+	return nil
+}
+
+func (m *Manifest) WriteTo(w io.Writer) (int64, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(data, '\n'))
+	return int64(n), err
+}
+
+// Decodes and validates a manifest
+func ParseManifest(data []byte) (*Manifest, error) {
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidManifest, err)
+	}
+	if err := manifest.Validate(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
@@ -0,0 +1,156 @@
+package project
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+
+	"github.com/canpacis/flint/ast"
+	"github.com/canpacis/flint/common"
+	"github.com/canpacis/flint/compiler"
+)
+
+// A project on a filesystem, its modules are resolved from the project root and
+// its dependencies from their own directories. Every linked module outside the
+// project root has to be a dependency of the manifest
+type Project struct {
+	Manifest *Manifest
+	// Lockfile the dependencies are verified against, nil to resolve them afresh
+	Lock     *Lockfile
+	version  common.Version
+	sources  *compiler.FSResolver
+	deps     map[string]*compiler.FSResolver
+	resolved map[string]LockedModule
+}
+
+func (p *Project) resolver(name string) *compiler.FSResolver {
+	if resolver, ok := p.deps[name]; ok {
+		return resolver
+	}
+	return p.sources
+}
+
+// Records every dependency file read, and rejects it if it differs from the locked one
+func (p *Project) read(name, file string, src []byte) error {
+	if p.Lock != nil {
+		if err := p.Lock.Verify(name, file, src); err != nil {
+			return err
+		}
+	}
+	p.resolved[name] = LockedModule{Name: name, File: file, Hash: Hash(src)}
+	return nil
+}
+
+// Checks a resolved dependency against the constraint of the manifest
+func (p *Project) check(name string, version common.Version) error {
+	locked, ok := p.resolved[name]
+	if !ok {
+		return nil
+	}
+	constraint, err := p.Manifest.Constraint(name)
+	if err != nil {
+		return err
+	}
+	if !constraint.Match(version) {
+		return fmt.Errorf("%w: module %s is %s, %s requires %s", common.ErrVersionMismatch, name, version, p.Manifest.Name, constraint)
+	}
+	locked.Version = version.String()
+	p.resolved[name] = locked
+	return nil
+}
+
+func (p *Project) Resolve(name string) (*ast.Program, error) {
+	program, err := p.resolver(name).Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	version := p.version
+	if v := program.Module.Version; v != nil {
+		version, err = common.ParseVersion(v.String)
+		if err != nil {
+			return nil, fmt.Errorf("module %s: %w", name, err)
+		}
+	}
+	return program, p.check(name, version)
+}
+
+func (p *Project) ResolveModule(name string) (*common.Module, error) {
+	mod, err := p.resolver(name).ResolveModule(name)
+	if err != nil {
+		return nil, err
+	}
+	return mod, p.check(name, mod.Version)
+}
+
+// Compiles the entry module along with every module it links
+func (p *Project) Build(builtins map[int]int) (*compiler.IRCompiler, error) {
+	program, err := p.sources.Resolve(p.Manifest.Entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve entry module: %w", err)
+	}
+	c := compiler.NewIRCompiler(p.version)
+	c.Init(program, p, builtins)
+	if err := c.Compile(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Returns a lockfile of the dependencies resolved so far
+func (p *Project) Lockfile() *Lockfile {
+	lock := &Lockfile{Modules: []LockedModule{}}
+	for _, mod := range p.resolved {
+		lock.Modules = append(lock.Modules, mod)
+	}
+	sortModules(lock.Modules)
+	return lock
+}
+
+func New(fsys fs.FS, parse compiler.ParseFunc, manifest *Manifest) (*Project, error) {
+	if err := manifest.Validate(); err != nil {
+		return nil, err
+	}
+	version, _ := manifest.ProjectVersion()
+	p := &Project{
+		Manifest: manifest,
+		version:  version,
+		sources:  compiler.NewFSResolver(fsys, parse, "."),
+		deps:     make(map[string]*compiler.FSResolver),
+		resolved: make(map[string]LockedModule),
+	}
+	for name, dep := range manifest.Dependencies {
+		resolver := compiler.NewFSResolver(fsys, parse, path.Clean(dep.Path))
+		resolver.OnRead(p.read)
+		p.deps[name] = resolver
+	}
+	return p, nil
+}
+
+// Opens the project at the root of fsys, the lockfile is loaded if there is one
+func Open(fsys fs.FS, parse compiler.ParseFunc) (*Project, error) {
+	data, err := fs.ReadFile(fsys, MANIFEST)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := ParseManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	p, err := New(fsys, parse, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = fs.ReadFile(fsys, LOCKFILE)
+	if errors.Is(err, fs.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.Lock, err = ParseLockfile(data); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
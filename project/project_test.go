@@ -0,0 +1,163 @@
+package project_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/canpacis/flint/ast"
+	"github.com/canpacis/flint/common"
+	"github.com/canpacis/flint/project"
+	"github.com/stretchr/testify/assert"
+)
+
+// Sources are a module name, optionally followed by @version, and the modules it links
+func parse(file string, src []byte) (*ast.Program, error) {
+	fields := strings.Fields(string(src))
+	mod := ast.Mod(fields[0])
+	if name, version, ok := strings.Cut(fields[0], "@"); ok {
+		mod = ast.VersionedMod(name, version)
+	}
+	links := []*ast.LinkStmt{}
+	for i, name := range fields[1:] {
+		links = append(links, ast.Link(i, name))
+	}
+	return ast.NewProgram(mod, links, nil, nil), nil
+}
+
+func TestManifest(t *testing.T) {
+	assert := assert.New(t)
+
+	type ManifestTest struct {
+		Source string
+		Err    string
+	}
+
+	tests := []ManifestTest{
+		{`{"name": "app", "version": "1.0.0", "entry": "main"}`, ""},
+		{`{"name": "app", "version": "1.0.0", "entry": "main", "dependencies": {"json": {"version": "^1.2", "path": "vendor/json"}}}`, ""},
+		{`{"name": "app", "version": "1.0.0", "entry": "main", "dependencies": {"json": {"path": "./vendor/json/"}}}`, ""},
+		{`{"version": "1.0.0", "entry": "main"}`, "invalid manifest: missing name"},
+		{`{"name": "app", "version": "one", "entry": "main"}`, `invalid manifest: invalid version "one"`},
+		{`{"name": "app", "version": "1.0.0"}`, `invalid manifest: invalid entry module ""`},
+		{`{"name": "app", "version": "1.0.0", "entry": "main", "dependencies": {"json": {"version": "^x", "path": "vendor"}}}`, "invalid manifest: dependency json: invalid version constraint"},
+		{`{"name": "app", "version": "1.0.0", "entry": "main", "dependencies": {"json": {"path": "../json"}}}`, `invalid manifest: dependency json: invalid path "../json"`},
+		{`{"name": "app", "version": "1.0.0", "entry": "main", "dependencies": {"main": {"path": "vendor"}}}`, "invalid manifest: entry module main cannot be a dependency"},
+		{`{"name": "app"`, "invalid manifest: unexpected end of JSON input"},
+	}
+
+	for i, test := range tests {
+		manifest, err := project.ParseManifest([]byte(test.Source))
+		if test.Err != "" {
+			assert.ErrorContainsf(err, test.Err, "Test case %d", i)
+			assert.ErrorIsf(err, project.ErrInvalidManifest, "Test case %d", i)
+			continue
+		}
+		assert.NoErrorf(err, "Test case %d", i)
+
+		buf := new(bytes.Buffer)
+		_, err = manifest.WriteTo(buf)
+		assert.NoErrorf(err, "Test case %d", i)
+		written, err := project.ParseManifest(buf.Bytes())
+		assert.NoErrorf(err, "Test case %d", i)
+		assert.Equalf(manifest, written, "Test case %d", i)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	assert := assert.New(t)
+
+	fsys := fstest.MapFS{
+		project.MANIFEST: {Data: []byte(`{
+			"name": "app",
+			"version": "0.3.0",
+			"entry": "main",
+			"dependencies": {
+				"json": {"version": "^1.2.0", "path": "vendor/json"},
+				"io": {"version": "~1.0", "path": "vendor/io"}
+			}
+		}`)},
+		"main.flir":             {Data: []byte("main util json")},
+		"util.flir":             {Data: []byte("util io")},
+		"vendor/json/json.flir": {Data: []byte("json@1.4.2 io")},
+		"vendor/io/io.flir":     {Data: []byte("io@1.0.1")},
+	}
+
+	p, err := project.Open(fsys, parse)
+	assert.NoError(err)
+	assert.Nil(p.Lock)
+	c, err := p.Build(map[int]int{})
+	assert.NoError(err)
+	_, err = c.WriteTo(new(bytes.Buffer))
+	assert.NoError(err)
+
+	// Only dependencies are locked, modules of the project are not
+	lock := p.Lockfile()
+	assert.Equal([]project.LockedModule{
+		{Name: "io", Version: "1.0.1", File: "vendor/io/io.flir", Hash: project.Hash([]byte("io@1.0.1"))},
+		{Name: "json", Version: "1.4.2", File: "vendor/json/json.flir", Hash: project.Hash([]byte("json@1.4.2 io"))},
+	}, lock.Modules)
+	assert.True(strings.HasPrefix(lock.Modules[0].Hash, "sha256:"))
+
+	buf := new(bytes.Buffer)
+	_, err = lock.WriteTo(buf)
+	assert.NoError(err)
+	fsys[project.LOCKFILE] = &fstest.MapFile{Data: bytes.Clone(buf.Bytes())}
+
+	type BuildTest struct {
+		File   string
+		Source string
+		Err    error
+		Msg    string
+	}
+
+	tests := []BuildTest{
+		{"", "", nil, ""},
+		{"main.flir", "main json", nil, ""},
+		{"vendor/io/io.flir", "io@1.0.2", project.ErrLockMismatch, "vendor/io/io.flir has changed"},
+		{"vendor/json/json.flir", "json@1.4.2", project.ErrLockMismatch, "vendor/json/json.flir has changed"},
+		{"vendor/json/json.flmod", "", project.ErrLockMismatch, "json is locked to vendor/json/json.flir, found vendor/json/json.flmod"},
+	}
+
+	for i, test := range tests {
+		files := fstest.MapFS{}
+		for name, file := range fsys {
+			files[name] = file
+		}
+		if test.File != "" {
+			files[test.File] = &fstest.MapFile{Data: []byte(test.Source)}
+		}
+
+		p, err := project.Open(files, parse)
+		assert.NoErrorf(err, "Test case %d", i)
+		assert.NotNilf(p.Lock, "Test case %d", i)
+		_, err = p.Build(map[int]int{})
+		if test.Err == nil {
+			assert.NoErrorf(err, "Test case %d", i)
+			continue
+		}
+		assert.ErrorIsf(err, test.Err, "Test case %d", i)
+		assert.ErrorContainsf(err, test.Msg, "Test case %d", i)
+	}
+
+	// A changed dependency builds once the lockfile is dropped
+	fsys["vendor/io/io.flir"] = &fstest.MapFile{Data: []byte("io@1.0.2")}
+	p, err = project.Open(fsys, parse)
+	assert.NoError(err)
+	p.Lock = nil
+	_, err = p.Build(map[int]int{})
+	assert.NoError(err)
+	locked, ok := p.Lockfile().Lookup("io")
+	assert.True(ok)
+	assert.Equal("1.0.2", locked.Version)
+
+	// Dependencies have to satisfy the constraints of the manifest
+	fsys["vendor/io/io.flir"] = &fstest.MapFile{Data: []byte("io@1.1.0")}
+	p, err = project.Open(fsys, parse)
+	assert.NoError(err)
+	p.Lock = nil
+	_, err = p.Build(map[int]int{})
+	assert.ErrorIs(err, common.ErrVersionMismatch)
+	assert.ErrorContains(err, "module io is 1.1.0, app requires ~1.0.0")
+}
@@ -0,0 +1,240 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+var errIsDir = errors.New("is a directory")
+var errNotDir = errors.New("not a directory")
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// In-memory filesystem, directories exist implicitly for the files in them
+type MemFS struct {
+	files map[string]*memFile
+}
+
+// The root and every parent of a file are directories
+func (m *MemFS) isDir(name string) bool {
+	if name == "." {
+		return true
+	}
+	prefix := name + "/"
+	for file := range m.files {
+		if strings.HasPrefix(file, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemFS) stat(op string, name string) (*memInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if file, ok := m.files[name]; ok {
+		return &memInfo{name: path.Base(name), size: int64(len(file.data)), mode: 0644, modTime: file.modTime}, nil
+	}
+	if m.isDir(name) {
+		return &memInfo{name: path.Base(name), mode: fs.ModeDir | 0755}, nil
+	}
+	return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *MemFS) Open(name string) (fs.File, error) {
+	info, err := m.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		entries, err := m.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &memDir{info: info, entries: entries}, nil
+	}
+	return &memReader{Reader: bytes.NewReader(m.files[name].data), info: info}, nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	return m.stat("stat", name)
+}
+
+// Entries of a directory sorted by name
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	info, err := m.stat("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	seen := make(map[string]bool)
+	entries := []fs.DirEntry{}
+	for file := range m.files {
+		rest, ok := strings.CutPrefix(file, prefix)
+		if !ok {
+			continue
+		}
+		child, _, _ := strings.Cut(rest, "/")
+		if seen[child] {
+			continue
+		}
+		seen[child] = true
+		info, err := m.stat("readdir", path.Join(name, child))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+func (m *MemFS) WriteFile(name string, data []byte) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+	}
+	if m.isDir(name) {
+		return &fs.PathError{Op: "write", Path: name, Err: errIsDir}
+	}
+	for parent := path.Dir(name); parent != "."; parent = path.Dir(parent) {
+		if _, ok := m.files[parent]; ok {
+			return &fs.PathError{Op: "write", Path: name, Err: errNotDir}
+		}
+	}
+	m.files[name] = &memFile{data: data, modTime: time.Now()}
+	return nil
+}
+
+func (m *MemFS) OpenWriter(name string, append bool) (io.WriteCloser, error) {
+	file, ok := m.files[name]
+	if !ok || !append {
+		if err := m.WriteFile(name, nil); err != nil {
+			return nil, err
+		}
+		file = m.files[name]
+	}
+	return &memWriter{file: file}, nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i *memInfo) Name() string {
+	return i.name
+}
+
+func (i *memInfo) Size() int64 {
+	return i.size
+}
+
+func (i *memInfo) Mode() fs.FileMode {
+	return i.mode
+}
+
+func (i *memInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i *memInfo) IsDir() bool {
+	return i.mode.IsDir()
+}
+
+func (i *memInfo) Sys() any {
+	return nil
+}
+
+type memReader struct {
+	*bytes.Reader
+	info *memInfo
+}
+
+func (r *memReader) Stat() (fs.FileInfo, error) {
+	return r.info, nil
+}
+
+func (r *memReader) Close() error {
+	return nil
+}
+
+type memDir struct {
+	info    *memInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errIsDir}
+}
+
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(rest))
+	d.offset += n
+	return rest[:n], nil
+}
+
+func (d *memDir) Close() error {
+	return nil
+}
+
+type memWriter struct {
+	file *memFile
+}
+
+func (w *memWriter) Write(b []byte) (int, error) {
+	w.file.data = append(w.file.data, b...)
+	w.file.modTime = time.Now()
+	return len(b), nil
+}
+
+func (w *memWriter) Close() error {
+	return nil
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string]*memFile)}
+}
@@ -0,0 +1,102 @@
+package vfs
+
+import (
+	"io"
+	"io/fs"
+	"strings"
+)
+
+type Perm int
+
+const (
+	Read = Perm(1 << iota)
+	Write
+)
+
+// Confines an FS to the paths granted by the embedder, every other path is
+// reported as fs.ErrPermission
+type Sandbox struct {
+	fsys   FS
+	grants map[string]Perm
+}
+
+// Grants perm on dir and everything below it, "." grants the whole filesystem.
+// The most specific grant of a path decides its permissions
+func (s *Sandbox) Grant(dir string, perm Perm) *Sandbox {
+	dir, err := Clean(dir)
+	if err == nil {
+		s.grants[dir] = perm
+	}
+	return s
+}
+
+func (s *Sandbox) Perm(name string) Perm {
+	for {
+		if perm, ok := s.grants[name]; ok {
+			return perm
+		}
+		if name == "." {
+			return 0
+		}
+		idx := strings.LastIndex(name, "/")
+		if idx < 0 {
+			name = "."
+		} else {
+			name = name[:idx]
+		}
+	}
+}
+
+func (s *Sandbox) check(op string, name string, perm Perm) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if s.Perm(name)&perm != perm {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+func (s *Sandbox) Open(name string) (fs.File, error) {
+	if err := s.check("open", name, Read); err != nil {
+		return nil, err
+	}
+	return s.fsys.Open(name)
+}
+
+func (s *Sandbox) Stat(name string) (fs.FileInfo, error) {
+	if err := s.check("stat", name, Read); err != nil {
+		return nil, err
+	}
+	return fs.Stat(s.fsys, name)
+}
+
+func (s *Sandbox) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := s.check("readdir", name, Read); err != nil {
+		return nil, err
+	}
+	return fs.ReadDir(s.fsys, name)
+}
+
+func (s *Sandbox) OpenWriter(name string, append bool) (io.WriteCloser, error) {
+	if err := s.check("open", name, Write); err != nil {
+		return nil, err
+	}
+	return s.fsys.OpenWriter(name, append)
+}
+
+// The root of the filesystem cannot be removed, whatever is granted on it
+func (s *Sandbox) Remove(name string) error {
+	if err := s.check("remove", name, Write); err != nil {
+		return err
+	}
+	if name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	return s.fsys.Remove(name)
+}
+
+// Wraps fsys without any grants
+func NewSandbox(fsys FS) *Sandbox {
+	return &Sandbox{fsys: fsys, grants: make(map[string]Perm)}
+}
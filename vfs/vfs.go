@@ -0,0 +1,79 @@
+package vfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A filesystem that can also write and remove files, names follow the io/fs rules
+type FS interface {
+	fs.FS
+	// Opens name for writing, creating it if it does not exist. The file is
+	// truncated unless append is set
+	OpenWriter(name string, append bool) (io.WriteCloser, error)
+	Remove(name string) error
+}
+
+// Cleans a program supplied path into a valid io/fs name, absolute paths are
+// relative to the root of the filesystem
+func Clean(name string) (string, error) {
+	name = path.Clean("/" + name)
+	name = strings.TrimPrefix(name, "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return name, nil
+}
+
+// Every access goes through an os.Root, so symlinks cannot lead out of the directory
+type dir struct {
+	fs.FS
+	root *os.Root
+}
+
+func (d *dir) path(op string, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.FromSlash(name), nil
+}
+
+func (d *dir) OpenWriter(name string, append bool) (io.WriteCloser, error) {
+	p, err := d.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if append {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	return d.root.OpenFile(p, flag, 0644)
+}
+
+func (d *dir) Remove(name string) error {
+	p, err := d.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return d.root.Remove(p)
+}
+
+func (d *dir) Close() error {
+	return d.root.Close()
+}
+
+// Returns a filesystem for the host directory root, it implements io.Closer to release the directory
+func Dir(root string) (FS, error) {
+	r, err := os.OpenRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	return &dir{FS: r.FS(), root: r}, nil
+}
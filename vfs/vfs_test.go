@@ -0,0 +1,182 @@
+package vfs_test
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/canpacis/flint/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func WriteFile(t *testing.T, fsys vfs.FS, name string, data string, append bool) {
+	w, err := fsys.OpenWriter(name, append)
+	assert.NoError(t, err)
+	_, err = io.WriteString(w, data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+}
+
+func TestFS(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := vfs.Dir(t.TempDir())
+	assert.NoError(err)
+	filesystems := map[string]vfs.FS{
+		"mem": vfs.NewMemFS(),
+		"dir": root,
+	}
+
+	for kind, fsys := range filesystems {
+		WriteFile(t, fsys, "hello.txt", "hello", false)
+		WriteFile(t, fsys, "hello.txt", ", world", true)
+		data, err := fs.ReadFile(fsys, "hello.txt")
+		assert.NoError(err, kind)
+		assert.Equal("hello, world", string(data), kind)
+
+		WriteFile(t, fsys, "hello.txt", "bye", false)
+		data, err = fs.ReadFile(fsys, "hello.txt")
+		assert.NoError(err, kind)
+		assert.Equal("bye", string(data), kind)
+
+		entries, err := fs.ReadDir(fsys, ".")
+		assert.NoError(err, kind)
+		if assert.Len(entries, 1, kind) {
+			assert.Equal("hello.txt", entries[0].Name(), kind)
+		}
+
+		assert.NoError(fsys.Remove("hello.txt"), kind)
+		_, err = fs.Stat(fsys, "hello.txt")
+		assert.ErrorIs(err, fs.ErrNotExist, kind)
+		assert.ErrorIs(fsys.Remove("hello.txt"), fs.ErrNotExist, kind)
+		_, err = fsys.OpenWriter("../escape.txt", false)
+		assert.ErrorIs(err, fs.ErrInvalid, kind)
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	assert := assert.New(t)
+
+	mem := vfs.NewMemFS()
+	assert.NoError(mem.WriteFile("a.txt", []byte("a")))
+	assert.NoError(mem.WriteFile("data/b.txt", []byte("b")))
+	assert.NoError(mem.WriteFile("data/nested/c.txt", []byte("c")))
+	assert.NoError(fstest.TestFS(mem, "a.txt", "data/b.txt", "data/nested/c.txt"))
+
+	entries, err := fs.ReadDir(mem, "data")
+	assert.NoError(err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal([]string{"b.txt", "nested"}, names)
+
+	assert.Error(mem.WriteFile("data", nil))
+	assert.Error(mem.WriteFile("a.txt/d.txt", nil))
+	_, err = mem.OpenWriter("data/nested", false)
+	assert.Error(err)
+	assert.ErrorIs(mem.Remove("data"), fs.ErrNotExist)
+}
+
+func TestDirSymlink(t *testing.T) {
+	assert := assert.New(t)
+
+	outside := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644))
+	inside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(inside, "link")); err != nil {
+		t.Skip("symlinks are not supported:", err)
+	}
+
+	root, err := vfs.Dir(inside)
+	assert.NoError(err)
+	_, err = fs.ReadFile(root, "link/secret.txt")
+	assert.Error(err)
+	_, err = root.OpenWriter("link/new.txt", false)
+	assert.Error(err)
+	assert.Error(root.Remove("link/secret.txt"))
+	_, err = os.Stat(filepath.Join(outside, "secret.txt"))
+	assert.NoError(err)
+	_, err = os.Stat(filepath.Join(outside, "new.txt"))
+	assert.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestClean(t *testing.T) {
+	assert := assert.New(t)
+
+	type CleanTest struct {
+		Path     string
+		Expected string
+	}
+
+	tests := []CleanTest{
+		{"data/file.txt", "data/file.txt"},
+		{"/data/file.txt", "data/file.txt"},
+		{"./data/../file.txt", "file.txt"},
+		{"../../etc/passwd", "etc/passwd"},
+		{"/", "."},
+		{"", "."},
+	}
+
+	for i, test := range tests {
+		name, err := vfs.Clean(test.Path)
+		assert.NoErrorf(err, "Test case %d", i)
+		assert.Equalf(test.Expected, name, "Test case %d", i)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	assert := assert.New(t)
+
+	mem := vfs.NewMemFS()
+	assert.NoError(mem.WriteFile("data/input.txt", []byte("input")))
+	assert.NoError(mem.WriteFile("secret.txt", []byte("secret")))
+
+	sandbox := vfs.NewSandbox(mem).
+		Grant("data", vfs.Read).
+		Grant("data/out", vfs.Read|vfs.Write)
+
+	type PermTest struct {
+		Path     string
+		Expected vfs.Perm
+	}
+
+	tests := []PermTest{
+		{".", 0},
+		{"secret.txt", 0},
+		{"data", vfs.Read},
+		{"data/input.txt", vfs.Read},
+		{"data/out", vfs.Read | vfs.Write},
+		{"data/out/log.txt", vfs.Read | vfs.Write},
+		{"data/outside.txt", vfs.Read},
+	}
+
+	for i, test := range tests {
+		assert.Equalf(test.Expected, sandbox.Perm(test.Path), "Test case %d", i)
+	}
+
+	data, err := fs.ReadFile(sandbox, "data/input.txt")
+	assert.NoError(err)
+	assert.Equal("input", string(data))
+	_, err = fs.ReadFile(sandbox, "secret.txt")
+	assert.ErrorIs(err, fs.ErrPermission)
+	_, err = sandbox.OpenWriter("data/input.txt", false)
+	assert.ErrorIs(err, fs.ErrPermission)
+	assert.ErrorIs(sandbox.Remove("data/input.txt"), fs.ErrPermission)
+
+	WriteFile(t, sandbox, "data/out/log.txt", "log", false)
+	entries, err := fs.ReadDir(sandbox, "data")
+	assert.NoError(err)
+	assert.Len(entries, 2)
+	_, err = fs.ReadDir(sandbox, ".")
+	assert.ErrorIs(err, fs.ErrPermission)
+	assert.NoError(sandbox.Remove("data/out/log.txt"))
+
+	// A write grant on the root does not allow removing it
+	root := vfs.NewSandbox(mem).Grant(".", vfs.Read|vfs.Write)
+	assert.ErrorIs(root.Remove("."), fs.ErrPermission)
+	assert.NoError(root.Remove("secret.txt"))
+}
@@ -0,0 +1,232 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/canpacis/flint/common"
+)
+
+var ErrUnsupportedType = errors.New("unsupported type")
+
+var errorType = reflect.TypeFor[error]()
+var constType = reflect.TypeFor[*common.Const]()
+
+// Const type a Go type converts to, *common.Const converts to any const type
+func constTypeOf(t reflect.Type) (common.ConstType, error) {
+	if t == constType {
+		return common.InvalidConstType, nil
+	}
+	if t == reflect.TypeFor[HeapHandle]() {
+		return common.RefConst, nil
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return common.StrConst, nil
+	case reflect.Bool:
+		return common.TrueConst, nil
+	case reflect.Int, reflect.Int64:
+		return common.I64Const, nil
+	case reflect.Int32:
+		return common.I32Const, nil
+	case reflect.Int16:
+		return common.I16Const, nil
+	case reflect.Int8:
+		return common.I8Const, nil
+	case reflect.Uint, reflect.Uint64:
+		return common.U64Const, nil
+	case reflect.Uint32:
+		return common.U32Const, nil
+	case reflect.Uint16:
+		return common.U16Const, nil
+	case reflect.Uint8:
+		return common.U8Const, nil
+	case reflect.Float64:
+		return common.F64Const, nil
+	case reflect.Float32:
+		return common.F32Const, nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return common.DataConst, nil
+		}
+	}
+	return common.InvalidConstType, fmt.Errorf("%w: %s", ErrUnsupportedType, t)
+}
+
+// Converts a Go value to a constant, integers of unspecified size become i64 or u64
+func ToConst(v any) (*common.Const, error) {
+	if c, ok := v.(*common.Const); ok {
+		return c, nil
+	}
+	value := reflect.ValueOf(v)
+	if !value.IsValid() {
+		return nil, fmt.Errorf("%w: nil", ErrUnsupportedType)
+	}
+	typ, err := constTypeOf(value.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	switch typ {
+	case common.TrueConst:
+		if !value.Bool() {
+			return common.NewConst(common.FalseConst, false), nil
+		}
+		return common.NewConst(common.TrueConst, true), nil
+	case common.StrConst:
+		return common.NewConst(typ, value.String()), nil
+	case common.DataConst:
+		return common.NewConst(typ, value.Bytes()), nil
+	case common.RefConst:
+		return common.NewConst(typ, uint32(value.Uint())), nil
+	case common.I64Const:
+		return common.NewConst(typ, value.Int()), nil
+	case common.I32Const:
+		return common.NewConst(typ, int32(value.Int())), nil
+	case common.I16Const:
+		return common.NewConst(typ, int16(value.Int())), nil
+	case common.I8Const:
+		return common.NewConst(typ, int8(value.Int())), nil
+	case common.U64Const:
+		return common.NewConst(typ, value.Uint()), nil
+	case common.U32Const:
+		return common.NewConst(typ, uint32(value.Uint())), nil
+	case common.U16Const:
+		return common.NewConst(typ, uint16(value.Uint())), nil
+	case common.U8Const:
+		return common.NewConst(typ, uint8(value.Uint())), nil
+	case common.F64Const:
+		return common.NewConst(typ, value.Float()), nil
+	default:
+		return common.NewConst(typ, float32(value.Float())), nil
+	}
+}
+
+// Converts a constant to the Go value it holds, bools become bool and refs HeapHandle
+func ToValue(c *common.Const) any {
+	c = unwrap(c)
+	switch c.Type {
+	case common.TrueConst:
+		return true
+	case common.FalseConst:
+		return false
+	case common.RefConst:
+		if handle, err := GetRef(c); err == nil {
+			return handle
+		}
+	}
+	return c.Value
+}
+
+// Converts a constant to the Go type t, the constant type has to match t exactly
+func FromConst(c *common.Const, t reflect.Type) (reflect.Value, error) {
+	if t == constType {
+		return reflect.ValueOf(unwrap(c)), nil
+	}
+	typ, err := constTypeOf(t)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	switch typ {
+	case common.TrueConst:
+		// Bool constants do not always carry a value, their type is the value
+		if c.Type != common.TrueConst && c.Type != common.FalseConst {
+			return reflect.Value{}, fmt.Errorf("%w: expected bool found %s", ErrConstTypeInvalid, c.Type)
+		}
+		return reflect.ValueOf(c.Type == common.TrueConst).Convert(t), nil
+	case common.RefConst:
+		handle, err := GetRef(c)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(handle).Convert(t), nil
+	}
+	if c.Type != typ || c.Value == nil {
+		return reflect.Value{}, fmt.Errorf("%w: expected %s found %s", ErrConstTypeInvalid, typ, c.Type)
+	}
+	value := reflect.ValueOf(c.Value)
+	if !value.CanConvert(t) {
+		return reflect.Value{}, fmt.Errorf("%w: expected %s found %T", ErrConstTypeInvalid, typ, c.Value)
+	}
+	return value.Convert(t), nil
+}
+
+// Wraps a Go function as a builtin. The function can take any of the types ToConst
+// supports and return at most one value, optionally followed by an error
+func Bind(name string, fn any) (*BuiltinFn, error) {
+	value := reflect.ValueOf(fn)
+	if value.Kind() != reflect.Func {
+		return nil, fmt.Errorf("cannot bind %s: %w: %T is not a function", name, ErrUnsupportedType, fn)
+	}
+	t := value.Type()
+	if t.IsVariadic() {
+		return nil, fmt.Errorf("cannot bind %s: %w: variadic functions", name, ErrUnsupportedType)
+	}
+	for i := range t.NumIn() {
+		if _, err := constTypeOf(t.In(i)); err != nil {
+			return nil, fmt.Errorf("cannot bind %s: argument %d: %w", name, i, err)
+		}
+	}
+
+	outs := t.NumOut()
+	errs := outs > 0 && t.Out(outs-1) == errorType
+	if errs {
+		outs--
+	}
+	if outs > 1 {
+		return nil, fmt.Errorf("cannot bind %s: %w: more than one result", name, ErrUnsupportedType)
+	}
+	returns := common.InvalidConstType
+	if outs == 1 {
+		typ, err := constTypeOf(t.Out(0))
+		if err != nil {
+			return nil, fmt.Errorf("cannot bind %s: result: %w", name, err)
+		}
+		// The instructions of the builtin only need to know that it returns something
+		if typ == common.InvalidConstType {
+			typ = common.FnConst
+		}
+		returns = typ
+	}
+
+	return NewBuiltinFn(name, t.NumIn(), returns, func(args ...*common.Const) (*common.Const, error) {
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			v, err := FromConst(arg, t.In(i))
+			if err != nil {
+				return nil, fmt.Errorf("argument %d of %s: %w", i, name, err)
+			}
+			in[i] = v
+		}
+
+		out := value.Call(in)
+		if errs {
+			if err, _ := out[len(out)-1].Interface().(error); err != nil {
+				return nil, err
+			}
+		}
+		if outs == 0 {
+			return nil, nil
+		}
+		result, err := ToConst(out[0].Interface())
+		if err != nil {
+			return nil, fmt.Errorf("result of %s: %w", name, err)
+		}
+		if result == nil {
+			return nil, fmt.Errorf("result of %s: %w: nil", name, ErrUnsupportedType)
+		}
+		return result, nil
+	}), nil
+}
+
+// Binds fn and registers it under name
+func (b *Builtins) RegisterFunc(name string, fn any) error {
+	builtin, err := Bind(name, fn)
+	if err != nil {
+		return err
+	}
+	b.Register(name, common.NewConst(common.FnConst, builtin))
+	return nil
+}
@@ -1,7 +1,10 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 
 	"github.com/canpacis/flint/common"
 )
@@ -48,7 +51,9 @@ func NewBuiltinFn(
 type Builtins struct {
 	indicies []*common.Const
 	names    map[string]int
-	pointer  int
+	// Names by index, for the allow list check of every load.builtin
+	list    []string
+	pointer int
 }
 
 func (b *Builtins) Len() int {
@@ -59,6 +64,7 @@ func (b *Builtins) Register(name string, c *common.Const) {
 	pointer := b.pointer
 	b.indicies[pointer] = c
 	b.names[name] = pointer
+	b.list = append(b.list, name)
 	b.pointer++
 }
 
@@ -70,6 +76,13 @@ func (b *Builtins) Get(name string) int {
 	return idx
 }
 
+func (b *Builtins) Name(idx int) string {
+	if idx < 0 || idx >= len(b.list) {
+		return ""
+	}
+	return b.list[idx]
+}
+
 func (b *Builtins) Map() map[int]int {
 	m := make(map[int]int, b.Len())
 	for i := range b.indicies {
@@ -93,14 +106,75 @@ func CreatePanic() *common.Const {
 
 type SyscallOp int
 
+// Every syscall takes an op, a descriptor and a buffer and returns an i64
 const (
+	// Reads into a ref buffer, returns the number of bytes read or 0 at the end of the
+	// stream. Reading an empty pipe blocks the thread until there is data to read
 	SyscallRead = SyscallOp(iota)
+	// Writes a data or ref buffer, returns the number of bytes written
 	SyscallWrite
+	// Same as SyscallRead but stops after a new line
+	SyscallReadLine
+	// Closes the descriptor, the buffer is ignored
+	SyscallClose
+	// Duplicates the descriptor and returns the new one, the buffer is ignored
+	SyscallDup
+	// Opens a pipe and returns its read end, the write end is the next descriptor.
+	// Both the descriptor and the buffer are ignored
+	SyscallPipe
+	// File syscalls take a path as their buffer.
+	// Opens the path with the OpenMode passed as the descriptor, returns the new descriptor
+	SyscallOpen
+	// Returns the size of a file, STAT_DIR for directories or STAT_NOT_EXIST
+	SyscallStat
+	// Returns a descriptor listing the directory entries one per line
+	SyscallReadDir
+	SyscallRemove
 )
 
+const STAT_DIR = -1
+const STAT_NOT_EXIST = -2
+
+func syscallPath(c *common.Const) (string, error) {
+	if c.Type == common.StrConst {
+		return GetString(c)
+	}
+	data, err := GetData(c)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func syscallBuffer(processor Processor, c *common.Const) ([]byte, error) {
+	if c.Type == common.RefConst {
+		handle, err := GetRef(c)
+		if err != nil {
+			return nil, err
+		}
+		heap, ok := processor.(HeapProcessor)
+		if !ok {
+			return nil, fmt.Errorf("%w: %T has no heap for ref buffers", ErrConstTypeInvalid, processor)
+		}
+		return heap.Heap().Bytes(handle)
+	}
+	return GetData(c)
+}
+
+func syscallRead(n int, err error) (*common.Const, error) {
+	var blocked *BlockedError
+	if errors.As(err, &blocked) {
+		return nil, err
+	}
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, ErrWouldBlock) {
+		return common.NewConst(common.I64Const, int64(n)), fmt.Errorf("failed to read from descriptor: %w", err)
+	}
+	return common.NewConst(common.I64Const, int64(n)), nil
+}
+
 func CreateSyscall(processor Processor) *common.Const {
 	fn := NewBuiltinFn("syscall", 3, common.I64Const, func(args ...*common.Const) (*common.Const, error) {
-		zero := common.NewConst(common.I64Const, 0)
+		zero := common.NewConst(common.I64Const, int64(0))
 
 		op, err := GetI64(args[0])
 		if err != nil {
@@ -110,25 +184,77 @@ func CreateSyscall(processor Processor) *common.Const {
 		if err != nil {
 			return zero, err
 		}
-		data, err := GetData(args[2])
-		if err != nil {
-			return zero, err
-		}
+		process := processor.Process()
 
 		switch SyscallOp(op) {
-		case SyscallRead:
-			return zero, nil
+		case SyscallRead, SyscallReadLine:
+			if args[2].Type != common.RefConst {
+				return zero, fmt.Errorf("%w: read buffer must be a ref found %s", ErrConstTypeInvalid, args[2].Type)
+			}
+			buf, err := syscallBuffer(processor, args[2])
+			if err != nil {
+				return zero, err
+			}
+			if SyscallOp(op) == SyscallReadLine {
+				return syscallRead(process.ReadLine(int(fd), buf))
+			}
+			return syscallRead(process.Read(int(fd), buf))
 		case SyscallWrite:
-			proccess := processor.Process()
-			w, err := proccess.WriteDescriptors.Get(int(fd))
+			data, err := syscallBuffer(processor, args[2])
 			if err != nil {
-				return zero, fmt.Errorf("invalid syscall descriptor %d: %w", fd, err)
+				return zero, err
 			}
-			n, err := w.Write(data)
+			n, err := process.Write(int(fd), data)
 			if err != nil {
-				return zero, fmt.Errorf("failed to write to buffer: %w", err)
+				return zero, fmt.Errorf("failed to write to descriptor: %w", err)
 			}
 			return common.NewConst(common.I64Const, int64(n)), nil
+		case SyscallClose:
+			return zero, process.Close(int(fd))
+		case SyscallDup:
+			dup, err := process.Dup(int(fd))
+			if err != nil {
+				return zero, err
+			}
+			return common.NewConst(common.I64Const, int64(dup)), nil
+		case SyscallPipe:
+			r, _, err := process.Pipe()
+			if err != nil {
+				return zero, err
+			}
+			return common.NewConst(common.I64Const, int64(r)), nil
+		case SyscallOpen, SyscallStat, SyscallReadDir, SyscallRemove:
+			path, err := syscallPath(args[2])
+			if err != nil {
+				return zero, err
+			}
+			switch SyscallOp(op) {
+			case SyscallOpen:
+				fd, err := process.OpenFile(path, OpenMode(fd))
+				if err != nil {
+					return zero, err
+				}
+				return common.NewConst(common.I64Const, int64(fd)), nil
+			case SyscallStat:
+				info, err := process.Stat(path)
+				if errors.Is(err, fs.ErrNotExist) {
+					return common.NewConst(common.I64Const, int64(STAT_NOT_EXIST)), nil
+				} else if err != nil {
+					return zero, err
+				}
+				if info.IsDir() {
+					return common.NewConst(common.I64Const, int64(STAT_DIR)), nil
+				}
+				return common.NewConst(common.I64Const, info.Size()), nil
+			case SyscallReadDir:
+				fd, err := process.ReadDir(path)
+				if err != nil {
+					return zero, err
+				}
+				return common.NewConst(common.I64Const, int64(fd)), nil
+			default:
+				return zero, process.Remove(path)
+			}
 		default:
 			return zero, fmt.Errorf("invalid op argument for syscall %d", op)
 		}
@@ -136,9 +262,46 @@ func CreateSyscall(processor Processor) *common.Const {
 	return common.NewConst(common.FnConst, fn)
 }
 
+func CreateArgc(processor Processor) *common.Const {
+	fn := NewBuiltinFn("argc", 0, common.I64Const, func(args ...*common.Const) (*common.Const, error) {
+		return common.NewConst(common.I64Const, int64(len(processor.Process().Args))), nil
+	})
+	return common.NewConst(common.FnConst, fn)
+}
+
+func CreateArgv(processor Processor) *common.Const {
+	fn := NewBuiltinFn("argv", 1, common.StrConst, func(args ...*common.Const) (*common.Const, error) {
+		idx, err := GetI64(args[0])
+		if err != nil {
+			return nil, err
+		}
+		argv := processor.Process().Args
+		if idx < 0 || int(idx) >= len(argv) {
+			return nil, fmt.Errorf("argument index %d out of range with %d arguments", idx, len(argv))
+		}
+		return common.NewConst(common.StrConst, argv[idx]), nil
+	})
+	return common.NewConst(common.FnConst, fn)
+}
+
+// Returns the value of an environment variable, or an empty string if it is not set
+func CreateGetenv(processor Processor) *common.Const {
+	fn := NewBuiltinFn("getenv", 1, common.StrConst, func(args ...*common.Const) (*common.Const, error) {
+		name, err := GetString(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return common.NewConst(common.StrConst, processor.Process().Env[name]), nil
+	})
+	return common.NewConst(common.FnConst, fn)
+}
+
 func DefaultBuiltins(processor Processor) *Builtins {
 	builtins := NewBuiltins()
 	builtins.Register("panic", CreatePanic())
 	builtins.Register("syscall", CreateSyscall(processor))
+	builtins.Register("argc", CreateArgc(processor))
+	builtins.Register("argv", CreateArgv(processor))
+	builtins.Register("getenv", CreateGetenv(processor))
 	return builtins
 }
@@ -0,0 +1,144 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/canpacis/flint/common"
+)
+
+var ErrNotInitialized = errors.New("vm is not initialized")
+var ErrCallSuspended = errors.New("called function yielded")
+
+// Error returned when a called function traps
+type TrapError struct {
+	Message string
+	// Stack trace of the call at the trap, the innermost frame first
+	Trace []string
+	// Error of the instruction that caused the trap, nil if the program panicked itself
+	Err error
+}
+
+func (e *TrapError) Error() string {
+	if len(e.Trace) == 0 {
+		return "trap: " + e.Message
+	}
+	return fmt.Sprintf("trap: %s\n\t%s", e.Message, strings.Join(e.Trace, "\n\t"))
+}
+
+func (e *TrapError) Unwrap() error {
+	return e.Err
+}
+
+// Calls the function name of the newest version of module with args converted by ToConst
+// and returns its result converted by ToValue, nil if it returns nothing
+func (vm *VM) Call(module, name string, args ...any) (any, error) {
+	return vm.CallContext(context.Background(), module, name, args...)
+}
+
+func (vm *VM) CallContext(ctx context.Context, module, name string, args ...any) (any, error) {
+	result, err := vm.call(ctx, module, name, args)
+	if err != nil || result == nil {
+		return nil, err
+	}
+	return ToValue(result), nil
+}
+
+// Calls the function name of module and converts its result to T with FromConst
+func CallAs[T any](vm *VM, module, name string, args ...any) (T, error) {
+	return CallAsContext[T](context.Background(), vm, module, name, args...)
+}
+
+func CallAsContext[T any](ctx context.Context, vm *VM, module, name string, args ...any) (T, error) {
+	var zero T
+	result, err := vm.call(ctx, module, name, args)
+	if err != nil {
+		return zero, err
+	}
+	if result == nil {
+		return zero, fmt.Errorf("%s.%s returned nothing", module, name)
+	}
+	value, err := FromConst(result, reflect.TypeFor[T]())
+	if err != nil {
+		return zero, fmt.Errorf("result of %s.%s: %w", module, name, err)
+	}
+	return value.Interface().(T), nil
+}
+
+// A vm sharing the heap, process, builtins, archive, hooks and fuel of vm, without
+// any of the threads, channels or state of its program
+func (vm *VM) fork() *VM {
+	return &VM{
+		config:   vm.config,
+		allowed:  vm.allowed,
+		heap:     vm.heap,
+		process:  vm.process,
+		builtins: vm.builtins,
+		archive:  vm.archive,
+		hooks:    vm.hooks,
+		metered:  vm.metered,
+		fuel:     vm.fuel,
+		costs:    vm.costs,
+	}
+}
+
+func (vm *VM) call(ctx context.Context, module, name string, args []any) (*common.Const, error) {
+	if vm.archive == nil {
+		return nil, ErrNotInitialized
+	}
+	mod, _, err := vm.archive.Module(module, common.Constraint{})
+	if err != nil {
+		return nil, err
+	}
+	constant, err := mod.Fn(name)
+	if err != nil {
+		return nil, err
+	}
+	fn, err := GetFn(constant)
+	if err != nil {
+		return nil, err
+	}
+	if fn.Locals() != len(args) {
+		return nil, fmt.Errorf("%w: expected %d got %d", ErrIncorrectNumberOfArgs, fn.Locals(), len(args))
+	}
+
+	// The call runs as the main thread of a program of its own, the program the vm
+	// was initialized with is left as it is
+	child := vm.fork()
+	thread := NewExecutor(child)
+	child.thread = thread
+	child.threads = []*Executor{thread}
+	for i, arg := range args {
+		c, err := ToConst(arg)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d of %s.%s: %w", i, module, name, err)
+		}
+		if err := thread.stack.Push(c); err != nil {
+			return nil, err
+		}
+	}
+	symbol, err := mod.Symbols.Export(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := thread.frames.Push(newFrame(fn, mod, symbol.Pointer, 0)); err != nil {
+		return nil, err
+	}
+
+	err = child.RunContext(ctx)
+	// Fuel is shared, the call uses up the fuel of the vm
+	vm.fuel = child.fuel
+	if err != nil {
+		return nil, err
+	}
+	switch thread.State() {
+	case StateTrapped:
+		return nil, &TrapError{Message: thread.panicmsg, Trace: thread.StackTrace(), Err: thread.err}
+	case StateSuspended:
+		return nil, fmt.Errorf("%w: %s.%s", ErrCallSuspended, module, name)
+	}
+	return thread.result, nil
+}
@@ -0,0 +1,183 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/canpacis/flint/common"
+)
+
+var ErrInvalidChannel = errors.New("invalid channel")
+var ErrChannelClosed = errors.New("channel is closed")
+
+type Channel struct {
+	id     int
+	cap    int
+	buffer []*common.Const
+	closed bool
+	// Number of parked receivers, an unbuffered channel only accepts values for them
+	receivers int
+}
+
+func (c *Channel) ID() int {
+	return c.id
+}
+
+func (c *Channel) Cap() int {
+	return c.cap
+}
+
+func (c *Channel) Len() int {
+	return len(c.buffer)
+}
+
+func (c *Channel) Closed() bool {
+	return c.closed
+}
+
+func (c *Channel) ready() bool {
+	return len(c.buffer) < max(c.cap, c.receivers)
+}
+
+func (c *Channel) send(value *common.Const) (bool, error) {
+	if c.closed {
+		return false, fmt.Errorf("%w: send on channel %d", ErrChannelClosed, c.id)
+	}
+	if !c.ready() {
+		return false, nil
+	}
+	c.buffer = append(c.buffer, value)
+	return true, nil
+}
+
+func (c *Channel) recv() (*common.Const, bool) {
+	if len(c.buffer) == 0 {
+		return nil, false
+	}
+	value := c.buffer[0]
+	c.buffer = c.buffer[1:]
+	return value, true
+}
+
+func (c *Channel) close() error {
+	if c.closed {
+		return fmt.Errorf("%w: close of channel %d", ErrChannelClosed, c.id)
+	}
+	c.closed = true
+	return nil
+}
+
+func (vm *VM) channel(cap int) *Channel {
+	channel := &Channel{id: len(vm.channels), cap: cap}
+	vm.channels = append(vm.channels, channel)
+	return channel
+}
+
+func (vm *VM) Channels() []*Channel {
+	return vm.channels
+}
+
+func (e *Executor) popChannel() (*Channel, error) {
+	constant, err := e.stack.Pop()
+	if err != nil {
+		return nil, err
+	}
+	id, err := GetI64(constant)
+	if err != nil {
+		return nil, err
+	}
+	if id < 0 || int(id) >= len(e.vm.channels) {
+		return nil, fmt.Errorf("%w: no such channel %d", ErrInvalidChannel, id)
+	}
+	return e.vm.channels[id], nil
+}
+
+func boolConst(b bool) *common.Const {
+	if b {
+		return common.NewConst(common.TrueConst, true)
+	}
+	return common.NewConst(common.FalseConst, false)
+}
+
+// Pushes a received value followed by a bool that is false when nothing was received
+func (e *Executor) pushReceived(value *common.Const, ok bool) error {
+	if !ok {
+		value = boolConst(false)
+	}
+	if err := e.stack.Push(value); err != nil {
+		return err
+	}
+	return e.stack.Push(boolConst(ok))
+}
+
+// Blocking operations park the executor and run again once the channel is ready
+func (e *Executor) ExecuteChannel(code common.OpCode, operands []int) error {
+	switch code {
+	case common.OpChan:
+		channel := e.vm.channel(operands[0])
+		return e.stack.Push(common.NewConst(common.I64Const, int64(channel.id)))
+	case common.OpSend, common.OpTrySend:
+		value, err := e.stack.Pop()
+		if err != nil {
+			return err
+		}
+		channel, err := e.popChannel()
+		if err != nil {
+			return err
+		}
+		sent, err := channel.send(value)
+		if err != nil {
+			return err
+		}
+		if code == common.OpTrySend {
+			return e.stack.Push(boolConst(sent))
+		}
+		if !sent {
+			if err := e.stack.Push(common.NewConst(common.I64Const, int64(channel.id))); err != nil {
+				return err
+			}
+			if err := e.stack.Push(value); err != nil {
+				return err
+			}
+			e.park(fmt.Sprintf("send on channel %d", channel.id), func() bool {
+				return channel.closed || channel.ready()
+			})
+		}
+		return nil
+	case common.OpRecv, common.OpTryRecv:
+		channel, err := e.popChannel()
+		if err != nil {
+			return err
+		}
+		value, ok := channel.recv()
+		if code == common.OpTryRecv {
+			return e.pushReceived(value, ok)
+		}
+		if !ok && !channel.closed {
+			if e.receiving != channel {
+				e.receiving = channel
+				channel.receivers++
+			}
+			if err := e.stack.Push(common.NewConst(common.I64Const, int64(channel.id))); err != nil {
+				return err
+			}
+			e.park(fmt.Sprintf("receive on channel %d", channel.id), func() bool {
+				return channel.closed || len(channel.buffer) > 0
+			})
+			return nil
+		}
+		if e.receiving == channel {
+			e.receiving = nil
+			channel.receivers--
+		}
+		return e.pushReceived(value, ok)
+	case common.OpClose:
+		channel, err := e.popChannel()
+		if err != nil {
+			return err
+		}
+		return channel.close()
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownOpCode, code)
+	}
+}
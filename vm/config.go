@@ -0,0 +1,122 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/canpacis/flint/vfs"
+)
+
+var ErrBuiltinNotAllowed = errors.New("builtin is not allowed")
+
+type Limit int
+
+const (
+	StackLimit = Limit(iota)
+	CallDepthLimit
+	HeapLimit
+)
+
+func (l Limit) String() string {
+	switch l {
+	case StackLimit:
+		return "stack"
+	case CallDepthLimit:
+		return "call depth"
+	case HeapLimit:
+		return "heap"
+	default:
+		return fmt.Sprintf("limit(%d)", int(l))
+	}
+}
+
+// Reported when a program exceeds one of the limits in its Config
+type LimitError struct {
+	Limit Limit
+	Max   int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s limit of %d exceeded", e.Limit, e.Max)
+}
+
+func (e *LimitError) Unwrap() error {
+	if e.Limit == HeapLimit {
+		return ErrOutOfMemory
+	}
+	return ErrStackOverflow
+}
+
+// Limits left at zero take their value from DefaultConfig, so Config{} is usable
+type Config struct {
+	// Maximum number of values on the value stack
+	StackSize int
+	// Maximum number of nested calls
+	CallDepth int
+	// Initial heap size in bytes, the heap grows on demand up to MaxHeapSize
+	HeapSize    int
+	MaxHeapSize int
+	// Names of the builtins a program can load, nil allows every builtin.
+	// The panic builtin is always allowed since traps depend on it
+	Builtins []string
+	// Standard descriptors, a nil descriptor cannot be read from or written to
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// Filesystem for file syscalls, nil disables them
+	FS vfs.FS
+}
+
+func (c Config) allowed() map[string]bool {
+	if c.Builtins == nil {
+		return nil
+	}
+	allowed := map[string]bool{"panic": true}
+	for _, name := range c.Builtins {
+		allowed[name] = true
+	}
+	return allowed
+}
+
+// Fills the limits that are not set with their defaults
+func (c Config) withDefaults() Config {
+	defaults := DefaultConfig()
+	if c.StackSize <= 0 {
+		c.StackSize = defaults.StackSize
+	}
+	if c.CallDepth <= 0 {
+		c.CallDepth = defaults.CallDepth
+	}
+	if c.HeapSize <= 0 {
+		c.HeapSize = defaults.HeapSize
+	}
+	if c.MaxHeapSize <= 0 {
+		c.MaxHeapSize = max(defaults.MaxHeapSize, c.HeapSize)
+	}
+	return c
+}
+
+func DefaultConfig() Config {
+	return Config{
+		StackSize:   STACK_SIZE,
+		CallDepth:   FRAME_SIZE,
+		HeapSize:    256,
+		MaxHeapSize: 256,
+		Stdin:       os.Stdin,
+		Stdout:      os.Stdout,
+		Stderr:      os.Stderr,
+	}
+}
+
+// A tight configuration for untrusted programs, no builtins other than panic and no I/O
+func SandboxConfig() Config {
+	return Config{
+		StackSize:   256,
+		CallDepth:   64,
+		HeapSize:    256,
+		MaxHeapSize: 64 * 1024,
+		Builtins:    []string{},
+	}
+}
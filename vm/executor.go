@@ -15,52 +15,172 @@ var ErrFailedToGetModule = errors.New("failed to get module")
 var ErrFailedToLoadLink = errors.New("failed to load link")
 var ErrDivideByZero = errors.New("divide by zero")
 var ErrIncorrectNumberOfArgs = errors.New("function is called with incorrect number of arguments")
+var ErrNotSuspended = errors.New("executor is not suspended")
+var ErrInvalidThread = errors.New("invalid thread")
+var ErrThreadTrapped = errors.New("joined thread trapped")
+
+type State int
+
+const (
+	// The executor can run, either it has not started yet or it was stopped by the host
+	StateRunnable = State(iota)
+	// The executor yielded and waits for a Resume
+	StateSuspended
+	// The executor is parked until another thread makes progress
+	StateBlocked
+	StateFinished
+	StateTrapped
+)
+
+func (s State) String() string {
+	switch s {
+	case StateRunnable:
+		return "runnable"
+	case StateSuspended:
+		return "suspended"
+	case StateBlocked:
+		return "blocked"
+	case StateFinished:
+		return "finished"
+	case StateTrapped:
+		return "trapped"
+	default:
+		return fmt.Sprintf("state(%d)", int(s))
+	}
+}
 
 type Executor struct {
+	id     int
 	vm     *VM
 	stack  *Stack[*common.Const]
 	frames *Stack[*Frame]
-	links  map[int]*common.Module
-	paused bool
-	done   bool
+	links  map[link]*common.Module
+	// Fn consts bound to the module they were loaded from, by module and pointer
+	bound    map[link]*common.Const
+	paused   bool
+	done     bool
+	result   *common.Const
+	paniced  bool
+	panicmsg string
+	err      error
+	// Set while the executor is parked, reports whether it can run again
+	wake    func() bool
+	blocked string
+	// Channel the executor is registered as a receiver on
+	receiving *Channel
+}
+
+// A link of a module, modules refer to each other by name so they can be placed anywhere in an archive
+type link struct {
+	mod     *common.Module
+	pointer int
 }
 
 func (e *Executor) Trap(reason string) {
+	for _, hook := range e.vm.hooks {
+		hook.OnTrap(e, reason)
+	}
 	idx := e.vm.builtins.Get("panic")
 	if idx < 0 {
 		panic("Cannot trap, builtin panic is not provided")
 	}
 	if err := e.stack.Push(common.NewConst(common.StrConst, reason)); err != nil {
-		panic(fmt.Sprintf("Trap failed: %s", err))
+		e.abort(reason)
+		return
 	}
 	if err := e.ExecuteLoad(common.OpLoadBuiltin, []int{idx}); err != nil {
-		panic(fmt.Sprintf("Trap failed: %s", err))
+		e.abort(reason)
+		return
 	}
 	if err := e.ExecuteCall(common.OpCall, []int{1}); err != nil {
-		panic(fmt.Sprintf("Trap failed: %s", err))
+		e.abort(reason)
+		return
+	}
+}
+
+// Halts without calling panic when a limit leaves no room for the call
+func (e *Executor) abort(reason string) {
+	e.panic(reason)
+	e.halt()
+}
+
+func (e *Executor) fail(err error) {
+	e.err = err
+	if e.main() {
+		e.vm.err = err
+	}
+	e.Trap(err.Error())
+}
+
+func (e *Executor) main() bool {
+	return e == e.vm.thread
+}
+
+// A trap in the main thread stops the program, other threads only stop themselves
+func (e *Executor) panic(msg string) {
+	e.paniced = true
+	e.panicmsg = msg
+	if e.main() {
+		e.vm.panic(msg)
+	}
+}
+
+func (e *Executor) halt() {
+	if e.main() {
+		e.vm.halt()
+	} else {
+		e.finish()
 	}
 }
 
 func (e *Executor) Running() bool {
-	return !e.vm.halted && !e.done && !e.paused
+	return !e.vm.halted && !e.done && !e.paused && !e.vm.starved && e.wake == nil
 }
 
+// Runs the program through the scheduler until this thread stops, other threads
+// take their turns in between as they do with VM.Run
 func (e *Executor) Run() {
-	for e.Running() {
-		frame, err := e.frames.Top()
-		if err != nil {
-			e.Trap(fmt.Errorf("failed to get frame: %w", err).Error())
-			continue
+	for !e.exited() && !(e.main() && e.paused) {
+		if e.vm.Step() == nil {
+			return
 		}
-		code, operands, err := frame.Fetch()
-		if err != nil {
-			e.Trap(err.Error())
-			continue
+	}
+}
+
+func (e *Executor) Step() {
+	frame, err := e.frames.Top()
+	if err != nil {
+		e.fail(fmt.Errorf("failed to get frame: %w", err))
+		return
+	}
+	code, operands, err := frame.Fetch()
+	if err != nil {
+		e.fail(err)
+		return
+	}
+	if e.vm.metered {
+		cost := e.vm.costs[code]
+		if e.vm.fuel < cost {
+			// Leave the instruction to be fetched again once fuel is added
+			frame.ip = frame.pc
+			e.vm.starved = true
+			return
+		}
+		e.vm.fuel -= cost
+	}
+	if len(e.vm.hooks) > 0 {
+		for _, hook := range e.vm.hooks {
+			hook.BeforeInstruction(e, frame, code, operands)
 		}
-		if err := e.Execute(code, operands); err != nil {
-			e.Trap(fmt.Errorf("failed to execute op %s: %w", code, err).Error())
-			continue
+		err = e.Execute(code, operands)
+		for _, hook := range e.vm.hooks {
+			hook.AfterInstruction(e, frame, code, operands, err)
 		}
+	} else {
+		err = e.Execute(code, operands)
+	}
+	if err != nil {
+		e.fail(fmt.Errorf("failed to execute op %s: %w", code, err))
 	}
 }
 
@@ -94,14 +214,31 @@ func (e *Executor) Execute(code common.OpCode, operands []int) error {
 		if err == nil {
 			str, err := GetString(constant)
 			if err == nil {
-				e.vm.panic(str)
+				e.panic(str)
 			}
 		}
-		e.vm.halt()
+		e.halt()
 		return nil
 	case common.OpHalt:
 		e.vm.halt()
 		return nil
+	case common.OpHaltCode:
+		constant, err := e.stack.Pop()
+		if err != nil {
+			return err
+		}
+		code, err := GetI64(constant)
+		if err != nil {
+			return err
+		}
+		e.vm.exit(int(code))
+		return nil
+	case common.OpSpawn:
+		return e.ExecuteSpawn(operands)
+	case common.OpJoin:
+		return e.ExecuteJoin()
+	case common.OpChan, common.OpSend, common.OpRecv, common.OpTrySend, common.OpTryRecv, common.OpClose:
+		return e.ExecuteChannel(code, operands)
 	default:
 		return fmt.Errorf("%w: %s", ErrUnknownOpCode, code)
 	}
@@ -142,10 +279,14 @@ func (e *Executor) ExecuteCall(code common.OpCode, operands []int) error {
 		return fmt.Errorf("cannot get current frame: %w", err)
 	}
 
-	frame := NewFrame(fn, current.mod, base-argsize)
+	fn, mod, pointer := unbind(fn, current.mod)
+	frame := newFrame(fn, mod, pointer, base-argsize)
 	if err := e.frames.Push(frame); err != nil {
 		return fmt.Errorf("cannot push new frame: %w", err)
 	}
+	for _, hook := range e.vm.hooks {
+		hook.OnCall(e, frame)
+	}
 
 	builtin, ok := fn.(*BuiltinFn)
 	if ok {
@@ -159,6 +300,21 @@ func (e *Executor) ExecuteCall(code common.OpCode, operands []int) error {
 		}
 
 		value, err := builtin.Fn(args...)
+		var blocked *BlockedError
+		if errors.As(err, &blocked) {
+			// Undoes the call and parks, the call is retried once the builtin can make progress
+			if _, err := e.frames.Pop(); err != nil {
+				return err
+			}
+			if err := e.stack.Push(constant); err != nil {
+				return err
+			}
+			e.park(blocked.Reason, blocked.Ready)
+			return nil
+		}
+		for _, hook := range e.vm.hooks {
+			hook.OnBuiltinCall(e, builtin, args, value, err)
+		}
 		if err != nil {
 			return fmt.Errorf("builtin call failed: %w", err)
 		}
@@ -169,6 +325,52 @@ func (e *Executor) ExecuteCall(code common.OpCode, operands []int) error {
 	return nil
 }
 
+// A function bound to the module it was loaded from, it runs with that module as its context
+type boundFn struct {
+	common.Fn
+	module *common.Module
+	// Pointer of the fn const in the module
+	pointer int
+}
+
+// Loads the const at pointer in mod, fn consts are bound to mod the first time they are loaded
+func (e *Executor) loadConst(mod *common.Module, pointer int) (*common.Const, error) {
+	key := link{mod, pointer}
+	if bound, ok := e.bound[key]; ok {
+		return bound, nil
+	}
+	constant := new(common.Const)
+	if err := mod.Consts.Get(pointer, constant); err != nil {
+		return nil, err
+	}
+	fn, ok := constant.Value.(common.Fn)
+	if !ok || constant.Type != common.FnConst {
+		return constant, nil
+	}
+	bound := common.NewConst(common.FnConst, &boundFn{Fn: fn, module: mod, pointer: pointer})
+	e.bound[key] = bound
+	return bound, nil
+}
+
+// Unbound functions, like builtins, run in the module of their caller
+func unbind(fn common.Fn, caller *common.Module) (common.Fn, *common.Module, int) {
+	if bound, ok := fn.(*boundFn); ok {
+		return bound.Fn, bound.module, bound.pointer
+	}
+	return fn, caller, -1
+}
+
+// Host code sees the fn a bound const was loaded as
+func unwrap(c *common.Const) *common.Const {
+	if c == nil {
+		return nil
+	}
+	if bound, ok := c.Value.(*boundFn); ok {
+		return common.NewConst(common.FnConst, bound.Fn)
+	}
+	return c
+}
+
 func (e *Executor) ExecuteReturn(code common.OpCode) error {
 	frame, err := e.frames.Pop()
 	if err != nil {
@@ -176,7 +378,17 @@ func (e *Executor) ExecuteReturn(code common.OpCode) error {
 	}
 
 	if e.frames.Len() == 0 {
-		// TODO: Executor is done, move the return value to the main thread
+		var value *common.Const
+		if code == common.OpReturnValue {
+			value, err = e.stack.Top()
+			if err != nil {
+				return err
+			}
+		}
+		for _, hook := range e.vm.hooks {
+			hook.OnReturn(e, frame, value)
+		}
+		e.result = value
 		e.finish()
 		return nil
 	}
@@ -191,6 +403,15 @@ func (e *Executor) ExecuteReturn(code common.OpCode) error {
 			return err
 		}
 	}
+	if len(e.vm.hooks) > 0 {
+		var value *common.Const
+		if code == common.OpReturnValue {
+			value = returns
+		}
+		for _, hook := range e.vm.hooks {
+			hook.OnReturn(e, frame, value)
+		}
+	}
 	for range locals {
 		_, err := e.stack.Pop()
 		if err != nil {
@@ -211,8 +432,8 @@ func (e *Executor) ExecuteLoad(code common.OpCode, operands []int) error {
 		if err != nil {
 			return err
 		}
-		constant := new(common.Const)
-		if err := mod.Consts.Get(operands[0], constant); err != nil {
+		constant, err := e.loadConst(mod, operands[0])
+		if err != nil {
 			return err
 		}
 		return e.stack.Push(constant)
@@ -221,8 +442,8 @@ func (e *Executor) ExecuteLoad(code common.OpCode, operands []int) error {
 		if err != nil {
 			return err
 		}
-		constant := new(common.Const)
-		if err := mod.Consts.Get(operands[1], constant); err != nil {
+		constant, err := e.loadConst(mod, operands[1])
+		if err != nil {
 			return err
 		}
 		return e.stack.Push(constant)
@@ -230,6 +451,11 @@ func (e *Executor) ExecuteLoad(code common.OpCode, operands []int) error {
 		if operands[0] >= e.vm.builtins.Len() {
 			return fmt.Errorf("%w: no such builtin %d", ErrMissingConst, operands[0])
 		}
+		if e.vm.allowed != nil {
+			if name := e.vm.builtins.Name(operands[0]); !e.vm.allowed[name] {
+				return fmt.Errorf("%w: %s", ErrBuiltinNotAllowed, name)
+			}
+		}
 		constant := e.vm.builtins.indicies[operands[0]]
 		return e.stack.Push(constant)
 	case common.OpLoadLocal:
@@ -408,6 +634,115 @@ func (e *Executor) ExecuteJump(code common.OpCode, operands []int) error {
 	return fmt.Errorf("%w: %s", ErrUnsupportedOp, code)
 }
 
+// Pops a function and its arguments and starts it in a new thread, pushing the thread handle
+func (e *Executor) ExecuteSpawn(operands []int) error {
+	constant, err := e.stack.Pop()
+	if err != nil {
+		return fmt.Errorf("cannot get function constant: %w", err)
+	}
+	fn, err := GetFn(constant)
+	if err != nil {
+		return err
+	}
+	if _, ok := fn.(*BuiltinFn); ok {
+		return fmt.Errorf("%w: cannot spawn builtin %s", ErrUnsupportedOp, fn.Name())
+	}
+	argsize := operands[0]
+	if fn.Locals() != argsize {
+		return fmt.Errorf("%w: expected %d got %d", ErrIncorrectNumberOfArgs, fn.Locals(), argsize)
+	}
+	current, err := e.frames.Top()
+	if err != nil {
+		return fmt.Errorf("cannot get current frame: %w", err)
+	}
+
+	thread := e.vm.spawn()
+	base := e.stack.Len() - argsize
+	for i := range argsize {
+		arg, err := e.stack.Get(base + i)
+		if err != nil {
+			return fmt.Errorf("cannot get argument constant: %w", err)
+		}
+		if err := thread.stack.Push(arg); err != nil {
+			return err
+		}
+	}
+	for range argsize {
+		if _, err := e.stack.Pop(); err != nil {
+			return err
+		}
+	}
+
+	fn, mod, pointer := unbind(fn, current.mod)
+	frame := newFrame(fn, mod, pointer, 0)
+	if err := thread.frames.Push(frame); err != nil {
+		return err
+	}
+	return e.stack.Push(common.NewConst(common.I64Const, int64(thread.id)))
+}
+
+// Pops a thread handle and waits for the thread to finish, pushing its return value if it has one
+func (e *Executor) ExecuteJoin() error {
+	constant, err := e.stack.Pop()
+	if err != nil {
+		return err
+	}
+	id, err := GetI64(constant)
+	if err != nil {
+		return err
+	}
+	thread, err := e.vm.lookup(int(id))
+	if err != nil {
+		return err
+	}
+	if thread == e {
+		return fmt.Errorf("%w: thread %d cannot join itself", ErrInvalidThread, id)
+	}
+
+	if !thread.exited() {
+		// Retry the join once the thread exits
+		if err := e.stack.Push(constant); err != nil {
+			return err
+		}
+		e.park(fmt.Sprintf("join thread %d", id), thread.exited)
+		return nil
+	}
+	if thread.paniced {
+		return fmt.Errorf("%w: thread %d: %s", ErrThreadTrapped, id, thread.panicmsg)
+	}
+	if thread.result != nil {
+		return e.stack.Push(thread.result)
+	}
+	return nil
+}
+
+// Parks the executor and rewinds it to the current instruction so it is executed
+// again once wake reports true
+func (e *Executor) park(reason string, wake func() bool) {
+	if frame, err := e.frames.Top(); err == nil {
+		frame.ip = frame.pc
+	}
+	e.blocked = reason
+	e.wake = wake
+}
+
+// Unparks the executor if it can make progress, reports whether it is still parked
+func (e *Executor) parked() bool {
+	if e.wake == nil {
+		return false
+	}
+	if e.wake() {
+		e.wake = nil
+		e.blocked = ""
+		return false
+	}
+	return true
+}
+
+func (e *Executor) exited() bool {
+	return e.done || e.paniced
+}
+
 func (e *Executor) Context() (*common.Module, error) {
 	frame, err := e.frames.Top()
 	if err != nil {
@@ -416,18 +751,47 @@ func (e *Executor) Context() (*common.Module, error) {
 	return frame.mod, nil
 }
 
-func (e *Executor) LoadLink(idx int) (*common.Module, error) {
-	cached, ok := e.links[idx]
+// Loads the module linked by the link at pointer in the links of the current module
+func (e *Executor) LoadLink(pointer int) (*common.Module, error) {
+	mod, err := e.Context()
+	if err != nil {
+		return nil, err
+	}
+	key := link{mod, pointer}
+	cached, ok := e.links[key]
 	if ok {
 		return cached, nil
 	}
-	mod := common.NewModule("", 0)
-	if err := e.vm.archive.Modules.Get(idx, mod); err != nil {
+	target := new(common.Link)
+	if err := mod.Links.Get(pointer, target); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFailedToLoadLink, err)
+	}
+	// Links the compiler resolved load the version their symbols point into, others load
+	// the newest version of the module that satisfies them
+	constraint := target.Constraint
+	if target.Resolved {
+		constraint = common.Constraint{Kind: common.ExactVersion, Version: target.Version}
+	}
+	linked, _, err := e.vm.archive.Module(target.Name, constraint)
+	if err != nil {
 		return nil, fmt.Errorf("%w: %w", ErrFailedToLoadLink, err)
 	}
 
-	e.links[idx] = mod
-	return mod, nil
+	e.links[key] = linked
+	return linked, nil
+}
+
+func (e *Executor) StackTrace() []string {
+	trace := make([]string, 0, e.frames.Len())
+	for i := e.frames.Len() - 1; i >= 0; i-- {
+		frame, _ := e.frames.Get(i)
+		if pos, ok := frame.Position(frame.pc); ok {
+			trace = append(trace, fmt.Sprintf("%s (%s)", frame, pos))
+		} else {
+			trace = append(trace, fmt.Sprintf("%s (+%d)", frame, frame.pc))
+		}
+	}
+	return trace
 }
 
 func (e *Executor) Stack() *Stack[*common.Const] {
@@ -438,6 +802,71 @@ func (e *Executor) Frames() *Stack[*Frame] {
 	return e.frames
 }
 
+func (e *Executor) Paused() bool {
+	return e.paused
+}
+
+func (e *Executor) Done() bool {
+	return e.done
+}
+
+func (e *Executor) ID() int {
+	return e.id
+}
+
+// Value returned by the first function of the executor
+func (e *Executor) Result() *common.Const {
+	return unwrap(e.result)
+}
+
+func (e *Executor) Paniced() bool {
+	return e.paniced
+}
+
+func (e *Executor) PanicMessage() string {
+	return e.panicmsg
+}
+
+// Returns the error that caused the executor to trap, if any
+func (e *Executor) Err() error {
+	return e.err
+}
+
+// Describes what a blocked executor waits for
+func (e *Executor) Blocked() string {
+	return e.blocked
+}
+
+func (e *Executor) State() State {
+	switch {
+	case e.paniced:
+		return StateTrapped
+	case e.done || e.vm.halted:
+		return StateFinished
+	case e.paused:
+		return StateSuspended
+	case e.wake != nil:
+		return StateBlocked
+	default:
+		return StateRunnable
+	}
+}
+
+// Continues a suspended executor from the instruction after its yield.
+// A non nil value is pushed to the stack as the result of the yield
+func (e *Executor) Resume(value *common.Const) error {
+	if e.State() != StateSuspended {
+		return fmt.Errorf("%w: executor is %s", ErrNotSuspended, e.State())
+	}
+	if value != nil {
+		if err := e.stack.Push(value); err != nil {
+			return err
+		}
+	}
+	e.paused = false
+	return nil
+}
+
 func (e *Executor) pause() {
 	e.paused = true
 }
@@ -450,9 +879,16 @@ const STACK_SIZE = 4096
 const FRAME_SIZE = 4096
 
 func NewExecutor(vm *VM) *Executor {
+	stack := NewStack[*common.Const](vm.config.StackSize)
+	stack.overflow = &LimitError{Limit: StackLimit, Max: vm.config.StackSize}
+	frames := NewStack[*Frame](vm.config.CallDepth)
+	frames.overflow = &LimitError{Limit: CallDepthLimit, Max: vm.config.CallDepth}
+
 	return &Executor{
 		vm:     vm,
-		stack:  NewStack[*common.Const](STACK_SIZE),
-		frames: NewStack[*Frame](FRAME_SIZE),
+		stack:  stack,
+		frames: frames,
+		links:  make(map[link]*common.Module),
+		bound:  make(map[link]*common.Const),
 	}
 }
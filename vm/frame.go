@@ -10,16 +10,59 @@ import (
 var ErrOpFetchFailed = errors.New("op fetch failed")
 
 type Frame struct {
-	fn  common.Fn
-	mod *common.Module
-	ip  int
-	bp  int
+	fn      common.Fn
+	mod     *common.Module
+	pointer int
+	ip      int
+	pc      int
+	bp      int
 }
 
 func (f *Frame) String() string {
 	return f.fn.Name()
 }
 
+func (f *Frame) Fn() common.Fn {
+	return f.fn
+}
+
+func (f *Frame) Module() *common.Module {
+	return f.mod
+}
+
+// Offset of the next instruction to be fetched
+func (f *Frame) IP() int {
+	return f.ip
+}
+
+// Offset of the last fetched instruction
+func (f *Frame) PC() int {
+	return f.pc
+}
+
+func (f *Frame) BP() int {
+	return f.bp
+}
+
+// Pointer of the fn const in the module of the frame, -1 if it is not known
+func (f *Frame) Pointer() int {
+	return f.pointer
+}
+
+func (f *Frame) Debug() *common.FnDebug {
+	if f.mod == nil || f.mod.Debug == nil || f.pointer < 0 {
+		return nil
+	}
+	return f.mod.Debug.Fn(f.pointer)
+}
+
+func (f *Frame) Position(offset int) (common.Position, bool) {
+	if f.mod == nil || f.mod.Debug == nil || f.pointer < 0 {
+		return common.Position{}, false
+	}
+	return f.mod.Debug.Position(f.pointer, offset)
+}
+
 func (f *Frame) Fetch() (common.OpCode, []int, error) {
 	instructions := f.fn.Instructions()
 	if f.ip >= len(instructions) {
@@ -34,15 +77,22 @@ func (f *Frame) Fetch() (common.OpCode, []int, error) {
 		return 0, nil, fmt.Errorf("%w: pointer is reading outside of function instructions", ErrOpFetchFailed)
 	}
 	operands, off := common.ReadOperands(def, instructions[f.ip+1:])
+	f.pc = f.ip
 	f.ip += off + 1
 	return common.OpCode(b), operands, nil
 }
 
 func NewFrame(fn common.Fn, mod *common.Module, bp int) *Frame {
+	return newFrame(fn, mod, -1, bp)
+}
+
+// Creates a frame for the fn const at pointer in mod, its debug info is found by the pointer
+func newFrame(fn common.Fn, mod *common.Module, pointer int, bp int) *Frame {
 	return &Frame{
-		fn:  fn,
-		mod: mod,
-		ip:  0,
-		bp:  bp,
+		fn:      fn,
+		mod:     mod,
+		pointer: pointer,
+		ip:      0,
+		bp:      bp,
 	}
 }
@@ -17,9 +17,26 @@ type HeapBlock struct {
 	free   bool
 }
 
+func (b HeapBlock) Handle() HeapHandle {
+	return b.handle
+}
+
+func (b HeapBlock) Offset() int {
+	return int(b.offset)
+}
+
+func (b HeapBlock) Size() int {
+	return int(b.size)
+}
+
+func (b HeapBlock) Free() bool {
+	return b.free
+}
+
 type Heap struct {
 	data     []byte
 	cap      uint32
+	max      uint32
 	blocks   []*HeapBlock
 	blockmap map[HeapHandle]*HeapBlock
 	next     HeapHandle
@@ -38,7 +55,36 @@ func (h *Heap) Alloc(size int) (HeapHandle, error) {
 		}
 	}
 
-	return 0, ErrOutOfMemory
+	if err := h.grow(sz); err != nil {
+		return 0, err
+	}
+	return h.splitAndAlloc(len(h.blocks)-1, sz), nil
+}
+
+// Grows the heap so that its last block is free and can hold size bytes
+func (h *Heap) grow(size uint32) error {
+	last := h.blocks[len(h.blocks)-1]
+	need := size
+	if last.free {
+		need -= last.size
+	}
+	if h.cap+need > h.max || h.cap+need < h.cap {
+		return &LimitError{Limit: HeapLimit, Max: int(h.max)}
+	}
+	grown := min(max(h.cap*2, h.cap+need), h.max)
+
+	h.data = append(h.data, make([]byte, grown-h.cap)...)
+	if last.free {
+		last.size += grown - h.cap
+	} else {
+		h.blocks = append(h.blocks, &HeapBlock{handle: 0, offset: h.cap, size: grown - h.cap, free: true})
+	}
+	h.cap = grown
+	return nil
+}
+
+func (h *Heap) Cap() int {
+	return int(h.cap)
 }
 
 func (h *Heap) splitAndAlloc(idx int, size uint32) HeapHandle {
@@ -78,6 +124,24 @@ func (h *Heap) splitAndAlloc(idx int, size uint32) HeapHandle {
 	return allocated.handle
 }
 
+func (h *Heap) Blocks() []HeapBlock {
+	blocks := make([]HeapBlock, len(h.blocks))
+	for i, block := range h.blocks {
+		blocks[i] = *block
+	}
+	return blocks
+}
+
+// Returns the memory of the block. The slice aliases the heap and is only valid until
+// the next allocation, which can grow the heap and move its data
+func (h *Heap) Bytes(handle HeapHandle) ([]byte, error) {
+	block, ok := h.blockmap[handle]
+	if !ok {
+		return nil, ErrInvalidHandle
+	}
+	return h.data[block.offset : block.offset+block.size], nil
+}
+
 func (h *Heap) Free(handle HeapHandle) error {
 	block, ok := h.blockmap[handle]
 	if !ok {
@@ -94,9 +158,15 @@ func (h *Heap) Free(handle HeapHandle) error {
 }
 
 func NewHeap(cap int) *Heap {
+	return NewGrowingHeap(cap, cap)
+}
+
+// Creates a heap of cap bytes that can grow up to max bytes
+func NewGrowingHeap(cap int, limit int) *Heap {
 	h := &Heap{
 		data:     make([]byte, cap),
 		cap:      uint32(cap),
+		max:      uint32(max(cap, limit)),
 		blocks:   make([]*HeapBlock, 0),
 		blockmap: make(map[HeapHandle]*HeapBlock),
 		next:     1,
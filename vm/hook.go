@@ -0,0 +1,97 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/canpacis/flint/common"
+)
+
+type Hook interface {
+	BeforeInstruction(e *Executor, frame *Frame, code common.OpCode, operands []int)
+	AfterInstruction(e *Executor, frame *Frame, code common.OpCode, operands []int, err error)
+	OnCall(e *Executor, frame *Frame)
+	OnReturn(e *Executor, frame *Frame, value *common.Const)
+	OnTrap(e *Executor, reason string)
+	OnBuiltinCall(e *Executor, fn *BuiltinFn, args []*common.Const, result *common.Const, err error)
+}
+
+// NopHook can be embedded to implement only the callbacks a hook needs
+type NopHook struct{}
+
+func (NopHook) BeforeInstruction(*Executor, *Frame, common.OpCode, []int)       {}
+func (NopHook) AfterInstruction(*Executor, *Frame, common.OpCode, []int, error) {}
+func (NopHook) OnCall(*Executor, *Frame)                                        {}
+func (NopHook) OnReturn(*Executor, *Frame, *common.Const)                       {}
+func (NopHook) OnTrap(*Executor, string)                                        {}
+func (NopHook) OnBuiltinCall(*Executor, *BuiltinFn, []*common.Const, *common.Const, error) {
+}
+
+type Tracer struct {
+	w     io.Writer
+	depth int
+}
+
+func (t *Tracer) printf(e *Executor, format string, args ...any) {
+	indent := strings.Repeat("  ", max(e.frames.Len()-1, 0))
+	fmt.Fprintf(t.w, indent+format+"\n", args...)
+}
+
+func (t *Tracer) top(e *Executor) string {
+	n := min(e.stack.Len(), t.depth)
+	values := make([]string, n)
+	for i := range n {
+		constant, _ := e.stack.Get(e.stack.Len() - 1 - i)
+		values[i] = fmt.Sprintf("%v", constant)
+	}
+	return "[" + strings.Join(values, " ") + "]"
+}
+
+func (t *Tracer) BeforeInstruction(*Executor, *Frame, common.OpCode, []int) {}
+
+func (t *Tracer) AfterInstruction(e *Executor, frame *Frame, code common.OpCode, operands []int, err error) {
+	ops := make([]string, len(operands))
+	for i, operand := range operands {
+		ops[i] = fmt.Sprintf("%d", operand)
+	}
+	instruction := strings.TrimSpace(code.String() + " " + strings.Join(ops, " "))
+	if err != nil {
+		t.printf(e, "%s+%04d %-24s error: %s", frame, frame.pc, instruction, err)
+		return
+	}
+	t.printf(e, "%s+%04d %-24s %s", frame, frame.pc, instruction, t.top(e))
+}
+
+func (t *Tracer) OnCall(e *Executor, frame *Frame) {
+	t.printf(e, "call %s", frame)
+}
+
+func (t *Tracer) OnReturn(e *Executor, frame *Frame, value *common.Const) {
+	if value != nil {
+		t.printf(e, "return %s %v", frame, value)
+	} else {
+		t.printf(e, "return %s", frame)
+	}
+}
+
+func (t *Tracer) OnTrap(e *Executor, reason string) {
+	t.printf(e, "trap: %s", reason)
+}
+
+func (t *Tracer) OnBuiltinCall(e *Executor, fn *BuiltinFn, args []*common.Const, result *common.Const, err error) {
+	values := make([]string, len(args))
+	for i, arg := range args {
+		values[i] = fmt.Sprintf("%v", arg)
+	}
+	if err != nil {
+		t.printf(e, "builtin %s(%s) error: %s", fn.Name(), strings.Join(values, ", "), err)
+		return
+	}
+	t.printf(e, "builtin %s(%s) = %v", fn.Name(), strings.Join(values, ", "), result)
+}
+
+// Writes a trace line for every executed instruction with the top values of the stack
+func NewTracer(w io.Writer) *Tracer {
+	return &Tracer{w: w, depth: 3}
+}
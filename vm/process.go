@@ -1,28 +1,373 @@
 package vm
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"strings"
+
+	"github.com/canpacis/flint/vfs"
 )
 
+var ErrBadDescriptor = errors.New("bad descriptor")
+var ErrTooManyDescriptors = errors.New("too many open descriptors")
+var ErrWouldBlock = errors.New("operation would block")
+var ErrNoFilesystem = errors.New("no filesystem is available")
+
+// Returned by reads that have to wait for data, a thread calling a builtin that
+// returns it parks until Ready reports true and then retries the call
+type BlockedError struct {
+	Reason string
+	Ready  func() bool
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrWouldBlock, e.Reason)
+}
+
+func (e *BlockedError) Unwrap() error {
+	return ErrWouldBlock
+}
+
+type OpenMode int
+
+const (
+	OpenRead = OpenMode(iota)
+	// Creates or truncates the file
+	OpenWrite
+	// Creates the file or appends to it
+	OpenAppend
+)
+
+const MAX_DESCRIPTORS = 256
+
 type Processor interface {
 	Process() *Process
 }
 
+// Syscalls can only use ref buffers of processors with a heap
+type HeapProcessor interface {
+	Processor
+	Heap() *Heap
+}
+
+// An open file shared by every descriptor duplicated from it
+type file struct {
+	reader *bufio.Reader
+	writer io.Writer
+	closer io.Closer
+	// Reports whether a read that would block can make progress, nil if reads never block
+	ready func() bool
+	refs  int
+}
+
+// Turns a read that would block before reading anything into a BlockedError
+func (f *file) block(fd, n int, err error) error {
+	if n == 0 && f.ready != nil && errors.Is(err, ErrWouldBlock) {
+		return &BlockedError{Reason: fmt.Sprintf("read descriptor %d", fd), Ready: f.ready}
+	}
+	return err
+}
+
+// A process owns a descriptor table shared by reads and writes. Stdin, stdout and
+// stderr are descriptors 0, 1 and 2, host streams are added with Open
 type Process struct {
-	ReadDescriptors  *Stack[io.Reader]
-	WriteDescriptors *Stack[io.Writer]
+	Args        []string
+	Env         map[string]string
+	descriptors []*file
+	fs          vfs.FS
+}
+
+// Sets the filesystem file syscalls work on, use a vfs.Sandbox to confine programs
+func (p *Process) SetFS(fsys vfs.FS) {
+	p.fs = fsys
+}
+
+func (p *Process) FS() vfs.FS {
+	return p.fs
+}
+
+func (p *Process) filesystem(name string) (string, error) {
+	if p.fs == nil {
+		return "", ErrNoFilesystem
+	}
+	return vfs.Clean(name)
+}
+
+// Opens a file of the filesystem as a descriptor
+func (p *Process) OpenFile(name string, mode OpenMode) (int, error) {
+	name, err := p.filesystem(name)
+	if err != nil {
+		return -1, err
+	}
+	switch mode {
+	case OpenRead:
+		f, err := p.fs.Open(name)
+		if err != nil {
+			return -1, err
+		}
+		info, err := f.Stat()
+		if err == nil && info.IsDir() {
+			f.Close()
+			return -1, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+		}
+		return p.Open(f, nil)
+	case OpenWrite, OpenAppend:
+		w, err := p.fs.OpenWriter(name, mode == OpenAppend)
+		if err != nil {
+			return -1, err
+		}
+		return p.install(&file{writer: w, closer: w})
+	default:
+		return -1, fmt.Errorf("invalid open mode %d", mode)
+	}
+}
+
+func (p *Process) Stat(name string) (fs.FileInfo, error) {
+	name, err := p.filesystem(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Stat(p.fs, name)
+}
+
+// Opens a descriptor listing the entries of a directory one per line,
+// directories end with a slash
+func (p *Process) ReadDir(name string) (int, error) {
+	name, err := p.filesystem(name)
+	if err != nil {
+		return -1, err
+	}
+	entries, err := fs.ReadDir(p.fs, name)
+	if err != nil {
+		return -1, err
+	}
+	var listing strings.Builder
+	for _, entry := range entries {
+		listing.WriteString(entry.Name())
+		if entry.IsDir() {
+			listing.WriteString("/")
+		}
+		listing.WriteString("\n")
+	}
+	return p.Open(strings.NewReader(listing.String()), nil)
+}
+
+func (p *Process) Remove(name string) error {
+	name, err := p.filesystem(name)
+	if err != nil {
+		return err
+	}
+	return p.fs.Remove(name)
+}
+
+func (p *Process) get(fd int) (*file, error) {
+	if fd < 0 || fd >= len(p.descriptors) || p.descriptors[fd] == nil {
+		return nil, fmt.Errorf("%w %d", ErrBadDescriptor, fd)
+	}
+	return p.descriptors[fd], nil
+}
+
+func (p *Process) free(from int) (int, error) {
+	for fd := from; fd < MAX_DESCRIPTORS; fd++ {
+		if fd >= len(p.descriptors) {
+			p.descriptors = append(p.descriptors, make([]*file, fd-len(p.descriptors)+1)...)
+		}
+		if p.descriptors[fd] == nil {
+			return fd, nil
+		}
+	}
+	return -1, ErrTooManyDescriptors
+}
+
+func (p *Process) install(f *file) (int, error) {
+	fd, err := p.free(0)
+	if err != nil {
+		return fd, err
+	}
+	f.refs++
+	p.descriptors[fd] = f
+	return fd, nil
+}
+
+// Opens a descriptor for host streams, either of r and w may be nil to open the
+// descriptor read or write only. The writer, or the reader if it is the only one
+// that implements io.Closer, is closed with the last descriptor that refers to it
+func (p *Process) Open(r io.Reader, w io.Writer) (int, error) {
+	if r == nil && w == nil {
+		return -1, errors.New("cannot open a descriptor without a reader or a writer")
+	}
+	f := &file{writer: w}
+	if r != nil {
+		f.reader = bufio.NewReader(r)
+	}
+	if c, ok := w.(io.Closer); ok {
+		f.closer = c
+	} else if c, ok := r.(io.Closer); ok {
+		f.closer = c
+	}
+	return p.install(f)
+}
+
+// Opens a readable and writable in-memory buffer holding data
+func (p *Process) OpenBuffer(data []byte) (int, error) {
+	buf := bytes.NewBuffer(data)
+	return p.Open(buf, buf)
+}
+
+func (p *Process) Close(fd int) error {
+	f, err := p.get(fd)
+	if err != nil {
+		return err
+	}
+	p.descriptors[fd] = nil
+	f.refs--
+	if f.refs == 0 && f.closer != nil {
+		return f.closer.Close()
+	}
+	return nil
+}
+
+// Returns a new descriptor referring to the same stream as fd
+func (p *Process) Dup(fd int) (int, error) {
+	f, err := p.get(fd)
+	if err != nil {
+		return -1, err
+	}
+	return p.install(f)
+}
+
+// Opens an in-memory pipe, the write end is always the descriptor after the read end.
+// Reading an empty pipe returns a BlockedError until it is written to or its write end is closed
+func (p *Process) Pipe() (int, int, error) {
+	for fd := 0; ; fd++ {
+		r, err := p.free(fd)
+		if err != nil {
+			return -1, -1, err
+		}
+		w, err := p.free(r + 1)
+		if err != nil {
+			return -1, -1, err
+		}
+		if w != r+1 {
+			fd = r
+			continue
+		}
+
+		pipe := &pipe{}
+		ready := func() bool { return pipe.buf.Len() > 0 || pipe.closed }
+		p.descriptors[r] = &file{reader: bufio.NewReader(&pipeReader{pipe}), ready: ready, refs: 1}
+		p.descriptors[w] = &file{writer: &pipeWriter{pipe}, closer: &pipeWriter{pipe}, refs: 1}
+		return r, w, nil
+	}
+}
+
+func (p *Process) Read(fd int, b []byte) (int, error) {
+	f, err := p.get(fd)
+	if err != nil {
+		return 0, err
+	}
+	if f.reader == nil {
+		return 0, fmt.Errorf("%w %d: descriptor is not readable", ErrBadDescriptor, fd)
+	}
+	n, err := f.reader.Read(b)
+	return n, f.block(fd, n, err)
+}
+
+// Reads until a new line, which is included, or until b is full. A pipe that runs
+// empty ends the line early, it only blocks if nothing was read
+func (p *Process) ReadLine(fd int, b []byte) (int, error) {
+	f, err := p.get(fd)
+	if err != nil {
+		return 0, err
+	}
+	if f.reader == nil {
+		return 0, fmt.Errorf("%w %d: descriptor is not readable", ErrBadDescriptor, fd)
+	}
+	n := 0
+	for n < len(b) {
+		c, err := f.reader.ReadByte()
+		if err != nil {
+			return n, f.block(fd, n, err)
+		}
+		b[n] = c
+		n++
+		if c == '\n' {
+			break
+		}
+	}
+	return n, nil
+}
+
+func (p *Process) Write(fd int, b []byte) (int, error) {
+	f, err := p.get(fd)
+	if err != nil {
+		return 0, err
+	}
+	if f.writer == nil {
+		return 0, fmt.Errorf("%w %d: descriptor is not writable", ErrBadDescriptor, fd)
+	}
+	return f.writer.Write(b)
+}
+
+type pipe struct {
+	buf    bytes.Buffer
+	closed bool
+}
+
+type pipeReader struct {
+	pipe *pipe
+}
+
+func (r *pipeReader) Read(b []byte) (int, error) {
+	if r.pipe.buf.Len() == 0 {
+		if r.pipe.closed {
+			return 0, io.EOF
+		}
+		return 0, ErrWouldBlock
+	}
+	return r.pipe.buf.Read(b)
+}
+
+type pipeWriter struct {
+	pipe *pipe
+}
+
+func (w *pipeWriter) Write(b []byte) (int, error) {
+	if w.pipe.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return w.pipe.buf.Write(b)
+}
+
+func (w *pipeWriter) Close() error {
+	w.pipe.closed = true
+	return nil
 }
 
 func NewProcess() *Process {
+	return NewProcessWithIO(os.Stdin, os.Stdout, os.Stderr)
+}
+
+// Creates a process with stdin, stdout and stderr on descriptors 0, 1 and 2,
+// nil streams leave their descriptors closed
+func NewProcessWithIO(stdin io.Reader, stdout io.Writer, stderr io.Writer) *Process {
 	p := &Process{
-		ReadDescriptors:  NewStack[io.Reader](255),
-		WriteDescriptors: NewStack[io.Writer](255),
+		descriptors: make([]*file, 3),
 	}
 
-	p.WriteDescriptors.Push(nil)
-	p.WriteDescriptors.Push(os.Stdout)
-	p.ReadDescriptors.Push(nil)
-	p.ReadDescriptors.Push(os.Stdin)
+	if stdin != nil {
+		p.descriptors[0] = &file{reader: bufio.NewReader(stdin), refs: 1}
+	}
+	if stdout != nil {
+		p.descriptors[1] = &file{writer: stdout, refs: 1}
+	}
+	if stderr != nil {
+		p.descriptors[2] = &file{writer: stderr, refs: 1}
+	}
 	return p
 }
@@ -0,0 +1,126 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInterrupted = errors.New("execution interrupted")
+var ErrDeadlock = errors.New("deadlock")
+
+// Number of instructions executed between context checks
+const CONTEXT_CHECK_INTERVAL = 1024
+
+// Number of instructions a thread runs before the scheduler switches to the next one
+const QUANTUM = 128
+
+// Runs the program like RunContext, Starved reports whether it stopped for lack of fuel
+func (vm *VM) Run() {
+	vm.RunContext(context.Background())
+}
+
+// Runs the threads of the program round robin until the main thread yields, finishes or traps.
+// Returns ErrOutOfFuel when the fuel runs out or ErrInterrupted when ctx is done,
+// in both cases the program can be continued with another call
+func (vm *VM) RunContext(ctx context.Context) error {
+	done := ctx.Done()
+	for i := 0; vm.alive(); i++ {
+		if done != nil && i%CONTEXT_CHECK_INTERVAL == 0 {
+			select {
+			case <-done:
+				return fmt.Errorf("%w: %w", ErrInterrupted, ctx.Err())
+			default:
+			}
+		}
+		vm.Step()
+	}
+	if vm.starved {
+		return ErrOutOfFuel
+	}
+	return nil
+}
+
+// Executes one instruction of the thread the scheduler picks and returns that thread,
+// nil when the program is not running. A deadlock traps and returns the main thread
+func (vm *VM) Step() *Executor {
+	if !vm.alive() {
+		return nil
+	}
+	thread := vm.next()
+	if thread == nil {
+		vm.deadlock()
+		return vm.thread
+	}
+	thread.Step()
+	vm.slice++
+	return thread
+}
+
+// Reports whether the program can make progress, see RunContext for when it stops
+func (vm *VM) Running() bool {
+	return vm.alive()
+}
+
+// The program runs as long as its main thread does, other threads are abandoned when it stops
+func (vm *VM) alive() bool {
+	main := vm.thread
+	return !vm.halted && !vm.starved && !main.done && !main.paused && !main.paniced
+}
+
+func (vm *VM) runnable(thread *Executor) bool {
+	if thread.parked() {
+		return false
+	}
+	// Only the main thread suspends to the host, other threads just give up their turn
+	if thread.paused && !thread.main() && !thread.exited() {
+		thread.paused = false
+	}
+	return thread.Running()
+}
+
+// Picks the thread to run the next instruction
+func (vm *VM) next() *Executor {
+	current := vm.threads[vm.current]
+	if vm.slice < QUANTUM && !current.paused && vm.runnable(current) {
+		return current
+	}
+	vm.slice = 0
+	for i := 1; i <= len(vm.threads); i++ {
+		idx := (vm.current + i) % len(vm.threads)
+		if thread := vm.threads[idx]; vm.runnable(thread) {
+			vm.current = idx
+			return thread
+		}
+	}
+	return nil
+}
+
+// Traps the main thread when every live thread is parked
+func (vm *VM) deadlock() {
+	report := []string{}
+	for _, thread := range vm.threads {
+		if thread.State() == StateBlocked {
+			report = append(report, fmt.Sprintf("thread %d blocked on %s", thread.id, thread.blocked))
+		}
+	}
+	main := vm.thread
+	main.wake = nil
+	main.blocked = ""
+	main.fail(fmt.Errorf("%w: %s", ErrDeadlock, strings.Join(report, ", ")))
+}
+
+func (vm *VM) spawn() *Executor {
+	thread := NewExecutor(vm)
+	thread.id = len(vm.threads)
+	vm.threads = append(vm.threads, thread)
+	return thread
+}
+
+func (vm *VM) lookup(id int) (*Executor, error) {
+	if id < 0 || id >= len(vm.threads) {
+		return nil, fmt.Errorf("%w: no such thread %d", ErrInvalidThread, id)
+	}
+	return vm.threads[id], nil
+}
@@ -12,6 +12,8 @@ var ErrStackUnderflow = errors.New("stack underflow")
 type Stack[T any] struct {
 	data    []T
 	pointer int
+	// Returned instead of ErrStackOverflow when a push exceeds the stack size
+	overflow error
 }
 
 func (s *Stack[T]) Top() (T, error) {
@@ -37,8 +39,15 @@ func (s *Stack[T]) Len() int {
 	return s.pointer
 }
 
+func (s *Stack[T]) Cap() int {
+	return len(s.data)
+}
+
 func (s *Stack[T]) Push(value T) error {
 	if s.pointer >= len(s.data) {
+		if s.overflow != nil {
+			return s.overflow
+		}
 		return ErrStackOverflow
 	}
 	s.data[s.pointer] = value
@@ -25,6 +25,20 @@ func GetData(c *common.Const) ([]byte, error) {
 	return v, nil
 }
 
+func GetRef(c *common.Const) (HeapHandle, error) {
+	if c.Type != common.RefConst {
+		return 0, fmt.Errorf("%w: expected ref found %s", ErrConstTypeInvalid, c.Type)
+	}
+	switch v := c.Value.(type) {
+	case uint32:
+		return HeapHandle(v), nil
+	case uint64:
+		return HeapHandle(v), nil
+	default:
+		return 0, fmt.Errorf("%w: expected ref found %T", ErrConstTypeInvalid, c.Value)
+	}
+}
+
 func GetI64(c *common.Const) (int64, error) {
 	n, ok := c.Value.(int64)
 	if !ok || c.Type != common.I64Const {
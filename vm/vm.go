@@ -1,24 +1,128 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
 
 	"github.com/canpacis/flint/common"
 )
 
+var ErrOutOfFuel = errors.New("out of fuel")
+
 type VM struct {
+	config   Config
+	allowed  map[string]bool
 	heap     *Heap
 	process  *Process
 	thread   *Executor
+	threads  []*Executor
+	channels []*Channel
+	current  int
+	slice    int
 	builtins *Builtins
 	archive  *common.Archive
+	hooks    []Hook
+	hookids  []HookID
+	nexthook HookID
+	metered  bool
+	fuel     uint64
+	costs    [256]uint64
+	starved  bool
 	halted   bool
+	code     int
 	paniced  bool
 	panicmsg string
+	err      error
+}
+
+// Resumes a suspended program with value and runs it until it yields again, finishes or traps
+func (vm *VM) Resume(value *common.Const) error {
+	if err := vm.thread.Resume(value); err != nil {
+		return err
+	}
+	vm.Run()
+	return nil
+}
+
+func (vm *VM) State() State {
+	return vm.thread.State()
+}
+
+// Enables fuel metering, every executed instruction consumes its cost from the fuel
+func (vm *VM) SetFuel(fuel uint64) {
+	vm.metered = true
+	vm.fuel = fuel
+	vm.starved = false
+}
+
+func (vm *VM) AddFuel(fuel uint64) {
+	vm.SetFuel(vm.fuel + fuel)
+}
+
+func (vm *VM) Fuel() uint64 {
+	return vm.fuel
+}
+
+// Reports whether the program stopped because it ran out of fuel, adding fuel lets it continue
+func (vm *VM) Starved() bool {
+	return vm.starved
+}
+
+func (vm *VM) DisableFuel() {
+	vm.metered = false
+	vm.starved = false
+}
+
+func (vm *VM) SetCost(code common.OpCode, cost uint64) {
+	vm.costs[code] = cost
+}
+
+func (vm *VM) Cost(code common.OpCode) uint64 {
+	return vm.costs[code]
+}
+
+// Identifies a registered hook, hooks of any type can be removed by it
+type HookID int
+
+func (vm *VM) AddHook(hook Hook) HookID {
+	vm.nexthook++
+	vm.hooks = append(vm.hooks, hook)
+	vm.hookids = append(vm.hookids, vm.nexthook)
+	return vm.nexthook
+}
+
+func (vm *VM) removeHook(i int) {
+	vm.hooks = append(vm.hooks[:i], vm.hooks[i+1:]...)
+	vm.hookids = append(vm.hookids[:i], vm.hookids[i+1:]...)
+}
+
+// Removes the first registration of hook. Hooks of types that cannot be compared,
+// like structs holding slices, are only removed by RemoveHookID
+func (vm *VM) RemoveHook(hook Hook) {
+	for i, h := range vm.hooks {
+		if sameHook(h, hook) {
+			vm.removeHook(i)
+			return
+		}
+	}
+}
+
+func (vm *VM) RemoveHookID(id HookID) {
+	for i, h := range vm.hookids {
+		if h == id {
+			vm.removeHook(i)
+			return
+		}
+	}
 }
 
-func (vm *VM) Run() {
-	vm.thread.Run()
+func sameHook(a, b Hook) bool {
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	if ta != tb || !ta.Comparable() {
+		return false
+	}
+	return a == b
 }
 
 func (vm *VM) Halted() bool {
@@ -33,13 +137,92 @@ func (vm *VM) PanicMessage() string {
 	return vm.panicmsg
 }
 
+// Exit status reported for a program that trapped
+const EXIT_PANIC = 2
+
+type Result struct {
+	// Value returned by main, nil if main returned nothing or the program halted
+	Value *common.Const
+	// Exit status of the program, the code halt.code popped, the integer returned by main,
+	// or EXIT_PANIC if the program trapped
+	Code     int
+	Paniced  bool
+	Finished bool
+}
+
+// Reports how the program ended, Finished is false while it can still run
+func (vm *VM) Result() Result {
+	result := Result{Code: vm.code}
+	switch vm.State() {
+	case StateTrapped:
+		result.Finished = true
+		result.Paniced = true
+		result.Code = EXIT_PANIC
+	case StateFinished:
+		result.Finished = true
+		result.Value = unwrap(vm.thread.result)
+		if result.Value != nil && !vm.halted {
+			if code, err := GetI64(result.Value); err == nil {
+				result.Code = int(code)
+			}
+		}
+	}
+	return result
+}
+
+// Returns the error that caused the program to trap, if any
+func (vm *VM) Err() error {
+	return vm.err
+}
+
+func (vm *VM) Config() Config {
+	return vm.config
+}
+
+// Returns the main thread
+func (vm *VM) Thread() *Executor {
+	return vm.thread
+}
+
+// Returns every thread started by the program, the main thread first
+func (vm *VM) Threads() []*Executor {
+	return vm.threads
+}
+
+func (vm *VM) Heap() *Heap {
+	return vm.heap
+}
+
+func (vm *VM) Archive() *common.Archive {
+	return vm.archive
+}
+
 func (vm *VM) Process() *Process {
 	return vm.process
 }
 
-func (vm *VM) Init(archive *common.Archive, builtins *Builtins) error {
+type InitOption func(*VM)
+
+// Sets the program arguments, read with the argc and argv builtins
+func WithArgs(args ...string) InitOption {
+	return func(vm *VM) {
+		vm.process.Args = args
+	}
+}
+
+// Sets the program environment, read with the getenv builtin
+func WithEnv(env map[string]string) InitOption {
+	return func(vm *VM) {
+		vm.process.Env = env
+	}
+}
+
+func (vm *VM) Init(archive *common.Archive, builtins *Builtins, options ...InitOption) error {
 	vm.archive = archive
 	vm.builtins = builtins
+	for _, option := range options {
+		option(vm)
+	}
 	main, err := archive.MainModule()
 	if err != nil {
 		return fmt.Errorf("failed to find main module in archive: %w", err)
@@ -52,8 +235,10 @@ func (vm *VM) Init(archive *common.Archive, builtins *Builtins) error {
 	if err != nil {
 		return err
 	}
-	frame := NewFrame(fn, main, 0)
+	_, pointer := archive.Entry()
+	frame := newFrame(fn, main, pointer, 0)
 	vm.thread = NewExecutor(vm)
+	vm.threads = []*Executor{vm.thread}
 	return vm.thread.frames.Push(frame)
 }
 
@@ -61,14 +246,31 @@ func (vm *VM) halt() {
 	vm.halted = true
 }
 
+func (vm *VM) exit(code int) {
+	vm.code = code
+	vm.halt()
+}
+
 func (vm *VM) panic(msg string) {
 	vm.panicmsg = msg
 	vm.paniced = true
 }
 
 func NewVM() *VM {
-	return &VM{
-		heap:    NewHeap(256),
-		process: NewProcess(),
+	return NewVMWithConfig(DefaultConfig())
+}
+
+func NewVMWithConfig(config Config) *VM {
+	config = config.withDefaults()
+	vm := &VM{
+		config:  config,
+		allowed: config.allowed(),
+		heap:    NewGrowingHeap(config.HeapSize, config.MaxHeapSize),
+		process: NewProcessWithIO(config.Stdin, config.Stdout, config.Stderr),
+	}
+	vm.process.SetFS(config.FS)
+	for i := range vm.costs {
+		vm.costs[i] = 1
 	}
+	return vm
 }
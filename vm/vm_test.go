@@ -2,11 +2,20 @@ package vm_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"math"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/canpacis/flint/common"
 	"github.com/canpacis/flint/compiler"
+	"github.com/canpacis/flint/vfs"
 	"github.com/canpacis/flint/vm"
 	"github.com/stretchr/testify/assert"
 )
@@ -426,9 +435,13 @@ func TestCall(t *testing.T) {
 }
 
 func SetupMachine(t *testing.T, mod *common.Module, builtins *vm.Builtins, fn *common.Const) *vm.VM {
+	return SetupConfiguredMachine(t, vm.DefaultConfig(), mod, builtins, fn)
+}
+
+func SetupConfiguredMachine(t *testing.T, config vm.Config, mod *common.Module, builtins *vm.Builtins, fn *common.Const) *vm.VM {
 	assert := assert.New(t)
 
-	machine := vm.NewVM()
+	machine := vm.NewVMWithConfig(config)
 	if builtins == nil {
 		builtins = vm.DefaultBuiltins(machine)
 	}
@@ -436,7 +449,7 @@ func SetupMachine(t *testing.T, mod *common.Module, builtins *vm.Builtins, fn *c
 	assert.NoError(err)
 
 	archive := common.NewArchive()
-	modidx, err := archive.Modules.Set(compiler.POOL_WRITE_LIMIT, mod)
+	modidx, err := archive.AddModule(mod)
 	assert.NoError(err)
 	archive.SetEntry(modidx, fnidx)
 	assert.NoError(machine.Init(archive, builtins))
@@ -510,8 +523,8 @@ func TestSyscall(t *testing.T) {
 
 	buf := new(bytes.Buffer)
 	process := machine.Process()
-	assert.NoError(process.WriteDescriptors.Push(buf))
-	bufidx := process.WriteDescriptors.Len() - 1
+	bufidx, err := process.Open(nil, buf)
+	assert.NoError(err)
 
 	mod := common.NewModule("main", common.NewVersion(0, 0, 1))
 	msg, err := mod.Consts.Set(0, common.NewConst(common.DataConst, []byte("Hello, World!\n")))
@@ -532,7 +545,7 @@ func TestSyscall(t *testing.T) {
 	assert.NoError(err)
 
 	archive := common.NewArchive()
-	modidx, err := archive.Modules.Set(compiler.POOL_WRITE_LIMIT, mod)
+	modidx, err := archive.AddModule(mod)
 	assert.NoError(err)
 	archive.SetEntry(modidx, fnidx)
 	assert.NoError(machine.Init(archive, builtins))
@@ -543,3 +556,1455 @@ func TestSyscall(t *testing.T) {
 	assert.Equal(false, machine.Paniced(), machine.PanicMessage())
 	assert.Equal("Hello, World!\n", buf.String(), "Buffer")
 }
+
+type CountingHook struct {
+	vm.NopHook
+	Before   int
+	After    int
+	Calls    []string
+	Returns  []string
+	Builtins []string
+	Traps    []string
+}
+
+func (h *CountingHook) BeforeInstruction(e *vm.Executor, frame *vm.Frame, code common.OpCode, operands []int) {
+	h.Before++
+}
+
+func (h *CountingHook) AfterInstruction(e *vm.Executor, frame *vm.Frame, code common.OpCode, operands []int, err error) {
+	h.After++
+}
+
+func (h *CountingHook) OnCall(e *vm.Executor, frame *vm.Frame) {
+	h.Calls = append(h.Calls, frame.String())
+}
+
+func (h *CountingHook) OnReturn(e *vm.Executor, frame *vm.Frame, value *common.Const) {
+	h.Returns = append(h.Returns, frame.String())
+}
+
+func (h *CountingHook) OnBuiltinCall(e *vm.Executor, fn *vm.BuiltinFn, args []*common.Const, result *common.Const, err error) {
+	h.Builtins = append(h.Builtins, fn.Name())
+}
+
+func (h *CountingHook) OnTrap(e *vm.Executor, reason string) {
+	h.Traps = append(h.Traps, reason)
+}
+
+func TestHooks(t *testing.T) {
+	assert := assert.New(t)
+
+	mod := common.NewModule("main", common.NewVersion(0, 0, 1))
+	add, err := mod.Consts.Set(0, Add())
+	assert.NoError(err)
+
+	builtins := vm.NewBuiltins()
+	builtins.Register("panic", vm.CreatePanic())
+	builtins.Register("builtin", Builtin())
+
+	var set common.Instructions
+	set = append(set, common.NewOp(common.OpLoadI64, 5)...)
+	set = append(set, common.NewOp(common.OpLoadI64, 7)...)
+	set = append(set, common.NewOp(common.OpLoadConst, add)...)
+	set = append(set, common.NewOp(common.OpCall, 2)...)
+	set = append(set, common.NewOp(common.OpLoadBuiltin, builtins.Get("builtin"))...)
+	set = append(set, common.NewOp(common.OpCall, 0)...)
+	set = append(set, common.NewOp(common.OpDivI64)...)
+	fn := common.NewConst(common.FnConst, common.NewCompiledFn("main", 0, set))
+
+	machine := SetupMachine(t, mod, builtins, fn)
+	hook := &CountingHook{}
+	machine.AddHook(hook)
+	trace := new(bytes.Buffer)
+	tracer := vm.NewTracer(trace)
+	machine.AddHook(tracer)
+	machine.Run()
+
+	assert.True(machine.Halted())
+	// main (7), add (4), builtin (1), panic (1)
+	assert.Equal(13, hook.Before)
+	assert.Equal(hook.Before, hook.After)
+	assert.Equal([]string{"add", "builtin", "panic"}, hook.Calls)
+	assert.Equal([]string{"add", "builtin"}, hook.Returns)
+	assert.Equal([]string{"builtin"}, hook.Builtins)
+	assert.Len(hook.Traps, 1)
+	assert.Contains(hook.Traps[0], "div.i64")
+
+	output := trace.String()
+	assert.Contains(output, "main+0000 load.i64 5")
+	assert.Contains(output, "[<i64 7> <i64 5>]")
+	assert.Contains(output, "call add")
+	assert.Contains(output, "  add+0010 add.i64                  [<i64 12> <i64 7> <i64 5>]")
+	assert.Contains(output, "return add <i64 12>")
+	assert.Contains(output, "builtin builtin() = <nil>")
+	assert.Contains(output, "div.i64                  error: constant type is invalid")
+
+	machine.RemoveHook(tracer)
+	machine.RemoveHook(hook)
+
+	// Hooks that cannot be compared are removed by their id
+	type SliceHook struct {
+		vm.NopHook
+		Seen []common.OpCode
+	}
+	id := machine.AddHook(SliceHook{})
+	machine.AddHook(hook)
+	assert.NotPanics(func() { machine.RemoveHook(SliceHook{}) })
+	machine.RemoveHookID(id)
+	machine.RemoveHook(hook)
+	before := hook.Before
+	assert.NoError(machine.Init(machine.Archive(), builtins))
+	machine.Run()
+	assert.Equal(before, hook.Before)
+}
+
+// Builds a machine running n pairs of `load.i64 1; pop` before it halts
+func SetupPairs(t *testing.T, n int) *vm.VM {
+	mod := common.NewModule("main", common.NewVersion(0, 0, 1))
+
+	var set common.Instructions
+	for range n {
+		set = append(set, common.NewOp(common.OpLoadI64, 1)...)
+		set = append(set, common.NewOp(common.OpPop)...)
+	}
+	set = append(set, common.NewOp(common.OpHalt)...)
+	fn := common.NewConst(common.FnConst, common.NewCompiledFn("main", 0, set))
+
+	return SetupMachine(t, mod, nil, fn)
+}
+
+func TestFuel(t *testing.T) {
+	assert := assert.New(t)
+
+	pair := len(common.NewOp(common.OpLoadI64, 1)) + len(common.NewOp(common.OpPop))
+	machine := SetupPairs(t, 30)
+	machine.SetCost(common.OpPop, 3)
+	machine.SetFuel(100)
+
+	// 25 pairs of load (1) and pop (3)
+	assert.ErrorIs(machine.RunContext(context.Background()), vm.ErrOutOfFuel)
+	assert.Equal(uint64(0), machine.Fuel())
+	frame, err := machine.Thread().Frames().Top()
+	assert.NoError(err)
+	assert.Equal(25*pair, frame.IP())
+
+	machine.AddFuel(2)
+	assert.ErrorIs(machine.RunContext(context.Background()), vm.ErrOutOfFuel)
+	assert.Equal(uint64(1), machine.Fuel())
+	frame, err = machine.Thread().Frames().Top()
+	assert.NoError(err)
+	assert.Equal(25*pair+len(common.NewOp(common.OpLoadI64, 1)), frame.IP())
+
+	// Plain runs stop as well instead of spinning
+	machine.Run()
+	assert.False(machine.Halted())
+	assert.True(machine.Starved())
+	machine.AddFuel(1)
+	assert.False(machine.Starved())
+
+	machine.DisableFuel()
+	assert.NoError(machine.RunContext(context.Background()))
+	assert.True(machine.Halted())
+}
+
+func TestRunContext(t *testing.T) {
+	assert := assert.New(t)
+
+	machine := SetupPairs(t, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := machine.RunContext(ctx)
+	assert.ErrorIs(err, vm.ErrInterrupted)
+	assert.ErrorIs(err, context.Canceled)
+	frame, err := machine.Thread().Frames().Top()
+	assert.NoError(err)
+	assert.Equal(0, frame.IP())
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	err = machine.RunContext(ctx)
+	assert.ErrorIs(err, vm.ErrInterrupted)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+
+	// An interrupted program continues with another call
+	assert.NoError(machine.RunContext(context.Background()))
+	assert.True(machine.Halted())
+}
+
+func TestHeapGrowth(t *testing.T) {
+	assert := assert.New(t)
+
+	heap := vm.NewGrowingHeap(16, 64)
+	_, err := heap.Alloc(10)
+	assert.NoError(err)
+	_, err = heap.Alloc(20)
+	assert.NoError(err)
+	assert.Equal(32, heap.Cap())
+	_, err = heap.Alloc(30)
+	assert.NoError(err)
+	assert.Equal(64, heap.Cap())
+
+	_, err = heap.Alloc(10)
+	var limit *vm.LimitError
+	assert.ErrorAs(err, &limit)
+	assert.Equal(vm.HeapLimit, limit.Limit)
+	assert.Equal(64, limit.Max)
+	assert.ErrorIs(err, vm.ErrOutOfMemory)
+}
+
+func TestLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	type LimitTest struct {
+		Config        func(*vm.Config)
+		Instructions  func(recurse int) common.Instructions
+		ExpectedLimit vm.Limit
+		ExpectedMax   int
+	}
+
+	tests := []LimitTest{
+		{
+			Config: func(c *vm.Config) { c.StackSize = 16 },
+			Instructions: func(int) common.Instructions {
+				var set common.Instructions
+				for range 17 {
+					set = append(set, common.NewOp(common.OpLoadI64, 1)...)
+				}
+				return set
+			},
+			ExpectedLimit: vm.StackLimit,
+			ExpectedMax:   16,
+		},
+		{
+			Config: func(c *vm.Config) { c.CallDepth = 8 },
+			Instructions: func(recurse int) common.Instructions {
+				var set common.Instructions
+				set = append(set, common.NewOp(common.OpLoadConst, recurse)...)
+				set = append(set, common.NewOp(common.OpCall, 0)...)
+				set = append(set, common.NewOp(common.OpReturn)...)
+				return set
+			},
+			ExpectedLimit: vm.CallDepthLimit,
+			ExpectedMax:   8,
+		},
+		{
+			Config: func(c *vm.Config) { c.HeapSize, c.MaxHeapSize = 32, 128 },
+			Instructions: func(int) common.Instructions {
+				var set common.Instructions
+				for range 3 {
+					set = append(set, common.NewOp(common.OpAlloc, 48)...)
+				}
+				return set
+			},
+			ExpectedLimit: vm.HeapLimit,
+			ExpectedMax:   128,
+		},
+	}
+
+	for i, test := range tests {
+		config := vm.DefaultConfig()
+		test.Config(&config)
+
+		mod := common.NewModule("main", common.NewVersion(0, 0, 1))
+		// The function is the first constant of the module so it can load itself from pointer 0
+		fn := common.NewConst(common.FnConst, common.NewCompiledFn("main", 0, test.Instructions(0)))
+		machine := SetupConfiguredMachine(t, config, mod, nil, fn)
+		machine.Run()
+
+		assert.Truef(machine.Paniced(), "Test case %d", i)
+		var limit *vm.LimitError
+		if assert.ErrorAsf(machine.Err(), &limit, "Test case %d", i) {
+			assert.Equalf(test.ExpectedLimit, limit.Limit, "Test case %d", i)
+			assert.Equalf(test.ExpectedMax, limit.Max, "Test case %d", i)
+		}
+		assert.Containsf(machine.PanicMessage(), "limit of", "Test case %d", i)
+	}
+
+	// Limits that are not set are defaulted
+	defaults := vm.DefaultConfig()
+	config := vm.NewVMWithConfig(vm.Config{HeapSize: 1024}).Config()
+	assert.Equal(defaults.StackSize, config.StackSize)
+	assert.Equal(defaults.CallDepth, config.CallDepth)
+	assert.Equal(1024, config.HeapSize)
+	assert.Equal(1024, config.MaxHeapSize)
+	mod := common.NewModule("main", common.NewVersion(0, 0, 1))
+	set := common.NewOp(common.OpLoadI64, 1)
+	set = append(set, common.NewOp(common.OpHalt)...)
+	machine := SetupConfiguredMachine(t, vm.Config{}, mod, nil, common.NewConst(common.FnConst, common.NewCompiledFn("main", 0, set)))
+	machine.Run()
+	assert.False(machine.Paniced(), machine.PanicMessage())
+	assert.True(machine.Halted())
+}
+
+func TestSandbox(t *testing.T) {
+	assert := assert.New(t)
+
+	syscall := vm.DefaultBuiltins(vm.NewVM()).Get("syscall")
+	write := func(fd int) *common.Const {
+		var set common.Instructions
+		set = append(set, common.NewOp(common.OpLoadI64, int(vm.SyscallWrite))...)
+		set = append(set, common.NewOp(common.OpLoadI64, fd)...)
+		set = append(set, common.NewOp(common.OpLoadConst, 0)...)
+		set = append(set, common.NewOp(common.OpLoadBuiltin, syscall)...)
+		set = append(set, common.NewOp(common.OpCall, 3)...)
+		set = append(set, common.NewOp(common.OpHalt)...)
+		return common.NewConst(common.FnConst, common.NewCompiledFn("main", 0, set))
+	}
+	module := func() *common.Module {
+		mod := common.NewModule("main", common.NewVersion(0, 0, 1))
+		_, err := mod.Consts.Set(0, common.NewConst(common.DataConst, []byte("sandboxed")))
+		assert.NoError(err)
+		return mod
+	}
+
+	machine := SetupConfiguredMachine(t, vm.SandboxConfig(), module(), nil, write(1))
+	machine.Run()
+	assert.True(machine.Paniced())
+	assert.ErrorIs(machine.Err(), vm.ErrBuiltinNotAllowed)
+	assert.Contains(machine.PanicMessage(), "syscall")
+
+	config := vm.SandboxConfig()
+	config.Builtins = []string{"syscall"}
+	machine = SetupConfiguredMachine(t, config, module(), nil, write(1))
+	machine.Run()
+	assert.True(machine.Paniced())
+	assert.Contains(machine.PanicMessage(), "bad descriptor 1")
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	config.Stdout = stdout
+	config.Stderr = stderr
+	machine = SetupConfiguredMachine(t, config, module(), nil, write(2))
+	machine.Run()
+	assert.False(machine.Paniced(), machine.PanicMessage())
+	assert.Nil(machine.Err())
+	assert.Equal("", stdout.String())
+	assert.Equal("sandboxed", stderr.String())
+}
+
+func TestResume(t *testing.T) {
+	assert := assert.New(t)
+
+	var set common.Instructions
+	set = append(set, common.NewOp(common.OpLoadI64, 1)...)
+	set = append(set, common.NewOp(common.OpYield)...)
+	set = append(set, common.NewOp(common.OpAddI64)...)
+	set = append(set, common.NewOp(common.OpYield)...)
+	set = append(set, common.NewOp(common.OpAddI64)...)
+	set = append(set, common.NewOp(common.OpHalt)...)
+	setup := func() *vm.VM {
+		mod := common.NewModule("main", common.NewVersion(0, 0, 1))
+		return SetupMachine(t, mod, nil, common.NewConst(common.FnConst, common.NewCompiledFn("main", 0, set)))
+	}
+	top := func(machine *vm.VM) any {
+		constant, err := machine.Thread().Stack().Top()
+		assert.NoError(err)
+		return constant.Value
+	}
+
+	machine := setup()
+	assert.Equal(vm.StateRunnable, machine.State())
+	assert.ErrorIs(machine.Resume(nil), vm.ErrNotSuspended)
+
+	machine.Run()
+	assert.Equal(vm.StateSuspended, machine.State())
+	assert.Equal(int64(1), top(machine))
+
+	assert.NoError(machine.Resume(common.NewConst(common.I64Const, int64(2))))
+	assert.Equal(vm.StateSuspended, machine.State())
+	assert.Equal(int64(3), top(machine))
+
+	assert.NoError(machine.Resume(common.NewConst(common.I64Const, int64(4))))
+	assert.Equal(vm.StateFinished, machine.State())
+	assert.Equal(int64(7), top(machine))
+	assert.ErrorIs(machine.Resume(nil), vm.ErrNotSuspended)
+
+	machine = setup()
+	machine.Run()
+	assert.NoError(machine.Resume(common.NewConst(common.StrConst, "two")))
+	assert.Equal(vm.StateTrapped, machine.State())
+	assert.Equal("trapped", machine.State().String())
+}
+
+func Fn(name string, locals int, ops ...common.Instructions) *common.Const {
+	var set common.Instructions
+	for _, op := range ops {
+		set = append(set, op...)
+	}
+	return common.NewConst(common.FnConst, common.NewCompiledFn(name, locals, set))
+}
+
+func TestThreads(t *testing.T) {
+	assert := assert.New(t)
+
+	syscall := vm.DefaultBuiltins(vm.NewVM()).Get("syscall")
+	write := func() common.Instructions {
+		var set common.Instructions
+		set = append(set, common.NewOp(common.OpLoadI64, int(vm.SyscallWrite))...)
+		set = append(set, common.NewOp(common.OpLoadI64, 2)...)
+		set = append(set, common.NewOp(common.OpLoadLocal, 0)...)
+		set = append(set, common.NewOp(common.OpLoadBuiltin, syscall)...)
+		set = append(set, common.NewOp(common.OpCall, 3)...)
+		set = append(set, common.NewOp(common.OpPop)...)
+		return set
+	}
+
+	var add, a, b, writer, spinner, faulty, joiner int
+	module := func() *common.Module {
+		mod := common.NewModule("main", common.NewVersion(0, 0, 1))
+		set := func(c *common.Const) int {
+			idx, err := mod.Consts.Set(mod.Consts.Len()+1, c)
+			assert.NoError(err)
+			return idx
+		}
+		add = set(Add())
+		a = set(common.NewConst(common.DataConst, []byte("a")))
+		b = set(common.NewConst(common.DataConst, []byte("b")))
+		writer = set(Fn("writer", 1, write(), common.NewOp(common.OpYield), write(), common.NewOp(common.OpReturn)))
+		spinner = set(Fn("spinner", 0, bytes.Repeat(common.NewOp(common.OpNoop), 4*vm.QUANTUM), common.NewOp(common.OpReturn)))
+		faulty = set(Fn("faulty", 0,
+			common.NewOp(common.OpLoadI64, 1),
+			common.NewOp(common.OpLoadI64, 0),
+			common.NewOp(common.OpDivI64),
+			common.NewOp(common.OpReturnValue),
+		))
+		joiner = set(Fn("joiner", 0, common.NewOp(common.OpLoadI64, 0), common.NewOp(common.OpJoin), common.NewOp(common.OpReturn)))
+		return mod
+	}
+	module()
+
+	type ThreadTest struct {
+		Main           []common.Instructions
+		ExpectedTop    any
+		ExpectedOutput string
+		ExpectedError  error
+		ExpectedStates []vm.State
+	}
+
+	tests := []ThreadTest{
+		{
+			Main: []common.Instructions{
+				common.NewOp(common.OpLoadI64, 5),
+				common.NewOp(common.OpLoadI64, 7),
+				common.NewOp(common.OpLoadConst, add),
+				common.NewOp(common.OpSpawn, 2),
+				common.NewOp(common.OpJoin),
+				common.NewOp(common.OpHalt),
+			},
+			ExpectedTop:    int64(12),
+			ExpectedStates: []vm.State{vm.StateFinished, vm.StateFinished},
+		},
+		{
+			// Writers yield to each other between their writes
+			Main: []common.Instructions{
+				common.NewOp(common.OpLoadConst, a),
+				common.NewOp(common.OpLoadConst, writer),
+				common.NewOp(common.OpSpawn, 1),
+				common.NewOp(common.OpLoadConst, b),
+				common.NewOp(common.OpLoadConst, writer),
+				common.NewOp(common.OpSpawn, 1),
+				common.NewOp(common.OpSwap),
+				common.NewOp(common.OpJoin),
+				common.NewOp(common.OpJoin),
+				common.NewOp(common.OpLoadI64, 1),
+				common.NewOp(common.OpHalt),
+			},
+			ExpectedTop:    int64(1),
+			ExpectedOutput: "abab",
+		},
+		{
+			// The spinner never yields and is preempted after its quantum
+			Main: []common.Instructions{
+				common.NewOp(common.OpLoadConst, spinner),
+				common.NewOp(common.OpSpawn, 0),
+				common.NewOp(common.OpLoadConst, a),
+				common.NewOp(common.OpLoadConst, writer),
+				common.NewOp(common.OpSpawn, 1),
+				common.NewOp(common.OpJoin),
+				common.NewOp(common.OpHalt),
+			},
+			ExpectedTop:    int64(1),
+			ExpectedOutput: "aa",
+			ExpectedStates: []vm.State{vm.StateFinished, vm.StateFinished, vm.StateFinished},
+		},
+		{
+			// A trap only stops the faulty thread
+			Main: []common.Instructions{
+				common.NewOp(common.OpLoadConst, faulty),
+				common.NewOp(common.OpSpawn, 0),
+				common.NewOp(common.OpLoadConst, writer),
+				common.NewOp(common.OpLoadConst, a),
+				common.NewOp(common.OpSwap),
+				common.NewOp(common.OpSpawn, 1),
+				common.NewOp(common.OpJoin),
+				common.NewOp(common.OpHalt),
+			},
+			ExpectedTop:    int64(1),
+			ExpectedOutput: "aa",
+			ExpectedStates: []vm.State{vm.StateFinished, vm.StateTrapped, vm.StateFinished},
+		},
+		{
+			Main: []common.Instructions{
+				common.NewOp(common.OpLoadConst, faulty),
+				common.NewOp(common.OpSpawn, 0),
+				common.NewOp(common.OpJoin),
+				common.NewOp(common.OpHalt),
+			},
+			ExpectedError:  vm.ErrThreadTrapped,
+			ExpectedStates: []vm.State{vm.StateTrapped, vm.StateTrapped},
+		},
+		{
+			Main: []common.Instructions{
+				common.NewOp(common.OpLoadConst, joiner),
+				common.NewOp(common.OpSpawn, 0),
+				common.NewOp(common.OpJoin),
+				common.NewOp(common.OpHalt),
+			},
+			ExpectedError:  vm.ErrDeadlock,
+			ExpectedStates: []vm.State{vm.StateTrapped, vm.StateFinished},
+		},
+	}
+
+	for i, test := range tests {
+		config := vm.DefaultConfig()
+		stderr := new(bytes.Buffer)
+		config.Stderr = stderr
+		machine := SetupConfiguredMachine(t, config, module(), nil, Fn("main", 0, test.Main...))
+		machine.Run()
+
+		if test.ExpectedError != nil {
+			assert.Truef(machine.Paniced(), "Test case %d", i)
+			assert.ErrorIsf(machine.Err(), test.ExpectedError, "Test case %d", i)
+			if errors.Is(test.ExpectedError, vm.ErrDeadlock) {
+				assert.Containsf(machine.PanicMessage(), "thread 0 blocked on join thread 1, thread 1 blocked on join thread 0", "Test case %d", i)
+			}
+		} else {
+			assert.Falsef(machine.Paniced(), "Test case %d: %s", i, machine.PanicMessage())
+			top, err := machine.Thread().Stack().Top()
+			assert.NoErrorf(err, "Test case %d", i)
+			assert.Equalf(test.ExpectedTop, top.Value, "Test case %d", i)
+		}
+		assert.Equalf(test.ExpectedOutput, stderr.String(), "Test case %d", i)
+		if test.ExpectedStates != nil {
+			states := []vm.State{}
+			for _, thread := range machine.Threads() {
+				states = append(states, thread.State())
+			}
+			assert.Equalf(test.ExpectedStates, states, "Test case %d", i)
+		}
+	}
+}
+
+func TestChannels(t *testing.T) {
+	assert := assert.New(t)
+
+	var producer int
+	module := func() *common.Module {
+		mod := common.NewModule("main", common.NewVersion(0, 0, 1))
+		var err error
+		producer, err = mod.Consts.Set(0, Fn("producer", 1,
+			common.NewOp(common.OpLoadLocal, 0),
+			common.NewOp(common.OpLoadI64, 42),
+			common.NewOp(common.OpSend),
+			common.NewOp(common.OpLoadLocal, 0),
+			common.NewOp(common.OpLoadI64, 43),
+			common.NewOp(common.OpSend),
+			common.NewOp(common.OpLoadLocal, 0),
+			common.NewOp(common.OpClose),
+			common.NewOp(common.OpReturn),
+		))
+		assert.NoError(err)
+		return mod
+	}
+	module()
+
+	recv := []common.Instructions{common.NewOp(common.OpLoadLocal, 0), common.NewOp(common.OpRecv)}
+	send := func(n int) []common.Instructions {
+		return []common.Instructions{common.NewOp(common.OpLoadLocal, 0), common.NewOp(common.OpLoadI64, n), common.NewOp(common.OpSend)}
+	}
+	join := func(parts ...[]common.Instructions) []common.Instructions {
+		var set []common.Instructions
+		for _, part := range parts {
+			set = append(set, part...)
+		}
+		return set
+	}
+	i64 := func(n int64) *common.Const { return common.NewConst(common.I64Const, n) }
+	ok := common.NewConst(common.TrueConst, true)
+	nok := common.NewConst(common.FalseConst, false)
+
+	type ChannelTest struct {
+		Main          []common.Instructions
+		ExpectedStack []*common.Const
+		ExpectedError error
+		ExpectedPanic string
+	}
+
+	tests := []ChannelTest{
+		{
+			// Unbuffered channel fed by another thread until it is closed
+			Main: join(
+				[]common.Instructions{
+					common.NewOp(common.OpChan, 0),
+					common.NewOp(common.OpLoadLocal, 0),
+					common.NewOp(common.OpLoadConst, producer),
+					common.NewOp(common.OpSpawn, 1),
+					common.NewOp(common.OpPop),
+				},
+				recv, recv, recv,
+				[]common.Instructions{common.NewOp(common.OpHalt)},
+			),
+			ExpectedStack: []*common.Const{i64(0), i64(42), ok, i64(43), ok, nok, nok},
+		},
+		{
+			Main: join(
+				[]common.Instructions{common.NewOp(common.OpChan, 2)},
+				send(1), send(2),
+				[]common.Instructions{
+					common.NewOp(common.OpLoadLocal, 0),
+					common.NewOp(common.OpLoadI64, 3),
+					common.NewOp(common.OpTrySend),
+				},
+				recv,
+				[]common.Instructions{
+					common.NewOp(common.OpLoadLocal, 0),
+					common.NewOp(common.OpTryRecv),
+					common.NewOp(common.OpLoadLocal, 0),
+					common.NewOp(common.OpTryRecv),
+					common.NewOp(common.OpHalt),
+				},
+			),
+			ExpectedStack: []*common.Const{i64(0), nok, i64(1), ok, i64(2), ok, nok, nok},
+		},
+		{
+			Main: join(
+				[]common.Instructions{common.NewOp(common.OpChan, 0)},
+				recv,
+				[]common.Instructions{common.NewOp(common.OpHalt)},
+			),
+			ExpectedError: vm.ErrDeadlock,
+			ExpectedPanic: "deadlock: thread 0 blocked on receive on channel 0",
+		},
+		{
+			Main: join(
+				[]common.Instructions{common.NewOp(common.OpChan, 1)},
+				send(1), send(2),
+				[]common.Instructions{common.NewOp(common.OpHalt)},
+			),
+			ExpectedError: vm.ErrDeadlock,
+			ExpectedPanic: "deadlock: thread 0 blocked on send on channel 0",
+		},
+		{
+			Main: join(
+				[]common.Instructions{
+					common.NewOp(common.OpChan, 1),
+					common.NewOp(common.OpLoadLocal, 0),
+					common.NewOp(common.OpClose),
+				},
+				send(1),
+				[]common.Instructions{common.NewOp(common.OpHalt)},
+			),
+			ExpectedError: vm.ErrChannelClosed,
+			ExpectedPanic: "channel is closed: send on channel 0",
+		},
+	}
+
+	for i, test := range tests {
+		hook := &CountingHook{}
+		machine := SetupMachine(t, module(), nil, Fn("main", 0, test.Main...))
+		machine.AddHook(hook)
+		machine.Run()
+
+		if test.ExpectedError != nil {
+			assert.Truef(machine.Paniced(), "Test case %d", i)
+			assert.ErrorIsf(machine.Err(), test.ExpectedError, "Test case %d", i)
+			assert.Containsf(machine.PanicMessage(), test.ExpectedPanic, "Test case %d", i)
+			continue
+		}
+		assert.Falsef(machine.Paniced(), "Test case %d: %s", i, machine.PanicMessage())
+		stack := machine.Thread().Stack()
+		if assert.Equalf(len(test.ExpectedStack), stack.Len(), "Test case %d", i) {
+			for j, expected := range test.ExpectedStack {
+				actual, err := stack.Get(j)
+				assert.NoErrorf(err, "Test case %d", i)
+				assert.Equalf(expected.Type, actual.Type, "Test case %d value %d", i, j)
+				if expected.Type == common.I64Const {
+					assert.Equalf(expected.Value, actual.Value, "Test case %d value %d", i, j)
+				}
+			}
+		}
+		// Blocked threads are parked rather than retrying their instruction every step
+		assert.Lessf(hook.Before, 64, "Test case %d", i)
+	}
+}
+
+func TestResult(t *testing.T) {
+	assert := assert.New(t)
+
+	type ResultTest struct {
+		Main          []common.Instructions
+		ExpectedValue any
+		ExpectedCode  int
+		ExpectedPanic bool
+	}
+
+	tests := []ResultTest{
+		{
+			Main:          []common.Instructions{common.NewOp(common.OpLoadI64, 3), common.NewOp(common.OpReturnValue)},
+			ExpectedValue: int64(3),
+			ExpectedCode:  3,
+		},
+		{
+			Main:          []common.Instructions{common.NewOp(common.OpLoadU32, 3), common.NewOp(common.OpReturnValue)},
+			ExpectedValue: uint32(3),
+		},
+		{
+			Main: []common.Instructions{common.NewOp(common.OpReturn)},
+		},
+		{
+			Main:         []common.Instructions{common.NewOp(common.OpLoadI64, 7), common.NewOp(common.OpHaltCode)},
+			ExpectedCode: 7,
+		},
+		{
+			Main:          []common.Instructions{common.NewOp(common.OpHaltCode)},
+			ExpectedCode:  vm.EXIT_PANIC,
+			ExpectedPanic: true,
+		},
+	}
+
+	for i, test := range tests {
+		mod := common.NewModule("main", common.NewVersion(0, 0, 1))
+		machine := SetupMachine(t, mod, nil, Fn("main", 0, test.Main...))
+		assert.Falsef(machine.Result().Finished, "Test case %d", i)
+		machine.Run()
+
+		result := machine.Result()
+		assert.Truef(result.Finished, "Test case %d", i)
+		assert.Equalf(test.ExpectedPanic, result.Paniced, "Test case %d", i)
+		assert.Equalf(test.ExpectedCode, result.Code, "Test case %d", i)
+		if test.ExpectedValue == nil {
+			assert.Nilf(result.Value, "Test case %d", i)
+		} else if assert.NotNilf(result.Value, "Test case %d", i) {
+			assert.Equalf(test.ExpectedValue, result.Value.Value, "Test case %d", i)
+		}
+	}
+}
+
+type ClosingBuffer struct {
+	bytes.Buffer
+	Closed bool
+}
+
+func (b *ClosingBuffer) Close() error {
+	b.Closed = true
+	return nil
+}
+
+func TestProcess(t *testing.T) {
+	assert := assert.New(t)
+
+	process := vm.NewProcessWithIO(strings.NewReader("first\nsecond"), nil, nil)
+	buf := make([]byte, 4)
+
+	n, err := process.ReadLine(0, buf)
+	assert.NoError(err)
+	assert.Equal("firs", string(buf[:n]))
+	n, err = process.ReadLine(0, buf)
+	assert.NoError(err)
+	assert.Equal("t\n", string(buf[:n]))
+	n, err = process.Read(0, buf)
+	assert.NoError(err)
+	assert.Equal("seco", string(buf[:n]))
+	_, err = process.Write(0, buf)
+	assert.ErrorIs(err, vm.ErrBadDescriptor)
+	_, err = process.Write(1, buf)
+	assert.ErrorIs(err, vm.ErrBadDescriptor)
+
+	file := &ClosingBuffer{}
+	fd, err := process.Open(nil, file)
+	assert.NoError(err)
+	assert.Equal(1, fd)
+	dup, err := process.Dup(fd)
+	assert.NoError(err)
+	assert.Equal(2, dup)
+	_, err = process.Write(fd, []byte("a"))
+	assert.NoError(err)
+	_, err = process.Write(dup, []byte("b"))
+	assert.NoError(err)
+	assert.NoError(process.Close(fd))
+	assert.False(file.Closed)
+	assert.ErrorIs(process.Close(fd), vm.ErrBadDescriptor)
+	assert.NoError(process.Close(dup))
+	assert.True(file.Closed)
+	assert.Equal("ab", file.String())
+
+	fd, err = process.OpenBuffer([]byte("buffered"))
+	assert.NoError(err)
+	n, err = process.Read(fd, buf)
+	assert.NoError(err)
+	assert.Equal("buff", string(buf[:n]))
+
+	_, err = process.Open(nil, nil)
+	assert.Error(err)
+
+	r, w, err := process.Pipe()
+	assert.NoError(err)
+	assert.Equal(r+1, w)
+	_, err = process.Read(r, buf)
+	assert.ErrorIs(err, vm.ErrWouldBlock)
+	var blocked *vm.BlockedError
+	if assert.ErrorAs(err, &blocked) {
+		assert.Equal(fmt.Sprintf("read descriptor %d", r), blocked.Reason)
+		assert.False(blocked.Ready())
+	}
+	_, err = process.Write(w, []byte("pipe"))
+	assert.NoError(err)
+	n, err = process.Read(r, buf)
+	assert.NoError(err)
+	assert.Equal("pipe", string(buf[:n]))
+	assert.NoError(process.Close(w))
+	_, err = process.Read(r, buf)
+	assert.ErrorIs(err, io.EOF)
+}
+
+func TestSyscallRead(t *testing.T) {
+	assert := assert.New(t)
+
+	syscall := vm.DefaultBuiltins(vm.NewVM()).Get("syscall")
+	call := func(op vm.SyscallOp, fd int, buf common.Instructions) []common.Instructions {
+		return []common.Instructions{
+			common.NewOp(common.OpLoadI64, int(op)),
+			common.NewOp(common.OpLoadI64, fd),
+			buf,
+			common.NewOp(common.OpLoadBuiltin, syscall),
+			common.NewOp(common.OpCall, 3),
+		}
+	}
+
+	var main []common.Instructions
+	main = append(main, common.NewOp(common.OpAlloc, 16))
+	main = append(main, call(vm.SyscallReadLine, 0, common.NewOp(common.OpLoadLocal, 0))...)
+	main = append(main, call(vm.SyscallReadLine, 0, common.NewOp(common.OpLoadLocal, 0))...)
+	main = append(main, call(vm.SyscallRead, 0, common.NewOp(common.OpLoadLocal, 0))...)
+	// Pipe the buffer back to the host through a duplicated stdout
+	main = append(main, call(vm.SyscallPipe, 0, common.NewOp(common.OpLoadLocal, 0))...)
+	main = append(main, call(vm.SyscallDup, 1, common.NewOp(common.OpLoadLocal, 0))...)
+	main = append(main, call(vm.SyscallWrite, 4, common.NewOp(common.OpLoadLocal, 0))...)
+	main = append(main, call(vm.SyscallRead, 3, common.NewOp(common.OpLoadLocal, 0))...)
+	main = append(main, call(vm.SyscallClose, 4, common.NewOp(common.OpLoadLocal, 0))...)
+	main = append(main, call(vm.SyscallRead, 3, common.NewOp(common.OpLoadLocal, 0))...)
+	main = append(main, call(vm.SyscallWrite, 5, common.NewOp(common.OpLoadLocal, 0))...)
+	main = append(main, common.NewOp(common.OpHalt))
+
+	config := vm.DefaultConfig()
+	config.Stdin = strings.NewReader("first\nsecond\n")
+	stdout := new(bytes.Buffer)
+	config.Stdout = stdout
+	mod := common.NewModule("main", common.NewVersion(0, 0, 1))
+	machine := SetupConfiguredMachine(t, config, mod, nil, Fn("main", 0, main...))
+	machine.Run()
+	assert.False(machine.Paniced(), machine.PanicMessage())
+
+	expected := []int64{6, 7, 0, 3, 5, 16, 16, 0, 0, 16}
+	stack := machine.Thread().Stack()
+	if assert.Equal(len(expected)+1, stack.Len()) {
+		for i, n := range expected {
+			constant, err := stack.Get(i + 1)
+			assert.NoError(err)
+			assert.Equalf(n, constant.Value, "Syscall %d", i)
+		}
+	}
+	assert.Equal("second\n", stdout.String()[:7])
+	assert.Len(stdout.String(), 16)
+}
+
+func TestPipe(t *testing.T) {
+	assert := assert.New(t)
+
+	syscall := vm.DefaultBuiltins(vm.NewVM()).Get("syscall")
+	call := func(op vm.SyscallOp, fd int, buf common.Instructions) []common.Instructions {
+		return []common.Instructions{
+			common.NewOp(common.OpLoadI64, int(op)),
+			common.NewOp(common.OpLoadI64, fd),
+			buf,
+			common.NewOp(common.OpLoadBuiltin, syscall),
+			common.NewOp(common.OpCall, 3),
+		}
+	}
+
+	var ping, writer, closer int
+	module := func() *common.Module {
+		mod := common.NewModule("main", common.NewVersion(0, 0, 1))
+		set := func(c *common.Const) int {
+			idx, err := mod.Consts.Set(mod.Consts.Len()+1, c)
+			assert.NoError(err)
+			return idx
+		}
+		ping = set(common.NewConst(common.DataConst, []byte("ping")))
+		var ops []common.Instructions
+		ops = append(ops, call(vm.SyscallWrite, 4, common.NewOp(common.OpLoadConst, ping))...)
+		writer = set(Fn("writer", 0, append(ops, common.NewOp(common.OpPop), common.NewOp(common.OpReturn))...))
+		ops = call(vm.SyscallClose, 4, common.NewOp(common.OpLoadI64, 0))
+		closer = set(Fn("closer", 0, append(ops, common.NewOp(common.OpPop), common.NewOp(common.OpReturn))...))
+		return mod
+	}
+	module()
+
+	type PipeTest struct {
+		Thread        int
+		ExpectedTop   any
+		ExpectedError error
+	}
+
+	tests := []PipeTest{
+		// The read parks the main thread until the writer fills the pipe
+		{writer, int64(4), nil},
+		// Closing the write end wakes the reader at the end of the stream
+		{closer, int64(0), nil},
+		// Nothing ever writes to the pipe
+		{-1, nil, vm.ErrDeadlock},
+	}
+
+	for i, test := range tests {
+		var main []common.Instructions
+		main = append(main, common.NewOp(common.OpAlloc, 16))
+		main = append(main, call(vm.SyscallPipe, 0, common.NewOp(common.OpLoadLocal, 0))...)
+		main = append(main, common.NewOp(common.OpPop))
+		if test.Thread >= 0 {
+			main = append(main, common.NewOp(common.OpLoadConst, test.Thread), common.NewOp(common.OpSpawn, 0), common.NewOp(common.OpPop))
+		}
+		main = append(main, call(vm.SyscallRead, 3, common.NewOp(common.OpLoadLocal, 0))...)
+		main = append(main, common.NewOp(common.OpHalt))
+
+		machine := SetupMachine(t, module(), nil, Fn("main", 0, main...))
+		machine.Run()
+
+		if test.ExpectedError != nil {
+			assert.Truef(machine.Paniced(), "Test case %d", i)
+			assert.ErrorIsf(machine.Err(), test.ExpectedError, "Test case %d", i)
+			assert.Containsf(machine.PanicMessage(), "thread 0 blocked on read descriptor 3", "Test case %d", i)
+			continue
+		}
+		assert.Falsef(machine.Paniced(), "Test case %d: %s", i, machine.PanicMessage())
+		top, err := machine.Thread().Stack().Top()
+		assert.NoErrorf(err, "Test case %d", i)
+		assert.Equalf(test.ExpectedTop, top.Value, "Test case %d", i)
+	}
+}
+
+func TestFileSyscalls(t *testing.T) {
+	assert := assert.New(t)
+
+	mem := vfs.NewMemFS()
+	assert.NoError(mem.WriteFile("data/input.txt", []byte("input")))
+	assert.NoError(mem.WriteFile("secret.txt", []byte("secret")))
+
+	syscall := vm.DefaultBuiltins(vm.NewVM()).Get("syscall")
+	var log, out, secret, content int
+	module := func() *common.Module {
+		mod := common.NewModule("main", common.NewVersion(0, 0, 1))
+		set := func(c *common.Const) int {
+			idx, err := mod.Consts.Set(mod.Consts.Len()+1, c)
+			assert.NoError(err)
+			return idx
+		}
+		log = set(common.NewConst(common.StrConst, "/data/out/log.txt"))
+		out = set(common.NewConst(common.StrConst, "data/out"))
+		secret = set(common.NewConst(common.StrConst, "secret.txt"))
+		content = set(common.NewConst(common.DataConst, []byte("logged")))
+		return mod
+	}
+	module()
+	call := func(op vm.SyscallOp, fd int, buf common.Instructions) []common.Instructions {
+		return []common.Instructions{
+			common.NewOp(common.OpLoadI64, int(op)),
+			common.NewOp(common.OpLoadI64, fd),
+			buf,
+			common.NewOp(common.OpLoadBuiltin, syscall),
+			common.NewOp(common.OpCall, 3),
+		}
+	}
+
+	var main []common.Instructions
+	main = append(main, common.NewOp(common.OpAlloc, 8))
+	main = append(main, call(vm.SyscallOpen, int(vm.OpenWrite), common.NewOp(common.OpLoadConst, log))...)
+	main = append(main, call(vm.SyscallWrite, 3, common.NewOp(common.OpLoadConst, content))...)
+	main = append(main, call(vm.SyscallClose, 3, common.NewOp(common.OpLoadLocal, 0))...)
+	main = append(main, call(vm.SyscallStat, 0, common.NewOp(common.OpLoadConst, log))...)
+	main = append(main, call(vm.SyscallStat, 0, common.NewOp(common.OpLoadConst, out))...)
+	main = append(main, call(vm.SyscallOpen, int(vm.OpenRead), common.NewOp(common.OpLoadConst, log))...)
+	main = append(main, call(vm.SyscallRead, 3, common.NewOp(common.OpLoadLocal, 0))...)
+	main = append(main, call(vm.SyscallReadDir, 0, common.NewOp(common.OpLoadConst, out))...)
+	main = append(main, call(vm.SyscallRemove, 0, common.NewOp(common.OpLoadConst, log))...)
+	main = append(main, call(vm.SyscallStat, 0, common.NewOp(common.OpLoadConst, log))...)
+	main = append(main, call(vm.SyscallReadLine, 4, common.NewOp(common.OpLoadLocal, 0))...)
+	main = append(main, call(vm.SyscallOpen, int(vm.OpenRead), common.NewOp(common.OpLoadConst, secret))...)
+	main = append(main, common.NewOp(common.OpHalt))
+
+	config := vm.DefaultConfig()
+	config.FS = vfs.NewSandbox(mem).Grant("data/out", vfs.Read|vfs.Write)
+	machine := SetupConfiguredMachine(t, config, module(), nil, Fn("main", 0, main...))
+	machine.Run()
+
+	assert.True(machine.Paniced())
+	assert.ErrorIs(machine.Err(), fs.ErrPermission)
+	assert.Contains(machine.PanicMessage(), "open secret.txt: permission denied")
+
+	expected := []int64{3, 6, 0, 6, vm.STAT_DIR, 3, 6, 4, 0, vm.STAT_NOT_EXIST, 8}
+	stack := machine.Thread().Stack()
+	for i, n := range expected {
+		constant, err := stack.Get(i + 1)
+		assert.NoError(err)
+		assert.Equalf(n, constant.Value, "Syscall %d", i)
+	}
+	handle, err := vm.GetRef(common.NewConst(common.RefConst, uint32(1)))
+	assert.NoError(err)
+	data, err := machine.Heap().Bytes(handle)
+	assert.NoError(err)
+	assert.Equal("log.txt\n", string(data))
+
+	machine = SetupConfiguredMachine(t, vm.DefaultConfig(), module(), nil, Fn("main", 0, main...))
+	machine.Run()
+	assert.ErrorIs(machine.Err(), vm.ErrNoFilesystem)
+}
+
+func TestArgs(t *testing.T) {
+	assert := assert.New(t)
+
+	builtins := vm.DefaultBuiltins(vm.NewVM())
+	var name, missing int
+	module := func() *common.Module {
+		mod := common.NewModule("main", common.NewVersion(0, 0, 1))
+		var err error
+		name, err = mod.Consts.Set(0, common.NewConst(common.StrConst, "NAME"))
+		assert.NoError(err)
+		missing, err = mod.Consts.Set(1, common.NewConst(common.StrConst, "MISSING"))
+		assert.NoError(err)
+		return mod
+	}
+	module()
+
+	main := Fn("main", 0,
+		common.NewOp(common.OpLoadBuiltin, builtins.Get("argc")),
+		common.NewOp(common.OpCall, 0),
+		common.NewOp(common.OpLoadI64, 2),
+		common.NewOp(common.OpLoadBuiltin, builtins.Get("argv")),
+		common.NewOp(common.OpCall, 1),
+		common.NewOp(common.OpLoadConst, name),
+		common.NewOp(common.OpLoadBuiltin, builtins.Get("getenv")),
+		common.NewOp(common.OpCall, 1),
+		common.NewOp(common.OpLoadConst, missing),
+		common.NewOp(common.OpLoadBuiltin, builtins.Get("getenv")),
+		common.NewOp(common.OpCall, 1),
+		common.NewOp(common.OpLoadI64, 3),
+		common.NewOp(common.OpLoadBuiltin, builtins.Get("argv")),
+		common.NewOp(common.OpCall, 1),
+		common.NewOp(common.OpHalt),
+	)
+
+	machine := vm.NewVM()
+	mod := module()
+	fnidx, err := mod.Consts.Set(compiler.POOL_WRITE_LIMIT, main)
+	assert.NoError(err)
+	archive := common.NewArchive()
+	modidx, err := archive.AddModule(mod)
+	assert.NoError(err)
+	archive.SetEntry(modidx, fnidx)
+	assert.NoError(machine.Init(archive, vm.DefaultBuiltins(machine),
+		vm.WithArgs("prog.flar", "a", "b"),
+		vm.WithEnv(map[string]string{"NAME": "flint"}),
+	))
+	machine.Run()
+
+	assert.True(machine.Paniced())
+	assert.Contains(machine.PanicMessage(), "argument index 3 out of range with 3 arguments")
+	expected := []any{int64(3), "b", "flint", ""}
+	stack := machine.Thread().Stack()
+	for i, value := range expected {
+		constant, err := stack.Get(i)
+		assert.NoError(err)
+		assert.Equalf(value, constant.Value, "Value %d", i)
+	}
+}
+
+func TestBind(t *testing.T) {
+	assert := assert.New(t)
+
+	errNegative := errors.New("negative scale")
+	var logged []string
+	builtins := vm.DefaultBuiltins(vm.NewVM())
+	assert.NoError(builtins.RegisterFunc("scale", func(s string, n int64) (float64, error) {
+		if n < 0 {
+			return 0, errNegative
+		}
+		return float64(len(s)) * float64(n), nil
+	}))
+	assert.NoError(builtins.RegisterFunc("log", func(s string, b bool) {
+		logged = append(logged, fmt.Sprint(s, b))
+	}))
+
+	var text, yes int
+	module := func() *common.Module {
+		mod := common.NewModule("main", common.NewVersion(0, 0, 1))
+		var err error
+		text, err = mod.Consts.Set(0, common.NewConst(common.StrConst, "flint"))
+		assert.NoError(err)
+		yes, err = mod.Consts.Set(1, common.NewConst(common.TrueConst, nil))
+		assert.NoError(err)
+		return mod
+	}
+	module()
+
+	tests := []struct {
+		ops      []common.Instructions
+		expected any
+		err      error
+	}{
+		{
+			[]common.Instructions{
+				common.NewOp(common.OpLoadConst, text),
+				common.NewOp(common.OpLoadI64, 3),
+				common.NewOp(common.OpLoadBuiltin, builtins.Get("scale")),
+				common.NewOp(common.OpCall, 2),
+				common.NewOp(common.OpLoadConst, text),
+				common.NewOp(common.OpLoadConst, yes),
+				common.NewOp(common.OpLoadBuiltin, builtins.Get("log")),
+				common.NewOp(common.OpCall, 2),
+				// Plain returns leave an empty constant behind
+				common.NewOp(common.OpPop),
+				common.NewOp(common.OpHalt),
+			},
+			float64(15),
+			nil,
+		},
+		{
+			[]common.Instructions{
+				common.NewOp(common.OpLoadI64, 3),
+				common.NewOp(common.OpLoadI64, 3),
+				common.NewOp(common.OpLoadBuiltin, builtins.Get("scale")),
+				common.NewOp(common.OpCall, 2),
+				common.NewOp(common.OpHalt),
+			},
+			nil,
+			vm.ErrConstTypeInvalid,
+		},
+		{
+			[]common.Instructions{
+				common.NewOp(common.OpLoadConst, text),
+				common.NewOp(common.OpLoadI64, -1),
+				common.NewOp(common.OpLoadBuiltin, builtins.Get("scale")),
+				common.NewOp(common.OpCall, 2),
+				common.NewOp(common.OpHalt),
+			},
+			nil,
+			errNegative,
+		},
+	}
+
+	for i, test := range tests {
+		machine := SetupMachine(t, module(), builtins, Fn("main", 0, test.ops...))
+		machine.Run()
+
+		if test.err != nil {
+			assert.Truef(machine.Paniced(), "Test case %d", i)
+			assert.ErrorIsf(machine.Err(), test.err, "Test case %d", i)
+			continue
+		}
+		assert.Falsef(machine.Paniced(), "Test case %d: %s", i, machine.PanicMessage())
+		top, err := machine.Thread().Stack().Top()
+		assert.NoError(err)
+		assert.Equalf(test.expected, top.Value, "Test case %d", i)
+	}
+	assert.Equal([]string{"flinttrue"}, logged)
+
+	_, err := vm.Bind("chan", func(chan int) {})
+	assert.ErrorIs(err, vm.ErrUnsupportedType)
+	_, err = vm.Bind("variadic", func(...int64) {})
+	assert.ErrorIs(err, vm.ErrUnsupportedType)
+	_, err = vm.Bind("results", func() (int64, int64) { return 0, 0 })
+	assert.ErrorIs(err, vm.ErrUnsupportedType)
+	_, err = vm.Bind("value", 42)
+	assert.ErrorIs(err, vm.ErrUnsupportedType)
+
+	for _, value := range []any{int64(-4), uint8(7), float32(1.5), "text", []byte("data"), true, false} {
+		c, err := vm.ToConst(value)
+		assert.NoError(err)
+		back, err := vm.FromConst(c, reflect.TypeOf(value))
+		assert.NoError(err)
+		assert.Equal(value, back.Interface())
+	}
+	c, err := vm.ToConst(7)
+	assert.NoError(err)
+	assert.Equal(common.I64Const, c.Type)
+	_, err = vm.FromConst(c, reflect.TypeFor[string]())
+	assert.ErrorIs(err, vm.ErrConstTypeInvalid)
+}
+
+func TestVMCall(t *testing.T) {
+	assert := assert.New(t)
+
+	mod := common.NewModule("math", common.NewVersion(0, 0, 1))
+	for i, fn := range []*common.Const{
+		Fn("math.main", 0,
+			common.NewOp(common.OpLoadI64, 1),
+			common.NewOp(common.OpHalt),
+		),
+		Fn("math.div", 2,
+			common.NewOp(common.OpLoadLocal, 0),
+			common.NewOp(common.OpLoadLocal, 1),
+			common.NewOp(common.OpDivI64),
+			common.NewOp(common.OpReturnValue),
+		),
+		Fn("math.nothing", 0,
+			common.NewOp(common.OpReturn),
+		),
+	} {
+		pointer, err := mod.Consts.Set(i, fn)
+		assert.NoError(err)
+		name := strings.TrimPrefix(fn.Value.(common.Fn).Name(), "math.")
+		visibility := common.Public
+		if name == "main" {
+			visibility = common.Private
+		}
+		assert.NoError(mod.Symbols.Add(common.Symbol{Name: name, Visibility: visibility, Pointer: pointer}))
+	}
+
+	machine := vm.NewVM()
+	_, err := machine.Call("math", "div", int64(1), int64(1))
+	assert.ErrorIs(err, vm.ErrNotInitialized)
+
+	archive := common.NewArchive()
+	modidx, err := archive.AddModule(mod)
+	assert.NoError(err)
+	archive.SetEntry(modidx, mod.Consts.Lookup(0))
+	assert.NoError(machine.Init(archive, vm.DefaultBuiltins(machine)))
+	machine.Run()
+	assert.True(machine.Halted())
+
+	result, err := machine.Call("math", "div", 12, int64(4))
+	assert.NoError(err)
+	assert.Equal(int64(3), result)
+
+	quotient, err := vm.CallAs[int](machine, "math", "div", 7, 2)
+	assert.NoError(err)
+	assert.Equal(3, quotient)
+
+	result, err = machine.Call("math", "nothing")
+	assert.NoError(err)
+	assert.Nil(result)
+
+	_, err = machine.Call("math", "div", 1, 0)
+	var trap *vm.TrapError
+	assert.ErrorAs(err, &trap)
+	assert.ErrorIs(err, vm.ErrDivideByZero)
+	assert.Contains(trap.Message, "divide by zero")
+	assert.Contains(trap.Trace, "math.div (+10)")
+
+	_, err = machine.Call("math", "div", "1", 0)
+	assert.ErrorIs(err, vm.ErrConstTypeInvalid)
+	_, err = machine.Call("math", "div", 1)
+	assert.ErrorIs(err, vm.ErrIncorrectNumberOfArgs)
+	_, err = machine.Call("math", "div", 1, make(chan int))
+	assert.ErrorIs(err, vm.ErrUnsupportedType)
+	_, err = machine.Call("math", "mul", 1, 2)
+	assert.ErrorIs(err, common.ErrSymbolNotFound)
+	_, err = machine.Call("math", "main")
+	assert.ErrorIs(err, common.ErrSymbolPrivate)
+	_, err = machine.Call("strings", "div", 1, 2)
+	assert.ErrorIs(err, common.ErrModuleNotFound)
+	_, err = vm.CallAs[string](machine, "math", "div", 1, 1)
+	assert.ErrorIs(err, vm.ErrConstTypeInvalid)
+
+	// Calls leave the state of the program alone
+	assert.True(machine.Halted())
+	assert.False(machine.Paniced())
+	assert.Len(machine.Threads(), 1)
+	top, err := machine.Thread().Stack().Top()
+	assert.NoError(err)
+	assert.Equal(int64(1), top.Value)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = vm.CallAsContext[int](ctx, machine, "math", "div", 4, 2)
+	assert.ErrorIs(err, vm.ErrInterrupted)
+
+	// A call running out of fuel uses up the fuel without starving the program
+	machine.SetFuel(2)
+	_, err = machine.Call("math", "div", 4, 2)
+	assert.ErrorIs(err, vm.ErrOutOfFuel)
+	assert.False(machine.Starved())
+	assert.True(machine.Halted())
+}
+
+func TestCrossModuleCall(t *testing.T) {
+	assert := assert.New(t)
+
+	lib := common.NewModule("lib", common.NewVersion(0, 0, 1))
+	_, err := lib.Consts.Set(0, common.NewConst(common.StrConst, "lib"))
+	assert.NoError(err)
+	name, err := lib.Consts.Set(1, Fn("lib.name", 0,
+		common.NewOp(common.OpLoadConst, 0),
+		common.NewOp(common.OpReturnValue),
+	))
+	assert.NoError(err)
+	// Returns a function of its own module for the caller to call
+	getter, err := lib.Consts.Set(2, Fn("lib.getter", 0,
+		common.NewOp(common.OpLoadConst, name),
+		common.NewOp(common.OpReturnValue),
+	))
+	assert.NoError(err)
+	assert.NoError(lib.Symbols.Add(common.Symbol{Name: "getter", Visibility: common.Public, Pointer: getter}))
+
+	// Modules are linked by name, wherever they are placed in the archive
+	archive := common.NewArchive()
+	_, err = archive.AddModule(common.NewModule("other", common.NewVersion(0, 0, 1)))
+	assert.NoError(err)
+	_, err = archive.AddModule(lib)
+	assert.NoError(err)
+
+	mod := common.NewModule("main", common.NewVersion(0, 0, 1))
+	_, err = mod.Consts.Set(0, common.NewConst(common.I64Const, int64(7)))
+	assert.NoError(err)
+	libidx, err := mod.Links.Set(0, common.NewLink("lib"))
+	assert.NoError(err)
+	main := Fn("main.main", 0,
+		common.NewOp(common.OpLoadModConst, libidx, name),
+		common.NewOp(common.OpCall, 0),
+		common.NewOp(common.OpLoadModConst, libidx, getter),
+		common.NewOp(common.OpCall, 0),
+		common.NewOp(common.OpCall, 0),
+		common.NewOp(common.OpLoadModConst, libidx, name),
+		common.NewOp(common.OpSpawn, 0),
+		common.NewOp(common.OpJoin),
+		common.NewOp(common.OpLoadConst, 0),
+		common.NewOp(common.OpHalt),
+	)
+	fnidx, err := mod.Consts.Set(compiler.POOL_WRITE_LIMIT, main)
+	assert.NoError(err)
+	modidx, err := archive.AddModule(mod)
+	assert.NoError(err)
+	archive.SetEntry(modidx, fnidx)
+
+	machine := vm.NewVM()
+	assert.NoError(machine.Init(archive, vm.DefaultBuiltins(machine)))
+	machine.Run()
+
+	assert.False(machine.Paniced(), machine.PanicMessage())
+	expected := []any{"lib", "lib", "lib", int64(7)}
+	stack := machine.Thread().Stack()
+	assert.Equal(len(expected), stack.Len())
+	for i, value := range expected {
+		constant, err := stack.Get(i)
+		assert.NoError(err)
+		assert.Equalf(value, constant.Value, "Value %d", i)
+	}
+
+	// Hosts get the fn itself, not its binding to lib
+	fn, err := machine.Call("lib", "getter")
+	assert.NoError(err)
+	assert.IsType(&common.CompiledFn{}, fn)
+
+	// A fn const is bound once and the same const is loaded every time
+	mod = common.NewModule("main", common.NewVersion(0, 0, 1))
+	add, err := mod.Consts.Set(0, Add())
+	assert.NoError(err)
+	machine = SetupMachine(t, mod, nil, Fn("main.main", 0,
+		common.NewOp(common.OpLoadConst, add),
+		common.NewOp(common.OpLoadConst, add),
+		common.NewOp(common.OpHalt),
+	))
+	machine.Run()
+	assert.False(machine.Paniced(), machine.PanicMessage())
+	first, err := machine.Thread().Stack().Get(0)
+	assert.NoError(err)
+	second, err := machine.Thread().Stack().Get(1)
+	assert.NoError(err)
+	assert.Same(first, second)
+
+	// Links are checked against the version of the module in the archive
+	mod = common.NewModule("main", common.NewVersion(0, 0, 1))
+	constraint, err := common.ParseConstraint("^0.1.0")
+	assert.NoError(err)
+	libidx, err = mod.Links.Set(0, common.NewVersionedLink("lib", constraint))
+	assert.NoError(err)
+	machine = SetupMachine(t, mod, nil, Fn("main.main", 0,
+		common.NewOp(common.OpLoadModConst, libidx, name),
+		common.NewOp(common.OpHalt),
+	))
+	_, err = machine.Archive().AddModule(lib)
+	assert.NoError(err)
+	machine.Run()
+	assert.True(machine.Paniced())
+	assert.ErrorIs(machine.Err(), common.ErrVersionMismatch)
+	assert.Contains(machine.PanicMessage(), "lib 0.0.1 requires ^0.1.0")
+
+	// Each link loads the version of lib it asks for when both are in the archive
+	next := common.NewModule("lib", common.NewVersion(0, 1, 0))
+	_, err = next.Consts.Set(0, common.NewConst(common.StrConst, "next"))
+	assert.NoError(err)
+	nextname, err := next.Consts.Set(1, Fn("lib.name", 0,
+		common.NewOp(common.OpLoadConst, 0),
+		common.NewOp(common.OpReturnValue),
+	))
+	assert.NoError(err)
+	mod = common.NewModule("main", common.NewVersion(0, 0, 1))
+	oldidx, err := mod.Links.Set(0, common.NewVersionedLink("lib", common.Constraint{Kind: common.ExactVersion, Version: lib.Version}))
+	assert.NoError(err)
+	newidx, err := mod.Links.Set(1, common.NewVersionedLink("lib", constraint))
+	assert.NoError(err)
+	machine = SetupMachine(t, mod, nil, Fn("main.main", 0,
+		common.NewOp(common.OpLoadModConst, oldidx, name),
+		common.NewOp(common.OpCall, 0),
+		common.NewOp(common.OpLoadModConst, newidx, nextname),
+		common.NewOp(common.OpCall, 0),
+		common.NewOp(common.OpHalt),
+	))
+	_, err = machine.Archive().AddModule(lib)
+	assert.NoError(err)
+	_, err = machine.Archive().AddModule(next)
+	assert.NoError(err)
+	machine.Run()
+	assert.False(machine.Paniced(), machine.PanicMessage())
+	for i, value := range []string{"lib", "next"} {
+		constant, err := machine.Thread().Stack().Get(i)
+		assert.NoError(err)
+		assert.Equal(value, constant.Value)
+	}
+
+	// Links the compiler resolved load that version even when a newer one satisfies them
+	last := common.NewModule("lib", common.NewVersion(0, 1, 1))
+	_, err = last.Consts.Set(0, common.NewConst(common.StrConst, "last"))
+	assert.NoError(err)
+	lastname, err := last.Consts.Set(1, Fn("lib.name", 0,
+		common.NewOp(common.OpLoadConst, 0),
+		common.NewOp(common.OpReturnValue),
+	))
+	assert.NoError(err)
+	assert.Equal(nextname, lastname)
+	mod = common.NewModule("main", common.NewVersion(0, 0, 1))
+	resolved := common.NewVersionedLink("lib", constraint)
+	resolved.Resolved = true
+	resolved.Version = next.Version
+	residx, err := mod.Links.Set(0, resolved)
+	assert.NoError(err)
+	newidx, err = mod.Links.Set(1, common.NewVersionedLink("lib", constraint))
+	assert.NoError(err)
+	machine = SetupMachine(t, mod, nil, Fn("main.main", 0,
+		common.NewOp(common.OpLoadModConst, residx, nextname),
+		common.NewOp(common.OpCall, 0),
+		common.NewOp(common.OpLoadModConst, newidx, lastname),
+		common.NewOp(common.OpCall, 0),
+		common.NewOp(common.OpHalt),
+	))
+	_, err = machine.Archive().AddModule(last)
+	assert.NoError(err)
+	_, err = machine.Archive().AddModule(next)
+	assert.NoError(err)
+	machine.Run()
+	assert.False(machine.Paniced(), machine.PanicMessage())
+	for i, value := range []string{"next", "last"} {
+		constant, err := machine.Thread().Stack().Get(i)
+		assert.NoError(err)
+		assert.Equal(value, constant.Value)
+	}
+}